@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The aligners -align-with can run on -fastq reads.
+var alignCommands = []string{"bwa-mem2", "bwa", "minimap2", "bowtie2", "hisat2", "STAR"}
+
+// The command aligning reads to a reference (an index prefix for bwa,
+// bowtie2 and hisat2, a genome directory for STAR) and writing SAM with
+// a header to stdout. Paired reads come in two files, or interleaved on
+// stdin when the one file is -.
+func AlignCommand(aligner, reference string, fastqs []string, threads int) (*exec.Cmd, error) {
+	t := strconv.Itoa(threads)
+	interleaved := len(fastqs) == 1 && fastqs[0] == "-"
+	var cmdArgs []string
+	switch aligner {
+	case "bwa-mem2", "bwa":
+		cmdArgs = []string{"mem", "-t", t}
+		if interleaved {
+			cmdArgs = append(cmdArgs, "-p")
+		}
+		cmdArgs = append(append(cmdArgs, reference), fastqs...)
+	case "minimap2":
+		cmdArgs = append([]string{"-a", "-x", "sr", "-t", t, reference}, fastqs...)
+	case "bowtie2", "hisat2":
+		cmdArgs = []string{"-p", t, "-x", reference}
+		if interleaved {
+			cmdArgs = append(cmdArgs, "--interleaved", "-")
+		} else if len(fastqs) == 2 {
+			cmdArgs = append(cmdArgs, "-1", fastqs[0], "-2", fastqs[1])
+		} else {
+			cmdArgs = append(cmdArgs, "-U", fastqs[0])
+		}
+	case "STAR":
+		if interleaved {
+			return nil, fmt.Errorf("STAR can't align reads piped to it, use -align-with another aligner")
+		}
+		prefix := fmt.Sprintf("contfilter.%d.%s.", os.Getpid(), filepath.Base(reference))
+		if args.SortTmpDir != "" {
+			prefix = filepath.Join(args.SortTmpDir, prefix)
+		} else {
+			prefix = filepath.Join(os.TempDir(), prefix)
+		}
+		cmdArgs = []string{"--runThreadN", t, "--genomeDir", reference, "--outSAMtype", "SAM",
+			"--outStd", "SAM", "--outSAMunmapped", "Within", "--outFileNamePrefix", prefix, "--readFilesIn"}
+		cmdArgs = append(cmdArgs, fastqs...)
+		if strings.HasSuffix(fastqs[0], ".gz") {
+			cmdArgs = append(cmdArgs, "--readFilesCommand", "zcat")
+		}
+	default:
+		return nil, fmt.Errorf("-align-with must be one of %s", strings.Join(alignCommands, ", "))
+	}
+	return exec.Command(aligner, cmdArgs...), nil
+}
+
+// The one or two FASTQ files of -fastq.
+func fastqFiles() ([]string, error) {
+	fastqs := strings.Split(args.Fastq, ",")
+	if len(fastqs) > 2 {
+		return nil, fmt.Errorf("-fastq takes one file, or two for paired reads, not %d", len(fastqs))
+	}
+	for _, fastq := range fastqs {
+		if _, err := os.Stat(fastq); err != nil {
+			return nil, err
+		}
+	}
+	return fastqs, nil
+}
+
+// Align the -fastq reads to a reference and scan the alignments as they come
+// out of samtools sort, named after the reference.
+func openAligned(scanner *BamScanner, reference string, fastqs []string) error {
+	align, err := AlignCommand(args.AlignWith, reference, fastqs, args.AlignThreads)
+	if err != nil {
+		return err
+	}
+	logger.Printf("aligning %s to %s with %s\n", args.Fastq, reference, args.AlignWith)
+	return scanner.OpenAligning(reference, []*exec.Cmd{align}, args.SortTmpDir, args.SortMem, args.SortOrder == "lexicographic")
+}
+
+// Whether a contamination file is a reference to align the sample's reads to
+// rather than a mapping of them.
+func IsFasta(filename string) bool {
+	name := strings.TrimSuffix(strings.ToLower(filename), ".gz")
+	for _, ext := range []string{".fa", ".fasta", ".fna"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// Align the reads of the -sample BAM, as samtools fastq gives them back, to a
+// contamination reference.
+func openExtracted(scanner *BamScanner, reference string) error {
+	if args.Sample == "" {
+		return fmt.Errorf("%s is a reference, which needs the -sample BAM to take reads from rather than stdin", reference)
+	}
+	if nativeIO() {
+		return needsSamtools("aligning the sample's reads to " + reference)
+	}
+	extract := samtoolsCommand("fastq", "-n", args.Sample)
+	align, err := AlignCommand(args.AlignWith, reference, []string{"-"}, args.AlignThreads)
+	if err != nil {
+		return err
+	}
+	logger.Printf("aligning the reads of %s to %s with %s\n", args.Sample, reference, args.AlignWith)
+	return scanner.OpenAligning(reference, []*exec.Cmd{extract, align}, args.SortTmpDir, args.SortMem, args.SortOrder == "lexicographic")
+}
+
+// Open the inputs of a run from -fastq, the sample being the reads aligned to
+// -reference and each contamination mapping the reads aligned to the
+// reference given in its place.
+func (run *Run) openAligning() error {
+	fastqs, err := fastqFiles()
+	if err != nil {
+		return err
+	}
+	// We sort the alignments ourselves, in whatever order is asked for.
+	if args.SortOrder == "auto" {
+		args.SortOrder = "natural"
+	}
+	if args.SortOrder == "lexicographic" {
+		nameCmp = strings.Compare
+	}
+	run.Sample = &BamScanner{}
+	if err := openAligned(run.Sample, args.Reference, fastqs); err != nil {
+		return err
+	}
+	run.SampleSorted = true
+	run.SampleHeader, err = run.Sample.ReadHeader()
+	if err != nil {
+		return err
+	}
+	run.SampleAligner = ChooseAligner(sampleName(), run.SampleHeader)
+	logger.Printf("sample %s: %s, edit distance from %s\n", sampleName(), run.SampleAligner.Name, run.SampleAligner.EditTag)
+	for _, cont := range run.Contamination {
+		contScanner := &BamScanner{}
+		if err := openAligned(contScanner, cont.Filename, fastqs); err != nil {
+			return err
+		}
+		header, err := contScanner.ReadHeader()
+		if err != nil {
+			return err
+		}
+		cont.Aligner = ChooseAligner(cont.Filename, header)
+		logger.Printf("contamination %s: %s, edit distance from %s\n", cont.Filename, cont.Aligner.Name, cont.Aligner.EditTag)
+		run.Sources = append(run.Sources, contScanner)
+	}
+	return nil
+}
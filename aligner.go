@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+)
+
+// The optional fields an aligner reports edit distance and alignment score in.
+type Aligner struct {
+	Name     string
+	EditTag  string
+	ScoreTag string
+}
+
+var knownAligners = []Aligner{
+	{"STAR", "nM", "AS"},
+	{"bwa-mem2", "NM", "AS"},
+	{"bwa", "NM", "AS"},
+	{"bowtie2", "NM", "AS"},
+	{"bowtie", "NM", ""},
+	{"hisat2", "NM", "AS"},
+	{"minimap2", "NM", "AS"},
+}
+
+// What we assume when the header doesn't name an aligner we know.
+var defaultAligner = Aligner{"unknown", "nM", "AS"}
+
+// Work out which aligner produced a file from the @PG lines of its header,
+// going by the first program we recognize.
+func DetectAligner(header string) (Aligner, bool) {
+	for _, line := range strings.Split(header, "\n") {
+		if !strings.HasPrefix(line, "@PG\t") {
+			continue
+		}
+		for _, field := range strings.Split(line, "\t")[1:] {
+			if !strings.HasPrefix(field, "PN:") && !strings.HasPrefix(field, "ID:") {
+				continue
+			}
+			program := strings.ToLower(field[3:])
+			for _, aligner := range knownAligners {
+				if program == strings.ToLower(aligner.Name) {
+					return aligner, true
+				}
+			}
+		}
+	}
+	return defaultAligner, false
+}
+
+// Settle on the tags to use for an input, applying -edit-tag and -score-tag.
+func ChooseAligner(filename, header string) *Aligner {
+	detected, ok := DetectAligner(header)
+	if !ok && (args.EditTag == "auto" || args.ScoreTag == "auto") {
+		logger.Printf("couldn't tell which aligner produced %s, assuming %s edit distances\n", filename, detected.EditTag)
+	}
+	aligner := detected
+	if args.EditTag != "auto" {
+		aligner.EditTag = args.EditTag
+	}
+	switch args.ScoreTag {
+	case "auto":
+	case "":
+		aligner.ScoreTag = ""
+	default:
+		aligner.ScoreTag = args.ScoreTag
+	}
+	return &aligner
+}
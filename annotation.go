@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Genes from a GTF or GFF3 annotation, for counting the reads kept and
+// rejected on each with -gtf. A gene is made up of its features of the chosen
+// type, exons by default in a GTF or genes in a GFF3, and a read counts for
+// every gene a feature of which its first mate's alignment overlaps.
+type Annotation struct {
+	Genes    []*Gene
+	features map[string][]geneFeature // by contig
+	bins     map[string]map[int][]int // contig and bin to indexes into features
+}
+
+type Gene struct {
+	Id       string
+	Name     string
+	Kept     int
+	Rejected int
+}
+
+type geneFeature struct {
+	start, end int // 1-based, inclusive
+	gene       *Gene
+}
+
+const annotationBinSize = 1 << 16
+
+// Pull one attribute out of a GTF (key "value";) or GFF3 (key=value;) list.
+func gtfAttribute(attributes, key string, gff bool) string {
+	for _, attr := range strings.Split(attributes, ";") {
+		attr = strings.TrimSpace(attr)
+		if gff {
+			if strings.HasPrefix(attr, key+"=") {
+				return attr[len(key)+1:]
+			}
+		} else if strings.HasPrefix(attr, key+" ") {
+			return strings.Trim(strings.TrimSpace(attr[len(key)+1:]), `"`)
+		}
+	}
+	return ""
+}
+
+// Read an annotation, gzipped or not. The feature type goes by the file name
+// when empty.
+func ReadAnnotation(filename, featureType string) (*Annotation, error) {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	var r io.Reader = fp
+	name := filename
+	if strings.HasSuffix(name, ".gz") {
+		gz, err := gzip.NewReader(fp)
+		if err != nil {
+			return nil, err
+		}
+		r = gz
+		name = strings.TrimSuffix(name, ".gz")
+	}
+	gff := strings.HasSuffix(name, ".gff") || strings.HasSuffix(name, ".gff3")
+	if featureType == "" {
+		featureType = "exon"
+		if gff {
+			featureType = "gene"
+		}
+	}
+	idKey, nameKey := "gene_id", "gene_name"
+	if gff {
+		idKey, nameKey = "ID", "Name"
+	}
+
+	a := &Annotation{
+		features: make(map[string][]geneFeature),
+		bins:     make(map[string]map[int][]int),
+	}
+	genes := make(map[string]*Gene)
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		fields := strings.Split(text, "\t")
+		if len(fields) != 9 {
+			return nil, fmt.Errorf("%s line %d: expected 9 columns, found %d", filename, line, len(fields))
+		}
+		if fields[2] != featureType {
+			continue
+		}
+		start, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: bad start: %v", filename, line, err)
+		}
+		end, err := strconv.Atoi(fields[4])
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: bad end: %v", filename, line, err)
+		}
+		id := gtfAttribute(fields[8], idKey, gff)
+		if id == "" {
+			return nil, fmt.Errorf("%s line %d: %s has no %s", filename, line, featureType, idKey)
+		}
+		gene, ok := genes[id]
+		if !ok {
+			gene = &Gene{Id: id, Name: gtfAttribute(fields[8], nameKey, gff)}
+			genes[id] = gene
+			a.Genes = append(a.Genes, gene)
+		}
+		a.add(fields[0], start, end, gene)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(a.Genes) == 0 {
+		return nil, fmt.Errorf("no %s features in %s", featureType, filename)
+	}
+	return a, nil
+}
+
+func (a *Annotation) add(contig string, start, end int, gene *Gene) {
+	a.features[contig] = append(a.features[contig], geneFeature{start, end, gene})
+	if a.bins[contig] == nil {
+		a.bins[contig] = make(map[int][]int)
+	}
+	i := len(a.features[contig]) - 1
+	for bin := start / annotationBinSize; bin <= end/annotationBinSize; bin++ {
+		a.bins[contig][bin] = append(a.bins[contig][bin], i)
+	}
+}
+
+// Read regions such as rRNA genes and chrM for -intervals from a BED file or
+// a Picard interval list, which has a SAM header. Each named region is a
+// Gene of that name, and unnamed ones are named by their position.
+func ReadIntervals(filename string) (*Annotation, error) {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	var r io.Reader = fp
+	if strings.HasSuffix(filename, ".gz") {
+		gz, err := gzip.NewReader(fp)
+		if err != nil {
+			return nil, err
+		}
+		r = gz
+	}
+	a := &Annotation{
+		features: make(map[string][]geneFeature),
+		bins:     make(map[string]map[int][]int),
+	}
+	genes := make(map[string]*Gene)
+	scanner := bufio.NewScanner(r)
+	line := 0
+	picard := false
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		if strings.HasPrefix(text, "@") {
+			picard = true
+			continue
+		}
+		if text == "" || text[0] == '#' || strings.HasPrefix(text, "track") || strings.HasPrefix(text, "browser") {
+			continue
+		}
+		fields := strings.Split(text, "\t")
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("%s line %d: expected a contig, start and end", filename, line)
+		}
+		start, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: bad start: %v", filename, line, err)
+		}
+		end, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: bad end: %v", filename, line, err)
+		}
+		// BED starts count from 0, interval lists from 1.
+		if !picard {
+			start++
+		}
+		name := fmt.Sprintf("%s:%d-%d", fields[0], start, end)
+		if picard && len(fields) >= 5 {
+			name = fields[4]
+		} else if !picard && len(fields) >= 4 {
+			name = fields[3]
+		}
+		gene, ok := genes[name]
+		if !ok {
+			gene = &Gene{Id: name}
+			genes[name] = gene
+			a.Genes = append(a.Genes, gene)
+		}
+		a.add(fields[0], start, end, gene)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(a.Genes) == 0 {
+		return nil, fmt.Errorf("no intervals in %s", filename)
+	}
+	return a, nil
+}
+
+// Whether either mate of a read aligns within any of the regions.
+func (a *Annotation) Covers(mate1, mate2 *Mate) (bool, error) {
+	for _, mate := range []*Mate{mate1, mate2} {
+		if mate == nil {
+			continue
+		}
+		genes, err := a.Overlapping(mate.Record)
+		if err != nil {
+			return false, err
+		}
+		if len(genes) > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// The genes overlapping the aligned blocks of an alignment, so a spliced
+// read doesn't count for genes in its introns.
+func (a *Annotation) Overlapping(record []string) ([]*Gene, error) {
+	bins, ok := a.bins[record[2]]
+	if !ok {
+		return nil, nil
+	}
+	pos, err := strconv.Atoi(record[3])
+	if err != nil {
+		return nil, fmt.Errorf("bad position %q", record[3])
+	}
+	ops, err := ParseCigar(record[5])
+	if err != nil {
+		return nil, err
+	}
+	features := a.features[record[2]]
+	genes := []*Gene{}
+	seen := make(map[*Gene]bool)
+	for _, op := range ops {
+		span := ReferenceSpan([]CigarOp{op})
+		if span == 0 {
+			continue
+		}
+		start, end := pos, pos+span-1
+		pos += span
+		if op.Op == 'N' {
+			continue
+		}
+		for bin := start / annotationBinSize; bin <= end/annotationBinSize; bin++ {
+			for _, i := range bins[bin] {
+				f := features[i]
+				if f.start <= end && start <= f.end && !seen[f.gene] {
+					seen[f.gene] = true
+					genes = append(genes, f.gene)
+				}
+			}
+		}
+	}
+	return genes, nil
+}
+
+// Count a read against the genes it overlaps. This does nothing without -gtf.
+func (a *Annotation) Add(record []string, rejected bool) error {
+	if a == nil {
+		return nil
+	}
+	genes, err := a.Overlapping(record)
+	if err != nil {
+		return err
+	}
+	for _, gene := range genes {
+		if rejected {
+			gene.Rejected++
+		} else {
+			gene.Kept++
+		}
+	}
+	return nil
+}
+
+// Write the genes with any reads, those with the most rejected first.
+func (a *Annotation) Write(filename string) error {
+	genes := []*Gene{}
+	for _, gene := range a.Genes {
+		if gene.Kept+gene.Rejected > 0 {
+			genes = append(genes, gene)
+		}
+	}
+	sort.SliceStable(genes, func(i, j int) bool {
+		return genes[i].Rejected > genes[j].Rejected
+	})
+	fp, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(fp)
+	fmt.Fprintln(w, "gene_id\tgene_name\treads\tkept\trejected\trejected_percent")
+	for _, gene := range genes {
+		name := gene.Name
+		if name == "" {
+			name = "NA"
+		}
+		total := gene.Kept + gene.Rejected
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%0.2f\n", gene.Id, name, total, gene.Kept, gene.Rejected,
+			float64(gene.Rejected)/float64(total)*100)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return fp.Close()
+}
@@ -2,43 +2,306 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
+// The longest SAM line we'll accept, from -max-record-size. Long reads need a
+// lot more than the bufio.Scanner default.
+var maxRecordSize = 16 * 1024 * 1024
+
+// The error scanning SAM text from name, saying what to do about a line too
+// long for the scanner rather than just that it was.
+func scanError(name string, err error) error {
+	if err == bufio.ErrTooLong {
+		return fmt.Errorf("%s has a line longer than the -max-record-size of %d MiB, raise it to read it", name, maxRecordSize>>20)
+	}
+	return fmt.Errorf("scanner of %s errored: %v", name, err)
+}
+
+// How many records ahead to look for ones that are out of order, for
+// -sort-window, or none to insist on the inputs being sorted.
+var sortWindow = 0
+
+// The most bytes of records to hold in each input's window, from its share
+// of -max-memory, or 0 for no limit short of -sort-window itself.
+var windowBytes int64 = 0
+
+// Whether to compare reads by their names with any /1 or /2 suffix or comment
+// after a space left off, for -normalize-names.
+var normalizeNames = false
+
+// A read name as it was before an aligner or the preparation of the FASTQ put
+// a mate suffix or the rest of the FASTQ header line on it.
+func NormalizeName(name string) string {
+	if i := strings.IndexByte(name, ' '); i >= 0 {
+		name = name[:i]
+	}
+	if n := len(name); n > 2 && name[n-2] == '/' && (name[n-1] == '1' || name[n-1] == '2') {
+		name = name[:n-2]
+	}
+	return name
+}
+
+// Whether to check every record against the SAM spec, for -strict.
+var strictRecords = false
+
+// The samtools to run, from -samtools-path, and with -backend sambamba, to
+// read BAM files with sambamba view instead. samtools still sorts, indexes
+// and writes them.
+var samtoolsPath = "samtools"
+var viewBackend = "samtools"
+
+func samtoolsCommand(cmdArgs ...string) *exec.Cmd {
+	return exec.Command(samtoolsPath, cmdArgs...)
+}
+
+// samtools view with the given arguments (-H or -h, then a file or - for
+// stdin), or the sambamba view equivalent.
+func viewCommand(viewArgs ...string) *exec.Cmd {
+	if viewBackend != "sambamba" {
+		return samtoolsCommand(append([]string{"view"}, viewArgs...)...)
+	}
+	cmdArgs := []string{"view"}
+	for _, arg := range viewArgs {
+		switch arg {
+		case "-":
+			arg = "/dev/stdin"
+		case "-h":
+			arg = "--with-header"
+		case "-H":
+			arg = "--header"
+		}
+		cmdArgs = append(cmdArgs, arg)
+	}
+	return exec.Command("sambamba", cmdArgs...)
+}
+
 type BamScanner struct {
 	LineNumber int
 	filename   string
 	stdin      bool
 	scanner    *bufio.Scanner
+	chunk      string   // the lines scanned but not yet split into records
+	fields     []string // room for the fields of records to come
 	wg         sync.WaitGroup
 	prev       string
 	record     []string
-	Closed     bool
+	header     []string
+	input      *CountingReader
+	size       int64
+	window     recordWindow
+	windowSize int64 // bytes of the records in window
+	drained    bool
+	scanned    string // the last read name read into the window
+	Reordered  int    // places the window put out of order records right
+	sorting    bool
+	expected   string // the -checksums digest, if any
+	Checksum   string // the digest of the file as read, once verified
+	cmd        *exec.Cmd
+	stderr     bytes.Buffer
+	waited     sync.Once
+	waitErr    error
+	// What samtools reads from, when it's programs like an aligner.
+	upstream       []*exec.Cmd
+	upstreamStderr []*bytes.Buffer
+	upstreamErr    error
+	Closed         bool
+}
+
+// Records read ahead for -sort-window, in a heap by read name and then the
+// order they came in.
+type windowRecord struct {
+	record []string
+	line   int
+}
+
+type recordWindow []windowRecord
+
+func (w recordWindow) Len() int { return len(w) }
+func (w recordWindow) Less(i, j int) bool {
+	if c := nameCmp(w[i].record[0], w[j].record[0]); c != 0 {
+		return c < 0
+	}
+	return w[i].line < w[j].line
+}
+func (w recordWindow) Swap(i, j int)       { w[i], w[j] = w[j], w[i] }
+func (w *recordWindow) Push(x interface{}) { *w = append(*w, x.(windowRecord)) }
+func (w *recordWindow) Pop() interface{} {
+	old := *w
+	r := old[len(old)-1]
+	*w = old[:len(old)-1]
+	return r
 }
 
+// Open a BAM file, feeding it to samtools ourselves and counting the bytes so
+// Progress can tell how far through it we are, and how far samtools got if it
+// fails.
 func (s *BamScanner) OpenBam(bamfile string) error {
+	if err := s.openFile(bamfile); err != nil {
+		return err
+	}
+	if nativeIO() {
+		s.scanner = newRecordScanner(openNativeView(s.input, false))
+		s.wg.Add(1)
+		return nil
+	}
+	cmd := viewCommand("-")
+	cmd.Stdin = s.input
+	return s.start(cmd)
+}
+
+// Open the file to be fed to samtools, hashing it as it goes when the
+// -checksums manifest has it.
+func (s *BamScanner) openFile(bamfile string) error {
 	s.filename = bamfile
-	cmd := exec.Command("samtools", "view", bamfile)
+	fp, size, err := OpenSource(bamfile)
+	if err != nil && IsRemote(bamfile) {
+		return fmt.Errorf("%s: %v", bamfile, err)
+	} else if err != nil {
+		return err
+	}
+	s.size = size
+	s.input = &CountingReader{r: fp}
+	if checksums == nil {
+		return nil
+	}
+	if s.expected = expectedChecksum(bamfile); s.expected == "" {
+		logger.Warnf("%s isn't in the -checksums manifest, not verifying it\n", bamfile)
+	} else {
+		s.input.hash, err = newChecksumHash(s.expected)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// How many bytes of the file have been read out of how many, or zeros when
+// that isn't known.
+func (s *BamScanner) Progress() (int64, int64) {
+	// Sorting reads the whole file before the first record comes out, so
+	// progress can only be told when the file is read as is.
+	if s.input == nil || s.sorting {
+		return 0, 0
+	}
+	return s.input.Count(), s.size
+}
+
+// Counts the bytes read through it, and hashes them if it has a hash.
+type CountingReader struct {
+	r    io.Reader
+	n    int64
+	hash hash.Hash
+}
+
+func (c *CountingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	if c.hash != nil {
+		c.hash.Write(p[:n])
+	}
+	return n, err
+}
+
+func (c *CountingReader) Count() int64 {
+	return atomic.LoadInt64(&c.n)
+}
+
+// Open a BAM file that is not sorted by read name by streaming it through
+// `samtools sort -n` (or -N for lexicographic order) first. Temporary files go
+// in tmpdir when given, and mem is passed through as samtools' per-thread
+// memory limit.
+func (s *BamScanner) OpenSorting(bamfile, tmpdir, mem string, lexicographic bool) error {
+	if nativeIO() {
+		return needsSamtools("sorting " + bamfile + " by name")
+	}
+	if err := s.openFile(bamfile); err != nil {
+		return err
+	}
+	s.sorting = true
+	cmd := sortCommand(bamfile, tmpdir, mem, lexicographic)
+	cmd.Stdin = s.input
+	return s.start(cmd)
+}
+
+// samtools sort by name from stdin to SAM on stdout.
+func sortCommand(name, tmpdir, mem string, lexicographic bool) *exec.Cmd {
+	byName := "-n"
+	if lexicographic {
+		byName = "-N"
+	}
+	cmdArgs := []string{"sort", byName, "-O", "SAM", "-o", "-"}
+	if tmpdir != "" {
+		prefix := fmt.Sprintf("contfilter.%d.%s", os.Getpid(), filepath.Base(name))
+		cmdArgs = append(cmdArgs, "-T", filepath.Join(tmpdir, prefix))
+	}
+	if mem != "" {
+		cmdArgs = append(cmdArgs, "-m", mem)
+	}
+	cmdArgs = append(cmdArgs, "-")
+	return samtoolsCommand(cmdArgs...)
+}
+
+// Scan the output of an aligner, sorting it by name on the way. Any commands
+// before it are piped into it in turn, such as samtools fastq feeding it reads.
+// The name is what to call it in messages, such as the reference aligned to.
+func (s *BamScanner) OpenAligning(name string, pipeline []*exec.Cmd, tmpdir, mem string, lexicographic bool) error {
+	if nativeIO() {
+		return needsSamtools("aligning to " + name)
+	}
+	s.filename = name
+	s.sorting = true
+	var stdin io.Reader
+	for _, cmd := range pipeline {
+		cmd.Stdin = stdin
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			return fmt.Errorf("failed creating pipe: %v", err)
+		}
+		stderr := &bytes.Buffer{}
+		cmd.Stderr = stderr
+		if err := cmd.Start(); err != nil {
+			return fmt.Errorf("failed to run %s: %v", cmd.Path, err)
+		}
+		s.upstream = append(s.upstream, cmd)
+		s.upstreamStderr = append(s.upstreamStderr, stderr)
+		stdin = out
+	}
+	cmd := sortCommand(name, tmpdir, mem, lexicographic)
+	cmd.Stdin = stdin
+	return s.start(cmd)
+}
+
+func (s *BamScanner) start(cmd *exec.Cmd) error {
 	input, err := cmd.StdoutPipe()
 	if err != nil {
 		return fmt.Errorf("failed creating pipe: %v", err)
 	}
+	cmd.Stderr = &s.stderr
 	if err := cmd.Start(); err != nil {
 		return fmt.Errorf("command failed to start: %v", err)
 	}
-	s.scanner = bufio.NewScanner(input)
+	s.cmd = cmd
+	s.scanner = newRecordScanner(input)
 	s.wg.Add(1)
 	go func() {
 		s.wg.Wait()
 
 		if !s.stdin {
-			if err := cmd.Wait(); err != nil {
+			if err := s.wait(); err != nil {
 				log.Fatal("wait failed: ", err)
 			}
 		}
@@ -46,6 +309,67 @@ func (s *BamScanner) OpenBam(bamfile string) error {
 	return nil
 }
 
+// Wait for samtools to exit, which it will have once the stream ends, and
+// whatever fed it.
+func (s *BamScanner) wait() error {
+	s.waited.Do(func() {
+		s.waitErr = s.cmd.Wait()
+		for i, cmd := range s.upstream {
+			if err := cmd.Wait(); err != nil && s.upstreamErr == nil {
+				s.upstreamErr = fmt.Errorf("%s failed: %v: %s", filepath.Base(cmd.Path), err,
+					strings.TrimSpace(s.upstreamStderr[i].String()))
+			}
+		}
+	})
+	return s.waitErr
+}
+
+// At the end of the stream, make sure samtools got to the end of the file
+// rather than stopping part way, as it does on a truncated or corrupt one.
+func (s *BamScanner) finish() error {
+	if s.cmd == nil {
+		// Read natively, if not from stdin.
+		return s.verify()
+	}
+	err := s.wait()
+	if s.upstreamErr != nil {
+		return fmt.Errorf("%s: %v", s.filename, s.upstreamErr)
+	}
+	if err == nil {
+		return s.verify()
+	}
+	msg := strings.TrimSpace(s.stderr.String())
+	tool := filepath.Base(s.cmd.Path)
+	if done, total := s.Progress(); total > 0 {
+		return fmt.Errorf("%s: input truncated at ~%0.0f%% (%s failed: %v: %s)",
+			s.filename, float64(done)/float64(total)*100, tool, err, msg)
+	}
+	return fmt.Errorf("%s: input truncated (%s failed: %v: %s)", s.filename, tool, err, msg)
+}
+
+// Where a contamination mapping's alignments of a read come from: a BAM file
+// scanned in step with the sample, or an index of one.
+type AlignmentSource interface {
+	Lookup(read string) ([][]string, error)
+}
+
+// All the records for a read, which must not come before the last one looked
+// up.
+func (s *BamScanner) Lookup(read string) ([][]string, error) {
+	records := [][]string{}
+	for {
+		record, err := s.Find(read)
+		if err != nil {
+			return nil, err
+		}
+		if record == nil {
+			// No more alignments for this read
+			return records, nil
+		}
+		records = append(records, record)
+	}
+}
+
 // Fast forward to the next record with read name `read`
 func (s *BamScanner) Find(read string) ([]string, error) {
 	for {
@@ -65,7 +389,7 @@ func (s *BamScanner) Find(read string) ([]string, error) {
 			s.Ratchet()
 			return record, nil
 		}
-		if strnum_cmp(record[0], read) < 0 {
+		if nameCmp(record[0], read) < 0 {
 			// Not far enough yet
 			s.Ratchet()
 		} else {
@@ -77,36 +401,214 @@ func (s *BamScanner) Find(read string) ([]string, error) {
 	}
 }
 
+// A scanner of SAM text, giving as many whole lines at a time as fit in its
+// buffer.
+func newRecordScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxRecordSize)
+	scanner.Split(scanLines)
+	return scanner
+}
+
+// A bufio.SplitFunc like bufio.ScanLines, only the token is every complete
+// line in the buffer, and the final newline is left on it.
+func scanLines(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.LastIndexByte(data, '\n'); i >= 0 {
+		return i + 1, data[:i+1], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// How many fields to make room for at a time, so that records don't each
+// need a slice of their own.
+const fieldsBlock = 16 * 1024
+
+// The next line of SAM text, without allocating.
+func (s *BamScanner) line() (string, bool) {
+	if s.chunk == "" {
+		if !s.scanner.Scan() {
+			return "", false
+		}
+		// The one copy of the lines, which the records read from them share.
+		s.chunk = string(s.scanner.Bytes())
+	}
+	line := s.chunk
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line, s.chunk = line[:i], line[i+1:]
+	} else {
+		s.chunk = ""
+	}
+	for len(line) > 0 && isSpace(line[len(line)-1]) {
+		line = line[:len(line)-1]
+	}
+	for len(line) > 0 && isSpace(line[0]) {
+		line = line[1:]
+	}
+	return line, true
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\v' || c == '\f'
+}
+
+// Split a line into its tab separated fields, in the room set aside for them.
+// Each record gets a slice capped at its own fields, so appending to one
+// doesn't overwrite the next.
+func (s *BamScanner) split(line string) []string {
+	n := strings.Count(line, "\t") + 1
+	if len(s.fields) < n {
+		size := fieldsBlock
+		if n > size {
+			size = n
+		}
+		s.fields = make([]string, size)
+	}
+	record := s.fields[:n:n]
+	s.fields = s.fields[n:]
+	for i := 0; i < n-1; i++ {
+		tab := strings.IndexByte(line, '\t')
+		record[i], line = line[:tab], line[tab+1:]
+	}
+	record[n-1] = line
+	return record
+}
+
+// The next record in the stream, and the line it's on, or nil at the end.
+func (s *BamScanner) scan() ([]string, int, error) {
+	for {
+		line, ok := s.line()
+		if !ok {
+			break
+		}
+		s.LineNumber++
+		if len(line) == 0 {
+			return nil, 0, fmt.Errorf("empty BAM record")
+		}
+		// Header lines only show up when the stream comes from samtools sort
+		// or a samtools view -h pipe.
+		if line[0] == '@' {
+			if contigMap != nil && strings.HasPrefix(line, "@SQ\t") {
+				line = renameSequence(line)
+			}
+			s.header = append(s.header, line)
+			continue
+		}
+		record := s.split(line)
+		if strictRecords {
+			if err := CheckRecord(record); err != nil {
+				return nil, 0, fmt.Errorf("%s line %d: read %s: %v", s.filename, s.LineNumber, record[0], err)
+			}
+		}
+		if normalizeNames {
+			record[0] = NormalizeName(record[0])
+		}
+		if contigMap != nil && len(record) > 6 {
+			renameContigs(record)
+		}
+		return record, s.LineNumber, nil
+	}
+	if err := s.scanner.Err(); err != nil {
+		return nil, 0, scanError(s.filename, err)
+	}
+	return nil, 0, s.finish()
+}
+
+// About how many bytes a record takes in memory: its fields and their
+// string headers.
+func recordSize(record []string) int64 {
+	size := int64(24)
+	for _, field := range record {
+		size += int64(len(field)) + 16
+	}
+	return size
+}
+
+// The next record in read name order out of the records in the window, which
+// is kept topped up with the ones after it.
+func (s *BamScanner) next() ([]string, int, error) {
+	if sortWindow == 0 {
+		return s.scan()
+	}
+	for !s.drained && len(s.window) <= sortWindow && (windowBytes == 0 || s.windowSize < windowBytes) {
+		record, line, err := s.scan()
+		if err != nil {
+			return nil, 0, err
+		}
+		if record == nil {
+			s.drained = true
+			break
+		}
+		if s.scanned != "" && nameCmp(s.scanned, record[0]) > 0 {
+			s.Reordered++
+		}
+		s.scanned = record[0]
+		heap.Push(&s.window, windowRecord{record, line})
+		s.windowSize += recordSize(record)
+	}
+	if len(s.window) == 0 {
+		return nil, 0, nil
+	}
+	r := heap.Pop(&s.window).(windowRecord)
+	s.windowSize -= recordSize(r.record)
+	return r.record, r.line, nil
+}
+
 func (s *BamScanner) Record() ([]string, error) {
 	if s.record != nil {
 		return s.record, nil
 	}
-	s.Closed = !s.scanner.Scan()
-	if err := s.scanner.Err(); err != nil {
-		return nil, fmt.Errorf("scanner of %s errored: %v", s.filename, err)
+	record, line, err := s.next()
+	if err != nil {
+		return nil, err
 	}
+	s.Closed = record == nil
 	if s.Closed {
 		return nil, nil
 	}
-	line := strings.TrimSpace(s.scanner.Text())
-	s.LineNumber++
-	if len(line) == 0 {
-		return nil, fmt.Errorf("empty BAM record")
-	}
-	s.record = strings.Split(line, "\t")
-	if len(s.record) == 0 {
-		return nil, fmt.Errorf("empty record at line %s", s.LineNumber)
-	}
+	s.record = record
 	read := s.record[0]
 	if s.prev != "" {
-		if strnum_cmp(s.prev, read) > 0 {
-			return nil, fmt.Errorf("sorting order violated at line %d", s.LineNumber)
+		if nameCmp(s.prev, read) > 0 {
+			if sortWindow > 0 && windowBytes > 0 {
+				return nil, fmt.Errorf("sorting order violated at line %d, by more than the -sort-window of %d records or its %s share of -max-memory",
+					line, sortWindow, formatBytes(uint64(windowBytes)))
+			} else if sortWindow > 0 {
+				return nil, fmt.Errorf("sorting order violated at line %d, by more than the -sort-window of %d records",
+					line, sortWindow)
+			}
+			return nil, fmt.Errorf("sorting order violated at line %d", line)
 		}
 	}
 	s.prev = read
 	return s.record, nil
 }
 
+// The header lines at the start of the stream, which is read up to the first
+// record to find them.
+func (s *BamScanner) ReadHeader() (string, error) {
+	if _, err := s.Record(); err != nil {
+		return "", err
+	}
+	if len(s.header) == 0 {
+		return "", nil
+	}
+	return strings.Join(s.header, "\n") + "\n", nil
+}
+
+// Read through to the end of the stream, so the whole file is verified.
+func (s *BamScanner) Drain() error {
+	for !s.Closed {
+		s.Ratchet()
+		if _, err := s.Record(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *BamScanner) Ratchet() {
 	s.record = nil
 }
@@ -116,36 +618,194 @@ func (s *BamScanner) Done() {
 }
 
 func (s *BamScanner) OpenStdin() {
-	s.filename = "stdin"
+	s.OpenReader("stdin", os.Stdin)
+}
+
+// Scan SAM text from r, with or without a header.
+func (s *BamScanner) OpenReader(name string, r io.Reader) {
+	s.filename = name
 	s.stdin = true
 	s.wg.Add(1)
-	s.scanner = bufio.NewScanner(os.Stdin)
+	s.scanner = newRecordScanner(r)
 }
 
+// The empty block that ends every complete BGZF file.
+var bgzfEOF = []byte{
+	0x1f, 0x8b, 0x08, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0x06, 0x00, 0x42, 0x43,
+	0x02, 0x00, 0x1b, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+}
+
+// Make sure a BAM file ends with the BGZF end of file block, which one cut
+// short in transfer won't. Files that aren't BGZF, like SAM or plain gzipped
+// SAM, are left be, as are remote ones.
+func CheckBgzfEOF(filename string) error {
+	if IsRemote(filename) {
+		return nil
+	}
+	fp, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	head := make([]byte, 18)
+	if _, err := io.ReadFull(fp, head); err != nil || bgzfSize(head) == 0 {
+		return nil
+	}
+	info, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+	tail := make([]byte, len(bgzfEOF))
+	if info.Size() >= int64(len(tail)) {
+		if _, err := fp.ReadAt(tail, info.Size()-int64(len(tail))); err != nil {
+			return err
+		}
+	}
+	if !bytes.Equal(tail, bgzfEOF) {
+		return fmt.Errorf("%s is truncated: it doesn't end with the BGZF end of file block", filename)
+	}
+	return nil
+}
+
+// Check the file's digest against the -checksums manifest, hashing whatever
+// samtools left unread, such as padding after the end of file block.
+func (s *BamScanner) verify() error {
+	if s.input == nil || s.input.hash == nil {
+		return nil
+	}
+	if _, err := io.Copy(io.Discard, s.input); err != nil {
+		return fmt.Errorf("%s: %v", s.filename, err)
+	}
+	digest := hex.EncodeToString(s.input.hash.Sum(nil))
+	if digest != s.expected {
+		return fmt.Errorf("%s: %s checksum %s doesn't match %s from -checksums", s.filename,
+			checksumName(s.input.hash), digest, s.expected)
+	}
+	s.Checksum = checksumName(s.input.hash) + ":" + digest
+	return nil
+}
+
+// The header of a BAM file, with any -contig-map applied.
 func ReadBamHeader(bamfile string) (string, error) {
-	output, err := exec.Command("samtools", "view", "-H", bamfile).Output()
+	header, err := readBamHeaderText(bamfile)
+	if err != nil {
+		return "", err
+	}
+	return RenameSequences(header), nil
+}
+
+func readBamHeaderText(bamfile string) (string, error) {
+	if nativeIO() {
+		return readNativeHeader(bamfile)
+	}
+	if IsRemote(bamfile) {
+		return readRemoteHeader(bamfile)
+	}
+	output, err := viewCommand("-H", bamfile).Output()
 	if err != nil {
 		return "", fmt.Errorf("failed to read header: %v", err)
 	}
 	return string(output), nil
 }
 
+// How much SAM text to gather up before handing it on to be written, so the
+// output isn't written a record at a time.
+const outputBuffer = 1024 * 1024
+
+// Buffers writes, flushing them when closed before closing what it writes to.
+type flushCloser struct {
+	*bufio.Writer
+	next io.WriteCloser
+}
+
+func newFlushCloser(w io.WriteCloser, size int) *flushCloser {
+	return &flushCloser{bufio.NewWriterSize(w, size), w}
+}
+
+func (f *flushCloser) Close() error {
+	if err := f.Flush(); err != nil {
+		return err
+	}
+	return f.next.Close()
+}
+
 type BamWriter struct {
-	filename string
-	wg       sync.WaitGroup
-	fp       *os.File
+	Uncompressed bool
+	Level        int  // BGZF compression level, or -1 for samtools' default
+	Sort         bool // sort by coordinate with samtools sort on the way out
+	TmpDir       string
+	Mem          string
+	filename     string
+	tmpname      string
+	upload       *exec.Cmd // streaming it to object storage
+	uploadStderr bytes.Buffer
+	wg           sync.WaitGroup
+	fp           *os.File
 }
 
+// Open a BAM file for writing through samtools. A filename of - writes the BAM
+// to stdout. Otherwise it's written under a temporary name in the same
+// directory and only renamed into place by Finish, so a run that dies partway
+// doesn't leave a truncated BAM under the real name.
 func (w *BamWriter) Open(bamfile string) (io.WriteCloser, error) {
 	w.filename = bamfile
-	cmd := exec.Command("samtools", "view", "-b", "-o", bamfile, "-")
+	target := bamfile
+	if IsObject(bamfile) {
+		target = "-"
+	} else if bamfile != "-" {
+		// Keeping the extension lets samtools tell the format.
+		w.tmpname = filepath.Join(filepath.Dir(bamfile),
+			fmt.Sprintf(".contfilter.%d.%s", os.Getpid(), filepath.Base(bamfile)))
+		target = w.tmpname
+	}
+	if nativeIO() {
+		return w.openNative(bamfile, target)
+	}
+	cmdArgs := []string{"view", "-b"}
+	if w.Sort {
+		cmdArgs = []string{"sort"}
+		if w.TmpDir != "" {
+			prefix := fmt.Sprintf("contfilter.%d.%s", os.Getpid(), filepath.Base(bamfile))
+			cmdArgs = append(cmdArgs, "-T", filepath.Join(w.TmpDir, prefix))
+		}
+		if w.Mem != "" {
+			cmdArgs = append(cmdArgs, "-m", w.Mem)
+		}
+	}
+	if w.Uncompressed {
+		cmdArgs = append(cmdArgs, "-u")
+	} else if w.Level >= 0 {
+		cmdArgs = append(cmdArgs, "-l", strconv.Itoa(w.Level))
+	}
+	cmdArgs = append(cmdArgs, "-o", target, "-")
+	cmd := samtoolsCommand(cmdArgs...)
 	fp, err := cmd.StdinPipe()
 	if err != nil {
 		return nil, fmt.Errorf("failed creating pipe: %v", err)
 	}
+	var output bytes.Buffer
+	cmd.Stderr = &output
+	switch {
+	case bamfile == "-":
+		cmd.Stdout = os.Stdout
+	case IsObject(bamfile):
+		bam, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, fmt.Errorf("failed creating pipe: %v", err)
+		}
+		w.upload = objectCommand(bamfile, true)
+		w.upload.Stdin = bam
+		w.upload.Stderr = &w.uploadStderr
+		if err := w.upload.Start(); err != nil {
+			return nil, fmt.Errorf("failed to upload %s: %v", bamfile, err)
+		}
+	default:
+		cmd.Stdout = &output
+	}
 	w.wg.Add(1)
 	go func() {
-		samOut, err := cmd.CombinedOutput()
+		err := cmd.Run()
+		samOut := output.Bytes()
 		if len(samOut) > 0 {
 			log.Println("samtools output:")
 			log.Print(string(samOut))
@@ -155,9 +815,42 @@ func (w *BamWriter) Open(bamfile string) (io.WriteCloser, error) {
 		}
 		w.wg.Done()
 	}()
-	return fp, nil
+	return newFlushCloser(fp, outputBuffer), nil
 }
 
 func (w *BamWriter) Wait() {
 	w.wg.Wait()
 }
+
+// Move the finished BAM file into place, or finish uploading it.
+func (w *BamWriter) Finish() error {
+	if w.upload != nil {
+		if err := w.upload.Wait(); err != nil {
+			return fmt.Errorf("failed to upload %s: %v: %s", w.filename, err, strings.TrimSpace(w.uploadStderr.String()))
+		}
+		return nil
+	}
+	if w.tmpname == "" {
+		return nil
+	}
+	if err := os.Rename(w.tmpname, w.filename); err != nil {
+		return fmt.Errorf("failed to move %s into place: %v", w.filename, err)
+	}
+	return nil
+}
+
+// Index the BAM file once it's written, which it must have been sorted for.
+func (w *BamWriter) Index() error {
+	if nativeIO() {
+		return needsSamtools("-index-output")
+	}
+	samOut, err := samtoolsCommand("index", w.filename).CombinedOutput()
+	if len(samOut) > 0 {
+		log.Println("samtools output:")
+		log.Print(string(samOut))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to index %s: %v", w.filename, err)
+	}
+	return nil
+}
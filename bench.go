@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+)
+
+var bases = []byte("ACGT")
+
+func randomSequence(rng *rand.Rand, length int) string {
+	seq := make([]byte, length)
+	for i := range seq {
+		seq[i] = bases[rng.Intn(len(bases))]
+	}
+	return string(seq)
+}
+
+// A mapped mate of a STAR-style read pair.
+func syntheticRecord(name string, flag, pos, mpos, readLen, editDist int, seq string) string {
+	tlen := mpos + readLen - pos
+	if flag&0x10 != 0 {
+		tlen = -(pos + readLen - mpos)
+	}
+	return fmt.Sprintf("%s\t%d\tchr1\t%d\t60\t%dM\t=\t%d\t%d\t%s\t%s\tNH:i:1\tHI:i:1\tAS:i:%d\tnM:i:%d",
+		name, flag, pos, readLen, mpos, tlen, seq, strings.Repeat("I", readLen), 2*readLen-2*editDist, editDist)
+}
+
+// Both mates of a read pair, first and second in the file.
+func syntheticPair(rng *rand.Rand, name string, readLen, editDist1, editDist2 int) []string {
+	pos := 1 + rng.Intn(1000000)
+	mpos := pos + readLen + rng.Intn(200)
+	return []string{
+		syntheticRecord(name, 99, pos, mpos, readLen, editDist1, randomSequence(rng, readLen)),
+		syntheticRecord(name, 147, mpos, pos, readLen, editDist2, randomSequence(rng, readLen)),
+	}
+}
+
+const syntheticHeader = "@HD\tVN:1.6\tSO:queryname\n@SQ\tSN:chr1\tLN:2000000\n@PG\tID:STAR\tPN:STAR\n"
+
+// contfilter bench [-reads N] [-read-len L] [options]
+//
+// Time scanning, scoring and writing on synthetic reads made up in memory, so
+// changes and options can be weighed without real data to hand. Takes the same
+// options as filtering, which apply to the scoring.
+func benchMain(argv []string) {
+	reads := flag.Int("reads", 200000, "number of synthetic read pairs")
+	readLen := flag.Int("read-len", 100, "length of each mate")
+	flag.CommandLine.Parse(argv)
+	if *reads < 1 || *readLen < 1 {
+		log.Println("usage: contfilter bench [-reads N] [-read-len L] [options]")
+		os.Exit(1)
+	}
+	OpenLogger()
+
+	// A third of the reads also map to the contamination, some better than
+	// in the sample and some worse.
+	rng := rand.New(rand.NewSource(1))
+	var sample bytes.Buffer
+	sample.WriteString(syntheticHeader)
+	contamination := make(map[string][][]string)
+	for i := 0; i < *reads; i++ {
+		name := fmt.Sprintf("read%d", i+1)
+		for _, line := range syntheticPair(rng, name, *readLen, rng.Intn(3), rng.Intn(3)) {
+			sample.WriteString(line + "\n")
+		}
+		if rng.Intn(3) == 0 {
+			records := [][]string{}
+			for _, line := range syntheticPair(rng, name, *readLen, rng.Intn(5), rng.Intn(5)) {
+				records = append(records, strings.Split(line, "\t"))
+			}
+			contamination[name] = records
+		}
+	}
+	aligner := ChooseAligner("synthetic", syntheticHeader)
+	cont, err := ParseContaminant("synthetic")
+	if err != nil {
+		logger.Fatal(err)
+	}
+	cont.Aligner = aligner
+	fmt.Printf("%d synthetic read pairs of %d bases, %d MB of SAM\n", *reads, *readLen, sample.Len()>>20)
+
+	report := func(stage string, start time.Time) {
+		elapsed := time.Since(start)
+		fmt.Printf("%-8s %10.3fs %12.0f reads/s\n", stage, elapsed.Seconds(), float64(*reads)/elapsed.Seconds())
+	}
+
+	start := time.Now()
+	scanner := &BamScanner{}
+	scanner.OpenReader("synthetic", &sample)
+	if _, err := scanner.ReadHeader(); err != nil {
+		logger.Fatal(err)
+	}
+	groups := [][][]string{}
+	for {
+		group, err := scanner.Group()
+		if err != nil {
+			logger.Fatal(err)
+		}
+		if group == nil {
+			break
+		}
+		groups = append(groups, group)
+	}
+	scanner.Done()
+	report("scan", start)
+
+	start = time.Now()
+	pair := args.PairScore != "best"
+	kept := []*Mate{}
+	rejected := 0
+	for _, group := range groups {
+		mate1, mate2, err := PickMates(group, aligner)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		mate1, mate2, reason := DropWeakMates(mate1, mate2)
+		if reason != "" {
+			rejected++
+			continue
+		}
+		result, err := Compare(mate1.Record[0], mate1, mate2, pair && mate2 != nil, cont, contamination[mate1.Record[0]])
+		if err != nil {
+			logger.Fatal(err)
+		}
+		if result.Rejected {
+			rejected++
+			continue
+		}
+		kept = append(kept, mate1)
+		if mate2 != nil {
+			kept = append(kept, mate2)
+		}
+	}
+	report("score", start)
+
+	// This is only our side of writing; samtools encoding BAM isn't included.
+	start = time.Now()
+	w := bufio.NewWriter(io.Discard)
+	for _, mate := range kept {
+		if _, _, err := WriteMate(w, mate, keptFlags); err != nil {
+			logger.Fatal(err)
+		}
+	}
+	w.Flush()
+	report("write", start)
+	fmt.Printf("kept %d and rejected %d reads\n", len(groups)-rejected, rejected)
+}
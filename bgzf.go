@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"runtime"
+)
+
+// How many threads to compress and decompress natively read and written files
+// with, from -native-threads.
+var nativeThreads = runtime.NumCPU()
+
+// Open a gzip stream to read it decompressed. BGZF, as BAM files and bgzipped
+// SAM are, comes in blocks that are decompressed in parallel. Other gzip
+// can't be split up like that, but is at least decompressed on a core of its
+// own, ahead of being read.
+func openGunzip(r *bufio.Reader) (io.ReadCloser, error) {
+	if head, err := r.Peek(18); err == nil && bgzfSize(head) > 0 {
+		return newBgzfReader(r, nativeThreads), nil
+	}
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return newReadAhead(gz), nil
+}
+
+// The size of the BGZF block starting with head, from the BC extra field of
+// its gzip header, or 0 if it isn't one.
+func bgzfSize(head []byte) int {
+	if len(head) < 12 || head[0] != 0x1f || head[1] != 0x8b || head[2] != 8 || head[3]&4 == 0 {
+		return 0
+	}
+	extra := head[12:]
+	if xlen := int(binary.LittleEndian.Uint16(head[10:])); xlen < len(extra) {
+		extra = extra[:xlen]
+	}
+	for len(extra) >= 4 {
+		slen := int(binary.LittleEndian.Uint16(extra[2:]))
+		if extra[0] == 'B' && extra[1] == 'C' && slen == 2 && len(extra) >= 6 {
+			return int(binary.LittleEndian.Uint16(extra[4:])) + 1
+		}
+		if len(extra) < 4+slen {
+			break
+		}
+		extra = extra[4+slen:]
+	}
+	return 0
+}
+
+// A BGZF block read in, and once decompressed, what it held.
+type bgzfBlock struct {
+	data []byte
+	out  []byte
+	err  error
+	done chan struct{}
+}
+
+// Reads a BGZF stream, decompressing the blocks ahead of it on a pool of
+// goroutines and handing them back in order.
+type bgzfReader struct {
+	blocks chan *bgzfBlock // in the order they're in the stream
+	stop   chan struct{}
+	out    []byte
+	err    error
+}
+
+func newBgzfReader(r *bufio.Reader, threads int) *bgzfReader {
+	if threads < 1 {
+		threads = 1
+	}
+	z := &bgzfReader{
+		blocks: make(chan *bgzfBlock, 4*threads),
+		stop:   make(chan struct{}),
+	}
+	work := make(chan *bgzfBlock, 4*threads)
+	for i := 0; i < threads; i++ {
+		go inflateBlocks(work)
+	}
+	go func() {
+		defer close(work)
+		defer close(z.blocks)
+		for {
+			block := &bgzfBlock{done: make(chan struct{})}
+			block.data, block.err = readBgzfBlock(r)
+			if block.err == io.EOF {
+				return
+			}
+			if block.err != nil {
+				close(block.done)
+			}
+			select {
+			case z.blocks <- block:
+			case <-z.stop:
+				return
+			}
+			if block.err != nil {
+				return
+			}
+			work <- block
+		}
+	}()
+	return z
+}
+
+// Read the next whole BGZF block, or io.EOF at the end of the stream.
+func readBgzfBlock(r *bufio.Reader) ([]byte, error) {
+	head, err := r.Peek(18)
+	if len(head) == 0 && err == io.EOF {
+		return nil, io.EOF
+	}
+	size := bgzfSize(head)
+	if size == 0 {
+		return nil, fmt.Errorf("bad BGZF block")
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("truncated BGZF block: %v", err)
+	}
+	return data, nil
+}
+
+func inflateBlocks(work chan *bgzfBlock) {
+	var fr io.ReadCloser
+	for block := range work {
+		data := block.data
+		xlen := int(binary.LittleEndian.Uint16(data[10:]))
+		if len(data) < 12+xlen+8 {
+			block.err = fmt.Errorf("bad BGZF block")
+			close(block.done)
+			continue
+		}
+		trailer := data[len(data)-8:]
+		compressed := bytes.NewReader(data[12+xlen : len(data)-8])
+		if fr == nil {
+			fr = flate.NewReader(compressed)
+		} else {
+			fr.(flate.Resetter).Reset(compressed, nil)
+		}
+		size := binary.LittleEndian.Uint32(trailer[4:])
+		if size > 64*1024 {
+			block.err = fmt.Errorf("bad BGZF block")
+			close(block.done)
+			continue
+		}
+		block.out = make([]byte, size)
+		if _, err := io.ReadFull(fr, block.out); err != nil {
+			block.err = fmt.Errorf("bad BGZF block: %v", err)
+		} else if crc32.ChecksumIEEE(block.out) != binary.LittleEndian.Uint32(trailer) {
+			block.err = fmt.Errorf("BGZF block fails its CRC check")
+		}
+		block.data = nil
+		close(block.done)
+	}
+}
+
+func (z *bgzfReader) Read(p []byte) (int, error) {
+	for len(z.out) == 0 {
+		if z.err != nil {
+			return 0, z.err
+		}
+		block, ok := <-z.blocks
+		if !ok {
+			z.err = io.EOF
+			continue
+		}
+		<-block.done
+		z.out, z.err = block.out, block.err
+	}
+	n := copy(p, z.out)
+	z.out = z.out[n:]
+	return n, nil
+}
+
+// Stop reading ahead, for when the rest of the stream isn't wanted.
+func (z *bgzfReader) Close() error {
+	close(z.stop)
+	return nil
+}
+
+// Reads ahead of where it's been read to on a goroutine of its own.
+type readAhead struct {
+	chunks chan []byte
+	stop   chan struct{}
+	out    []byte
+	err    error
+	final  error // what the goroutine stopped with
+}
+
+func newReadAhead(r io.Reader) *readAhead {
+	ra := &readAhead{chunks: make(chan []byte, 4), stop: make(chan struct{})}
+	go func() {
+		defer close(ra.chunks)
+		for {
+			chunk := make([]byte, 256*1024)
+			n := 0
+			var err error
+			for n < len(chunk) && err == nil {
+				var m int
+				m, err = r.Read(chunk[n:])
+				n += m
+			}
+			if n > 0 {
+				select {
+				case ra.chunks <- chunk[:n]:
+				case <-ra.stop:
+					return
+				}
+			}
+			if err == io.EOF {
+				return
+			} else if err != nil {
+				ra.final = err
+				return
+			}
+		}
+	}()
+	return ra
+}
+
+func (ra *readAhead) Read(p []byte) (int, error) {
+	for len(ra.out) == 0 {
+		if ra.err != nil {
+			return 0, ra.err
+		}
+		chunk, ok := <-ra.chunks
+		if !ok {
+			// The goroutine is done with final once it's closed chunks.
+			ra.err = ra.final
+			if ra.err == nil {
+				ra.err = io.EOF
+			}
+			continue
+		}
+		ra.out = chunk
+	}
+	n := copy(p, ra.out)
+	ra.out = ra.out[n:]
+	return n, nil
+}
+
+func (ra *readAhead) Close() error {
+	close(ra.stop)
+	return nil
+}
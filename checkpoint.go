@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Where a run stopped at -max-time got to, for another to pick up from with
+// -resume. Reads are done whole, so it's the last one done.
+type Checkpoint struct {
+	Sample       string `json:"sample"`
+	StoppedAfter string `json:"stopped_after"`
+	Output       string `json:"output"`
+}
+
+// Where the checkpoint goes, by default next to the output.
+func checkpointFilename() string {
+	if args.Checkpoint != "" {
+		return args.Checkpoint
+	}
+	if args.Output == "-" || IsObject(args.Output) {
+		return "contfilter.checkpoint"
+	}
+	return args.Output + ".checkpoint"
+}
+
+func (c *Checkpoint) Write(filename string) error {
+	blob, err := json.MarshalIndent(c, "", "    ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(blob, '\n'), 0666)
+}
+
+// Read the checkpoint to resume from, which must be of the same sample.
+func ReadCheckpoint(filename, sample string) (*Checkpoint, error) {
+	blob, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	c := &Checkpoint{}
+	if err := json.Unmarshal(blob, c); err != nil {
+		return nil, fmt.Errorf("%s isn't a checkpoint: %v", filename, err)
+	}
+	if c.StoppedAfter == "" {
+		return nil, fmt.Errorf("%s doesn't say where the run stopped", filename)
+	}
+	if c.Sample != sample {
+		return nil, fmt.Errorf("%s is a checkpoint of %s, not %s", filename, c.Sample, sample)
+	}
+	if c.Output == args.Output {
+		return nil, fmt.Errorf("%s is of a run that wrote to %s, which resuming it would overwrite: give another -output", filename, c.Output)
+	}
+	return c, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The digests inputs must have, from the -checksums manifest, by file name.
+var checksums map[string]string
+
+// Read a manifest in the format of md5sum or sha256sum, a digest and a file
+// name on each line.
+func ReadChecksums(filename string) (map[string]string, error) {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	manifest := make(map[string]string)
+	scanner := bufio.NewScanner(fp)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s line %d: expected a digest and a file name", filename, line)
+		}
+		digest := strings.ToLower(fields[0])
+		if _, err := newChecksumHash(digest); err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", filename, line, err)
+		}
+		// sha256sum marks files read in binary mode with a *.
+		manifest[strings.TrimPrefix(fields[1], "*")] = digest
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// The hash a digest was made with, going by its length.
+func newChecksumHash(digest string) (hash.Hash, error) {
+	if _, err := hex.DecodeString(digest); err != nil {
+		return nil, fmt.Errorf("%q isn't a hex digest", digest)
+	}
+	switch len(digest) {
+	case 2 * md5.Size:
+		return md5.New(), nil
+	case 2 * sha256.Size:
+		return sha256.New(), nil
+	}
+	return nil, fmt.Errorf("%q is neither an md5 nor a sha256 digest", digest)
+}
+
+func checksumName(h hash.Hash) string {
+	if h.Size() == md5.Size {
+		return "md5"
+	}
+	return "sha256"
+}
+
+// The digest the manifest gives a file, by the name it was given as or else
+// by its base name.
+func expectedChecksum(filename string) string {
+	if digest, ok := checksums[filename]; ok {
+		return digest
+	}
+	return checksums[filepath.Base(filename)]
+}
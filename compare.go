@@ -14,6 +14,10 @@ func digitToInt(s string) int {
 	return n
 }
 
+// How read names are compared when checking sort order and matching reads up
+// across files. Switched to strings.Compare for lexicographically sorted input.
+var nameCmp = strnum_cmp
+
 // From: https://github.com/samtools/samtools/blob/develop/bam_sort.c#L13
 func strnum_cmp(as, bs string) int {
 	a := []rune(as)
@@ -60,7 +64,7 @@ func strnum_cmp(as, bs string) int {
 			}
 		} else {
 			if a[i] != b[j] {
-				return digitToInt(string(a[i])) - digitToInt(string(b[j]))
+				return int(a[i]) - int(b[j])
 			}
 			i++
 			j++
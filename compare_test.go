@@ -0,0 +1,55 @@
+package main
+
+import (
+	"sort"
+	"testing"
+)
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+func TestStrnumCmp(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"read1", "read1", 0},
+		{"read2", "read10", -1},
+		{"read10", "read9", 1},
+		{"read10", "read10a", -1},
+		{"read1:22", "read1:3", 1},
+		// Runs of letters compare by character, not as numbers.
+		{"readA", "readB", -1},
+		{"readb", "readB", 1},
+		{"a1", "b1", -1},
+		{"HWI:1:X", "HWI:1:10", 1},
+		{"abc", "ab", 1},
+		{"", "a", -1},
+	}
+	for _, test := range tests {
+		if got := sign(strnum_cmp(test.a, test.b)); got != test.want {
+			t.Errorf("strnum_cmp(%q, %q) = %d, want %d", test.a, test.b, got, test.want)
+		}
+		if got := sign(strnum_cmp(test.b, test.a)); got != -test.want {
+			t.Errorf("strnum_cmp(%q, %q) = %d, want %d", test.b, test.a, got, -test.want)
+		}
+	}
+}
+
+func TestStrnumCmpSorts(t *testing.T) {
+	names := []string{"r10/1", "r2/2", "rB1", "r2/1", "rA10", "r1", "rA9", "r100"}
+	want := []string{"r1", "r2/1", "r2/2", "r10/1", "r100", "rA9", "rA10", "rB1"}
+	sort.Slice(names, func(i, j int) bool { return strnum_cmp(names[i], names[j]) < 0 })
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("sorted %v, want %v", names, want)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A contamination mapping and the parameters used when comparing the sample
+// against it. These default to the global flags but can be overridden per file
+// by appending them to its name, e.g. rrna.bam:margin=2,edit-penalty=3.
+type Contaminant struct {
+	Filename   string
+	Label      string // what to call it in reports, if not by its file name
+	Margin     float64
+	MarginFrac float64 // additional margin as a fraction of the sample alignment length
+	Penalty    float64
+	Weight     float64 // divides the sample's advantage over it, below 1 to make it harder to reject by
+	MinLength  int
+	MaxDist    int // alignments more diverged than this are ignored, -1 for no limit
+	Aligner    *Aligner
+	Index      *IndexReader // from `contfilter index`, if there is one
+	IndexFile  string       // where the index is, if not the file name plus .cfi
+	Blacklist  *Annotation  // regions prone to cross-mapping, from -blacklist
+}
+
+// Read a -cont-list file, with a contamination file on each line followed by
+// an optional label and any overrides, as in
+//
+//	rrna.bam rRNA margin=4 edit-penalty=3
+//
+// and return them as contamination arguments. Blank lines and lines starting
+// with # are skipped.
+func ReadContaminantList(filename string) ([]string, error) {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	contArgs := []string{}
+	scanner := bufio.NewScanner(fp)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		settings := []string{}
+		for i, field := range fields[1:] {
+			if !strings.Contains(field, "=") {
+				if i > 0 {
+					return nil, fmt.Errorf("%s line %d: expected key=value, got %q", filename, line, field)
+				}
+				field = "label=" + field
+			}
+			settings = append(settings, field)
+		}
+		arg := fields[0]
+		if len(settings) > 0 {
+			arg += ":" + strings.Join(settings, ",")
+		}
+		contArgs = append(contArgs, arg)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return contArgs, nil
+}
+
+// Find contamination files given more than once, whether by the same path or
+// as copies with the same size and header, which would count every rejection
+// twice. Each later one maps to the index of the first, and to how it matches.
+func DuplicateContaminants(conts []*Contaminant) (map[int]int, map[int]string, error) {
+	infos := make([]os.FileInfo, len(conts))
+	headers := make(map[int]string)
+	header := func(i int) (string, error) {
+		if h, ok := headers[i]; ok {
+			return h, nil
+		}
+		h, err := ReadBamHeader(conts[i].Filename)
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", conts[i].Filename, err)
+		}
+		headers[i] = h
+		return h, nil
+	}
+	dups := make(map[int]int)
+	why := make(map[int]string)
+	for i, cont := range conts {
+		if IsRemote(cont.Filename) {
+			// Only the same URL given twice can be told.
+			for j := 0; j < i; j++ {
+				if conts[j].Filename == cont.Filename {
+					dups[i], why[i] = j, "is the same URL as"
+					break
+				}
+			}
+			continue
+		}
+		if args.Fastq != "" {
+			// These are aligner index prefixes rather than files, so there's
+			// nothing to stat, only the same prefix given twice to tell.
+			for j := 0; j < i; j++ {
+				if filepath.Clean(conts[j].Filename) == filepath.Clean(cont.Filename) {
+					dups[i], why[i] = j, "is the same index as"
+					break
+				}
+			}
+			continue
+		}
+		info, err := os.Stat(cont.Filename)
+		if err != nil {
+			return nil, nil, err
+		}
+		infos[i] = info
+		for j := 0; j < i; j++ {
+			if _, ok := dups[j]; ok || infos[j] == nil {
+				continue
+			}
+			if os.SameFile(infos[j], info) {
+				dups[i], why[i] = j, "is the same file as"
+				break
+			}
+			// FASTA references have no headers to compare.
+			if infos[j].Size() != info.Size() || IsFasta(cont.Filename) {
+				continue
+			}
+			hi, err := header(i)
+			if err != nil {
+				return nil, nil, err
+			}
+			hj, err := header(j)
+			if err != nil {
+				return nil, nil, err
+			}
+			if hi == hj {
+				dups[i], why[i] = j, "has the same size and header as"
+				break
+			}
+		}
+	}
+	return dups, why, nil
+}
+
+// Split a contamination argument into its file name and any overrides.
+func splitOverrides(arg string) (string, string) {
+	i := strings.LastIndex(arg, ":")
+	if i < 0 {
+		return arg, ""
+	}
+	// Only settings we know start overrides, so the colon of a URL's scheme
+	// or port, as in https://host:8443/x.bam?a=b, doesn't. The keys have no
+	// slash, though the values of blacklist= and index= may.
+	for _, setting := range strings.Split(arg[i+1:], ",") {
+		key, _, ok := strings.Cut(setting, "=")
+		if !ok || strings.Contains(key, "/") || !contaminantSettings[key] {
+			return arg, ""
+		}
+	}
+	return arg[:i], arg[i+1:]
+}
+
+// Expand glob patterns among the contamination arguments, such as
+// cont/*.bam:margin=2, into the files they match in name order, each with the
+// pattern's overrides. A file whose name merely looks like a pattern is
+// taken as it is.
+func ExpandContaminants(contArgs []string) ([]string, error) {
+	expanded := []string{}
+	for _, arg := range contArgs {
+		pattern, overrides := splitOverrides(arg)
+		if !strings.ContainsAny(pattern, "*?[") || IsRemote(pattern) {
+			expanded = append(expanded, arg)
+			continue
+		}
+		if _, err := os.Stat(pattern); err == nil {
+			expanded = append(expanded, arg)
+			continue
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", pattern, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no contamination files match %s", pattern)
+		}
+		sort.Strings(matches)
+		for _, match := range matches {
+			if overrides != "" {
+				match += ":" + overrides
+			}
+			expanded = append(expanded, match)
+		}
+	}
+	return expanded, nil
+}
+
+func ParseContaminant(arg string) (*Contaminant, error) {
+	cont := &Contaminant{
+		Filename:   arg,
+		Margin:     args.Margin,
+		MarginFrac: args.MarginFrac,
+		Penalty:    args.Penalty,
+		Weight:     1,
+		MinLength:  args.MinLength,
+		MaxDist:    -1,
+	}
+	filename, overrides := splitOverrides(arg)
+	if i := strings.LastIndex(arg, ":"); overrides == "" && i >= 0 && !IsRemote(arg) && strings.Contains(arg[i+1:], "=") {
+		// Not a file with a colon in its name, so most likely a misspelt
+		// setting, which Set will say.
+		if _, err := os.Stat(arg); err != nil {
+			filename, overrides = arg[:i], arg[i+1:]
+		}
+	}
+	if overrides == "" {
+		return cont, nil
+	}
+	cont.Filename = filename
+	for _, setting := range strings.Split(overrides, ",") {
+		if err := cont.Set(setting); err != nil {
+			return nil, fmt.Errorf("%s: %v", arg, err)
+		}
+	}
+	return cont, nil
+}
+
+// The keys Set takes.
+var contaminantSettings = map[string]bool{
+	"margin": true, "margin-frac": true, "edit-penalty": true, "penalty": true,
+	"min-len": true, "max-edit-dist": true, "weight": true, "label": true,
+	"blacklist": true, "index": true,
+}
+
+// Apply a single key=value override.
+func (c *Contaminant) Set(setting string) error {
+	kv := strings.SplitN(setting, "=", 2)
+	if len(kv) != 2 {
+		return fmt.Errorf("expected key=value, got %q", setting)
+	}
+	key, value := kv[0], kv[1]
+	var err error
+	switch key {
+	case "margin":
+		c.Margin, err = strconv.ParseFloat(value, 64)
+	case "margin-frac":
+		c.MarginFrac, err = strconv.ParseFloat(value, 64)
+	case "edit-penalty", "penalty":
+		c.Penalty, err = strconv.ParseFloat(value, 64)
+	case "min-len":
+		c.MinLength, err = strconv.Atoi(value)
+	case "max-edit-dist":
+		c.MaxDist, err = strconv.Atoi(value)
+	case "weight":
+		c.Weight, err = strconv.ParseFloat(value, 64)
+		if err == nil && c.Weight <= 0 {
+			err = fmt.Errorf("must be positive")
+		}
+	case "label":
+		c.Label = value
+	case "blacklist":
+		c.Blacklist, err = ReadIntervals(value)
+	case "index":
+		c.IndexFile = value
+	default:
+		return fmt.Errorf("unknown setting %q", key)
+	}
+	if err != nil {
+		return fmt.Errorf("bad value for %s: %v", key, err)
+	}
+	return nil
+}
+
+// How much better than a contaminant alignment the sample has to score, given
+// the length of the sample alignment.
+func (c *Contaminant) RequiredMargin(length float64) float64 {
+	return c.Margin + c.MarginFrac*length
+}
+
+// Whether an alignment in this contamination mapping is good enough to count.
+func (c *Contaminant) Usable(a *Alignment) bool {
+	return a.Len >= c.MinLength && (c.MaxDist < 0 || a.EditDist <= c.MaxDist)
+}
+
+// The label it was given, or else its file name.
+func (c *Contaminant) Name() string {
+	if c.Label != "" {
+		return c.Label
+	}
+	return c.Filename
+}
+
+func (c *Contaminant) String() string {
+	maxDist := "none"
+	if c.MaxDist >= 0 {
+		maxDist = strconv.Itoa(c.MaxDist)
+	}
+	name := c.Filename
+	if c.Label != "" {
+		name += " [" + c.Label + "]"
+	}
+	weight := ""
+	if c.Weight != 1 {
+		weight = fmt.Sprintf(", advantage weight %g", c.Weight)
+	}
+	return fmt.Sprintf("%s (margin %g + %g of length, edit penalty %g%s, min length %d, max edit distance %s)",
+		name, c.Margin, c.MarginFrac, c.Penalty, weight, c.MinLength, maxDist)
+}
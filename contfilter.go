@@ -6,42 +6,313 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"os"
-	"strconv"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
 )
 
 type Args struct {
-	Sample      string
-	Margin      float64
-	MinLength   int
-	MaxDist     int
-	Limit       int
-	Penalty     float64
-	Output      string
-	Ercc        bool
-	LogFilename string
-	Verbose     bool
+	Sample              string
+	Fastq               string
+	Reference           string
+	AlignWith           string
+	AlignThreads        int
+	HeaderFrom          string
+	Margin              float64
+	MarginFrac          float64
+	AmbiguousWindow     float64
+	AmbiguousOutput     string
+	Ties                string
+	KeepIf              string
+	MinLength           int
+	MinMappedFrac       float64
+	MaxDist             int
+	MaxNFrac            float64
+	Dust                float64
+	Limit               int
+	Subsample           float64
+	Seed                int64
+	StartRead           string
+	StopRead            string
+	MaxTime             time.Duration
+	Checkpoint          string
+	Resume              string
+	Penalty             float64
+	ClipPenalty         float64
+	QualityWeight       bool
+	Output              string
+	OutputUncompressed  bool
+	CompressionLevel    int
+	SortOutput          bool
+	IndexOutput         bool
+	Force               bool
+	Singletons          string
+	FastqOut            string
+	FastqInterleaved    bool
+	Unmapped            string
+	UnmappedOutput      string
+	Ercc                bool
+	ExcludeContigs      PatternList
+	ExcludeCounts       string
+	ContigCounts        string
+	Gtf                 string
+	GtfFeature          string
+	GeneCounts          string
+	Reheader            string
+	KeepHeader          PatternList
+	DropHeader          PatternList
+	DropExcludedSQ      bool
+	RequireFlags        SamFlags
+	ExcludeFlags        SamFlags
+	SetFlags            SamFlags
+	ClearFlags          SamFlags
+	AmbiguousSetFlags   SamFlags
+	AmbiguousClearFlags SamFlags
+	Duplicates          string
+	AutoSort            bool
+	AutoIndex           bool
+	SortTmpDir          string
+	SortMem             string
+	MaxMemory           string
+	SortOrder           string
+	SamtoolsPath        string
+	Backend             string
+	Native              bool
+	NativeThreads       int
+	SampleAlignment     string
+	Prefilter           string
+	BloomSize           int
+	DropSecondary       bool
+	PrimaryOnly         bool
+	PairScore           string
+	LongRead            bool
+	Length              string
+	Deletions           string
+	EditTag             string
+	ScoreTag            string
+	Annotate            bool
+	KeepTags            string
+	StripTags           string
+	MismatchProfile     string
+	Sweep               string
+	SweepMargins        FloatList
+	SweepPenalties      FloatList
+	Truth               string
+	TruthROC            string
+	Kraken              string
+	KrakenTaxa          string
+	KrakenReport        string
+	KrakenRequire       bool
+	Estimate            bool
+	ScoreHistogram      string
+	HistogramBin        float64
+	Decisions           string
+	NearMisses          string
+	ResultsDB           string
+	ResultsDBReads      bool
+	MetricsAddr         string
+	Progress            bool
+	ProgressJSON        string
+	ProgressInterval    time.Duration
+	LogFilename         string
+	Stats               string
+	FailRejectedAbove   float64
+	FailKeptBelow       float64
+	LogLevel            string
+	LogFormat           string
+	AuditLog            string
+	Verbose             bool
+	SkipMalformed       bool
+	MaxErrors           ErrorBudget
+	SortWindow          int
+	NormalizeNames      bool
+	ContigMap           string
+	Strict              bool
+	MaxRecordSize       int
+	Checksums           string
+	HTTPRetries         int
+	ContList            string
+	ShortCircuit        bool
+	DedupeContamination bool
+	Intervals           string
+	IntervalsAction     string
+	DecoyContigs        string
+	DecoyAction         string
+	Blacklist           string
+	BlacklistAction     string
+}
+
+// PatternList collects the values of a flag that may be given more than once.
+type PatternList []string
+
+func (p *PatternList) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *PatternList) Set(value string) error {
+	if _, err := regexp.Compile(value); err != nil {
+		return err
+	}
+	*p = append(*p, value)
+	return nil
 }
 
 var args = Args{}
-var logger *log.Logger
+
+// Set at build time with -ldflags "-X main.Version=...".
+var Version = "dev"
+
+// Replaced by OpenLogger once the options are known.
+var logger = NewLogger(os.Stderr, LevelInfo, false)
+var excludedContigs *regexp.Regexp
+var decoyContigs *regexp.Regexp
+var excludedCounts = make(map[string]int)
 
 func init() {
 	log.SetFlags(0)
-	flag.StringVar(&args.Sample, "sample", "", "BAM file of the sample you want to filter (sorted by name, required)")
+	flag.StringVar(&args.Sample, "sample", "", "BAM file of the sample you want to filter (sorted by name, required unless -fastq)")
+	flag.StringVar(&args.Fastq, "fastq", "", "instead of -sample, align these reads (r1.fq.gz,r2.fq.gz if paired) to -reference and to the contamination references given in place of BAMs, with -align-with")
+	flag.StringVar(&args.Reference, "reference", "", "the sample's reference for -fastq, as -align-with takes it (index prefix, or STAR genome directory)")
+	flag.StringVar(&args.AlignWith, "align-with", "bwa-mem2", "aligner to run on -fastq reads, and on sample reads for contamination references (.fa, .fasta or .fna) given in place of BAMs: "+strings.Join(alignCommands, ", "))
+	flag.IntVar(&args.AlignThreads, "align-threads", 4, "threads for each -align-with aligner, of which one runs per reference at once")
 	flag.Float64Var(&args.Margin, "margin", 1.0, "how much better sample needs to be matched")
+	flag.Float64Var(&args.MarginFrac, "margin-frac", 0, "additional margin as a fraction of the sample alignment length, e.g. 0.02")
+	flag.Float64Var(&args.AmbiguousWindow, "ambiguous-window", 0, "call reads ambiguous, neither kept nor rejected, when the sample score is within this much either side of the best contaminant score plus the margin")
+	flag.StringVar(&args.Ties, "ties", "reject", "what to do with reads whose sample score exactly ties the best contaminant score plus the margin: keep, reject, or call them ambiguous")
+	flag.StringVar(&args.KeepIf, "keep-if", "", "keep reads whose sample score is greater than the best contaminant score plus the margin (the same as -ties reject), or at-least it (-ties keep)")
+	flag.StringVar(&args.AmbiguousOutput, "ambiguous-output", "", "write ambiguous reads, of -ambiguous-window or -ties ambiguous, to this bam file rather than leaving them out")
 	flag.IntVar(&args.MinLength, "min-len", 60, "min length for an alignment")
+	flag.Float64Var(&args.MinMappedFrac, "min-mapped-frac", 0, "filter out sample mates with less than this fraction of their read aligned (by CIGAR, counting clipped bases in the read), e.g. 0.8, rather than or as well as -min-len")
 	flag.IntVar(&args.MaxDist, "max-edit-dist", 5, "max edit distance for a sample match")
+	flag.Float64Var(&args.MaxNFrac, "max-n-frac", 1, "filter out sample mates with more than this fraction of their bases N, e.g. 0.1")
+	flag.Float64Var(&args.Dust, "dust", 0, "filter out sample mates of low complexity, with a DUST score above this in any 64 base window (e.g. 7; 0 for no filter)")
 	flag.IntVar(&args.Limit, "limit", 0, "limit the number of sample reads considered (0 = no limit)")
+	flag.Float64Var(&args.Subsample, "subsample", 1, "process only this fraction of the sample reads, e.g. 0.1, picked at random (by -seed) but keeping mates together")
+	flag.Int64Var(&args.Seed, "seed", 0, "seed for which reads -subsample picks, the same seed picking the same reads")
+	flag.StringVar(&args.StartRead, "start-read", "", "skip the sample reads before this one in name order")
+	flag.StringVar(&args.StopRead, "stop-read", "", "stop after this sample read, or where it would be in name order")
+	flag.DurationVar(&args.MaxTime, "max-time", 0, "stop after this long, e.g. 3h30m, finishing the outputs, marking the stats partial and writing a -checkpoint to -resume from (exit status 4)")
+	flag.StringVar(&args.Checkpoint, "checkpoint", "", "where to write the checkpoint of a run stopped by -max-time (default the -output name with .checkpoint added)")
+	flag.StringVar(&args.Resume, "resume", "", "carry on from the checkpoint of a run stopped by -max-time, skipping the sample reads it did (needs another -output)")
 	flag.Float64Var(&args.Penalty, "edit-penalty", 2.0, "multiple for how to penalize edit distance")
-	flag.StringVar(&args.Output, "output", "", "output bam file (required)")
+	flag.BoolVar(&args.QualityWeight, "quality-weight", false, "weight mismatches (from MD tags) by base quality, so each counts toward edit distance as the probability the call is right")
+	flag.Float64Var(&args.ClipPenalty, "clip-penalty", 0, "multiple for how to penalize soft-clipped bases, in sample and contamination alignments alike (not applied to -score-tag scores)")
+	flag.StringVar(&args.Output, "output", "", "output bam file, or - for stdout (required)")
+	flag.BoolVar(&args.OutputUncompressed, "output-uncompressed", false, "write uncompressed BAM (samtools -u), e.g. when piping into samtools sort")
+	flag.BoolVar(&args.SortOutput, "sort-output", false, "sort the output BAM files by coordinate (with -sort-tmpdir and -sort-mem)")
+	flag.BoolVar(&args.IndexOutput, "index-output", false, "index the output BAM files once written, requires -sort-output")
+	flag.BoolVar(&args.Force, "force", false, "overwrite output files that already exist")
+	flag.IntVar(&args.CompressionLevel, "compression-level", -1, "BGZF compression level 0-9 for the output BAM files (default samtools' choice)")
+	flag.StringVar(&args.Singletons, "singletons", "", "write kept paired reads left with only one mate to this bam file instead of the output")
+	flag.StringVar(&args.FastqOut, "fastq-out", "", "also write kept reads as bgzipped FASTQ, to files named with this prefix: pairs to prefix_R1.fastq.gz and prefix_R2.fastq.gz, and reads with one mate to prefix_singletons.fastq.gz")
+	flag.BoolVar(&args.FastqInterleaved, "fastq-interleaved", false, "write -fastq-out as one interleaved FASTQ file (bgzipped if it ends in .gz), or - for stdout, instead of by prefix")
+	flag.StringVar(&args.Unmapped, "unmapped", "drop", "what to do with unmapped sample reads: drop, keep (pass through) or separate (see -unmapped-output)")
+	flag.StringVar(&args.UnmappedOutput, "unmapped-output", "", "bam file for unmapped reads with -unmapped separate")
+	flag.StringVar(&args.Decisions, "decisions", "", "write a table of each read's scores, outcome and the reason for it to this file, gzipped if it ends in .gz or Parquet if it ends in .parquet")
+	flag.StringVar(&args.NearMisses, "near-misses", "", "write the reads kept although found in the contamination, with their scores and how far the sample won by, to this file")
+	flag.StringVar(&args.ResultsDB, "results-db", "", "add the run's parameters and stats to this SQLite database (created if need be, with the sqlite3 tool) to query across samples")
+	flag.BoolVar(&args.ResultsDBReads, "results-db-reads", false, "also store each read's decision, as with -decisions, in the -results-db database")
+	flag.BoolVar(&args.Progress, "progress", false, "show a progress bar with percent done, throughput and ETA when stderr is a terminal, instead of logging progress")
+	flag.DurationVar(&args.ProgressInterval, "progress-interval", 30*time.Second, "how often to log progress, e.g. 30s or 5m, or 0 to log every 100000 reads")
+	flag.StringVar(&args.ProgressJSON, "progress-json", "", "write progress events as JSON lines to this file, or stdout or stderr")
+	flag.StringVar(&args.MetricsAddr, "metrics-addr", "", "serve Prometheus metrics of the run's progress on this address, e.g. :9090, at /metrics")
+	flag.StringVar(&args.Sweep, "sweep", "", "also try every combination of -sweep-margins and -sweep-edit-penalties, replacing the margin and edit penalty of every contamination file, and write how many reads each keeps to this file")
+	flag.Var(&args.SweepMargins, "sweep-margins", "comma separated margins for -sweep (default -margin)")
+	flag.Var(&args.SweepPenalties, "sweep-edit-penalties", "comma separated edit penalties for -sweep (default -edit-penalty)")
+	flag.StringVar(&args.Truth, "truth", "", "evaluate the filter against this table of read names and whether each is contaminated (true or false), e.g. from contfilter simulate")
+	flag.StringVar(&args.TruthROC, "truth-roc", "", "with -truth, write precision and recall at every margin that would change them to this file")
+	flag.StringVar(&args.Kraken, "kraken", "", "kraken2 --output classification of the sample's reads, to report how often it agrees with the rejections by alignment")
+	flag.StringVar(&args.KrakenTaxa, "kraken-taxa", "", "comma separated taxon IDs of the contamination for -kraken, e.g. 10090 for mouse")
+	flag.StringVar(&args.KrakenReport, "kraken-report", "", "kraken2 (or Bracken) report whose taxa under the -kraken-taxa count as the contamination too")
+	flag.BoolVar(&args.KrakenRequire, "kraken-require", false, "only reject reads that -kraken also classifies to the contamination")
+	flag.BoolVar(&args.Estimate, "estimate", false, "estimate the fraction of contaminated reads, with a confidence interval, by fitting a mixture to the difference between sample and contamination scores")
+	flag.StringVar(&args.ScoreHistogram, "score-histogram", "", "write a histogram of how much better each compared read scores in the sample than in the contamination to this file")
+	flag.Float64Var(&args.HistogramBin, "histogram-bin", 1, "bin width of -score-histogram")
+	flag.StringVar(&args.MismatchProfile, "mismatch-profile", "", "write the distribution of mismatches (from MD tags) along the read for kept and rejected reads to this file")
+	flag.StringVar(&args.ContList, "cont-list", "", "file listing contamination BAMs one per line, each optionally followed by a label and key=value overrides, along with any given as arguments")
+	flag.BoolVar(&args.DedupeContamination, "dedupe-contamination", false, "leave out contamination files given more than once (by path, or copies with the same size and header) instead of stopping")
+	flag.IntVar(&args.HTTPRetries, "http-retries", 5, "how many times to retry reading an http(s):// or htsget:// input when the connection fails, resuming where it left off, waiting twice as long before each")
+	flag.StringVar(&args.Checksums, "checksums", "", "verify the inputs as they're read against this md5sum or sha256sum manifest, recording the digests in the stats")
+	flag.StringVar(&args.Stats, "stats", "", "write the run's counts as JSON to this file, as on the log's stats line")
+	flag.Float64Var(&args.FailRejectedAbove, "fail-if-rejected-above", -1, "exit with status 3 when more than this fraction of the reads compared, e.g. 0.2, are rejected (negative to not check)")
+	flag.Float64Var(&args.FailKeptBelow, "fail-if-kept-below", -1, "exit with status 3 when less than this fraction of all sample reads, e.g. 0.5, are kept (negative to not check)")
 	flag.StringVar(&args.LogFilename, "log", "", "write parameters and stats to a log file")
-	flag.BoolVar(&args.Verbose, "verbose", false, "keep a record of what happens to each read in the log (must give -log name)")
+	flag.StringVar(&args.LogLevel, "log-level", "info", "how much to log: error, warn, info, debug (what happens to each read) or trace (and the alignments behind it)")
+	flag.StringVar(&args.LogFormat, "log-format", "text", "log as plain text or as JSON lines with a time and level on each message")
+	flag.StringVar(&args.AuditLog, "audit-log", "", "write the record of what happens to each read (as with -verbose) to this gzipped file instead of the log, up to -log-level if that's debug or trace")
+	flag.BoolVar(&args.Verbose, "verbose", false, "keep a record of what happens to each read in the log, the same as -log-level trace (must give -log name)")
+	flag.BoolVar(&args.SkipMalformed, "skip-malformed", false, "count and drop reads whose sample records can't be parsed (e.g. missing the edit distance tag or too few fields), and contamination records likewise, rather than stopping (logged with -log-level debug)")
+	flag.Var(&args.MaxErrors, "max-errors", "with -skip-malformed, stop once more than this many records, or this fraction of the reads if below 1, are malformed (default no limit)")
 	flag.BoolVar(&args.Ercc, "ercc", false, "exclude ERCC mappings from sample before filtering")
+	flag.StringVar(&args.HeaderFrom, "header-from", "", "take the sample's header from this SAM (or BAM) file, e.g. when piping in samtools view without -h")
+	flag.StringVar(&args.Reheader, "reheader", "", "write the header from this SAM (or BAM) file instead of the sample's")
+	flag.Var(&args.KeepHeader, "keep-header", "keep only the @HD line and header lines matching this regular expression (may be repeated)")
+	flag.Var(&args.DropHeader, "drop-header", "drop header lines matching this regular expression (may be repeated)")
+	flag.BoolVar(&args.DropExcludedSQ, "drop-excluded-sq", false, "drop the @SQ lines of contigs excluded by -ercc or -exclude-contigs; samtools will refuse any output record still referring to one")
+	flag.Var(&args.ExcludeContigs, "exclude-contigs", "exclude sample mappings to contigs matching this regular expression before filtering (may be repeated)")
+	flag.StringVar(&args.ExcludeCounts, "exclude-counts", "", "write the number of excluded reads per contig (e.g. ERCC transcript) to this file")
+	flag.StringVar(&args.DecoyContigs, "decoy-contigs", `^(hs37d5|chrEBV|NC_007605|.*_decoy)$`, "regular expression matching the sample's decoy contigs, which reads aligned to are counted")
+	flag.StringVar(&args.DecoyAction, "decoy-action", "compare", "what to do with reads aligned to -decoy-contigs: compare them as usual, exclude them, or keep them without comparing")
+	flag.StringVar(&args.Blacklist, "blacklist", "", "BED file of regions of the contamination references known to cross-map, e.g. conserved genes, whose alignments are treated as -blacklist-action says (or blacklist=file.bed per contamination file)")
+	flag.StringVar(&args.BlacklistAction, "blacklist-action", "ignore", "what to do with contamination alignments in -blacklist regions: ignore them, or flag reads they alone reject but reject them still")
+	flag.StringVar(&args.Intervals, "intervals", "", "BED file or Picard interval list of regions such as rRNA genes and chrM to set sample reads aligned there apart by, before comparing to contamination")
+	flag.StringVar(&args.IntervalsAction, "intervals-action", "remove", "what to do with reads in -intervals: remove them, or count them and compare them as usual")
+	flag.StringVar(&args.ContigCounts, "contig-counts", "", "write how many compared reads aligned to each sample contig were kept and rejected to this file")
+	flag.StringVar(&args.Gtf, "gtf", "", "GTF or GFF3 annotation (may be gzipped) to count kept and rejected reads per gene by, see -gene-counts")
+	flag.StringVar(&args.GtfFeature, "gtf-feature", "", "annotation feature type making up genes (default exon for GTF, gene for GFF3)")
+	flag.StringVar(&args.GeneCounts, "gene-counts", "", "write how many compared reads overlapping each -gtf gene were kept and rejected to this file")
+	flag.Var(&args.RequireFlags, "require-flags", "only consider sample alignments with all of these FLAG bits set (number or names, like samtools -f)")
+	flag.Var(&args.ExcludeFlags, "exclude-flags", "ignore sample alignments with any of these FLAG bits set (number or names, like samtools -F)")
+	flag.Var(&args.SetFlags, "set-flags", "set these FLAG bits on the alignments of kept reads as they're written (number or names, e.g. QCFAIL)")
+	flag.Var(&args.ClearFlags, "clear-flags", "clear these FLAG bits on the alignments of kept reads as they're written (number or names, e.g. DUP)")
+	flag.Var(&args.AmbiguousSetFlags, "ambiguous-set-flags", "set these FLAG bits on the alignments written to -ambiguous-output (number or names, e.g. QCFAIL)")
+	flag.Var(&args.AmbiguousClearFlags, "ambiguous-clear-flags", "clear these FLAG bits on the alignments written to -ambiguous-output (number or names)")
+	flag.StringVar(&args.Duplicates, "duplicates", "compare", "how to treat reads flagged as PCR duplicates: compare (like any other), exclude, or inherit the decision made for the read they duplicate")
+	flag.BoolVar(&args.AutoSort, "auto-sort", false, "sort inputs whose header doesn't declare them sorted by name with samtools sort -n")
+	flag.BoolVar(&args.AutoIndex, "auto-index", false, "index contamination BAMs that aren't sorted by name (e.g. coordinate-sorted) as with contfilter index, rather than sorting them")
+	flag.StringVar(&args.SortTmpDir, "sort-tmpdir", "", "directory for temporary files when sorting (default samtools' choice)")
+	flag.StringVar(&args.MaxMemory, "max-memory", "", "memory to keep to, e.g. 8G, shared with the samtools sorts run (which get half unless -sort-mem is given): duplicate decisions spill to disk, -prefilter exact falls back to bloom filters and -sort-window is cut short past their shares")
+	flag.StringVar(&args.SortMem, "sort-mem", "", "memory per thread for samtools sort, e.g. 2G (default samtools' choice)")
+	flag.IntVar(&args.MaxRecordSize, "max-record-size", 16, "the longest SAM line to read, in MiB (at least 256 with -long-read)")
+	flag.BoolVar(&args.NormalizeNames, "normalize-names", false, "match reads by name without any /1 or /2 suffix or comment after a space, as some aligners and FASTQ preparations leave them, in all the inputs (and so the output)")
+	flag.StringVar(&args.ContigMap, "contig-map", "", "file of contig names to rename (a line each of the name and the one to use instead, e.g. 1 chr1), applied to the RNAME and RNEXT of all the inputs and their @SQ headers, before any exclusions or reports")
+	flag.BoolVar(&args.Strict, "strict", false, "check every record of the inputs against the SAM spec (FLAG bits, field counts and values, CIGAR against SEQ and QUAL, optional field syntax), stopping at the first that isn't with its file and line")
+	flag.IntVar(&args.SortWindow, "sort-window", 0, "put records of the inputs that are out of name order by up to this many records (e.g. from concatenating files) back in order instead of stopping")
+	flag.StringVar(&args.SamtoolsPath, "samtools-path", "samtools", "samtools to run, e.g. a particular version's full path")
+	flag.StringVar(&args.Backend, "backend", "samtools", "what reads the BAM files: samtools, or sambamba (its view, found on the PATH; samtools still sorts and writes)")
+	flag.BoolVar(&args.Native, "native", false, "read and write BAM files in Go rather than with samtools, as is done when samtools can't be found (inputs must then be sorted by name already)")
+	flag.IntVar(&args.NativeThreads, "native-threads", 0, "how many threads to compress and decompress BGZF (BAM and bgzipped SAM) with when reading and writing natively, or 0 for one per CPU")
+	flag.StringVar(&args.SortOrder, "sort-order", "auto", "read name ordering of the inputs: natural (samtools), lexicographic or auto (from the @HD header)")
+	flag.StringVar(&args.SampleAlignment, "sample-alignment", "primary", "which of a sample mate's alignments to score it by: primary or best")
+	flag.BoolVar(&args.PrimaryOnly, "primary-only", false, "write only the primary alignment of kept sample mates, leaving out secondary and supplementary ones (which are still used in scoring as usual)")
+	flag.BoolVar(&args.DropSecondary, "drop-secondary", false, "don't write the other alignments of kept sample mates to the output")
+	flag.StringVar(&args.PairScore, "pair-score", "best", "how to score a read with both mates: best (best mate), sum or mean of the mates' scores")
+	flag.BoolVar(&args.LongRead, "long-read", false, "score long-read (e.g. minimap2) alignments by alignment block length and de/NM divergence")
+	flag.StringVar(&args.Length, "length", "seq", "take alignment length from seq (the length of SEQ) or cigar (aligned bases, excluding N skips and clipping)")
+	flag.StringVar(&args.Deletions, "deletions", "auto", "whether deletions count toward CIGAR alignment length: count, ignore or auto (count only with -long-read)")
+	flag.BoolVar(&args.ShortCircuit, "short-circuit", false, "don't compare a read against the remaining contamination files once one rejects it, so their found and rejected counts leave out such reads")
+	flag.StringVar(&args.Prefilter, "prefilter", "none", "first gather the read names in each contamination BAM into a bloom filter or exact set, so reads absent from one skip scanning it: none, bloom or exact")
+	flag.IntVar(&args.BloomSize, "bloom-size", 64, "size in MB of each contamination BAM's bloom filter with -prefilter bloom")
+	flag.StringVar(&args.EditTag, "edit-tag", "auto", "tag holding the edit distance, e.g. nM or NM, or auto to go by the aligner named in each file's @PG header")
+	flag.StringVar(&args.ScoreTag, "score-tag", "", "score alignments by this tag (e.g. AS, or auto for the aligner's) instead of length and edit distance")
+	flag.BoolVar(&args.Annotate, "annotate", false, "tag kept reads with their score (ZS), best contaminant score (ZC) and that contaminant's file (ZN)")
+	flag.StringVar(&args.KeepTags, "keep-tags", "", "write only these optional fields of kept reads, as a comma separated list of tags (e.g. NM,MD,AS), along with any -annotate tags")
+	flag.StringVar(&args.StripTags, "strip-tags", "", "leave these optional fields out of kept reads, as a comma separated list of tags (e.g. OQ,BI,BD)")
 	flag.Usage = func() {
-		log.Println("usage: contfilter [options] cont1.bam cont2.bam")
+		log.Println("usage: contfilter [options] cont1.bam[:key=value,...] cont2.bam ...")
+		log.Println("       contfilter index [-o out.cfi] [-normalize-names] cont.bam")
+		log.Println("       contfilter validate [options] file.bam ...")
+		log.Println("       contfilter explain -read NAME [options] cont1.bam ...")
+		log.Println("       contfilter bench [-reads N] [-read-len L] [options]")
+		log.Println("       contfilter simulate [options] -o prefix")
+		log.Println("       contfilter stats-merge [-o merged.json] run1.json run2.json ...")
+		log.Println("       contfilter stats-diff [-max-diff points] a.json b.json")
+		log.Println("  margin, margin-frac, edit-penalty, min-len and max-edit-dist can be overridden per contamination file,")
+		log.Println("  which can also be given a weight, label, blacklist (BED file) and index (.cfi file)")
+		log.Println("  weight=w divides how much better the sample scores than that file before comparing with the margin, so below 1 makes it harder to reject by")
 		flag.PrintDefaults()
 	}
 }
@@ -51,31 +322,30 @@ func benchmark(start time.Time, label string) {
 	logger.Printf("%s took %s", label, elapsed)
 }
 
-func extract(row []string) (int, int, error) {
-	if len(row) < 15 {
-		return 0, 0, fmt.Errorf("too few fields")
+func OpenLogger() {
+	level, err := ParseLevel(args.LogLevel)
+	if err != nil {
+		log.Fatal(err)
 	}
-	match_len := len(row[9])
-	edit_tag := row[14]
-	if edit_tag[:5] != "nM:i:" {
-		return 0, 0, fmt.Errorf("malformed edit distance tag: %s", edit_tag)
+	if args.Verbose || (args.AuditLog != "" && level < LevelDebug) {
+		level = LevelTrace
 	}
-	edit_dist, err := strconv.Atoi(edit_tag[5:])
-	if err != nil {
-		return 0, 0, fmt.Errorf("failed to parse edit dist: %s", edit_tag)
+	if args.LogFormat != "text" && args.LogFormat != "json" {
+		log.Fatal("-log-format must be text or json")
 	}
-	return match_len, edit_dist, nil
-}
-
-func OpenLogger() {
-	if args.LogFilename == "" {
-		logger = log.New(os.Stderr, "", 0)
-	} else {
+	var out io.Writer = os.Stderr
+	if args.LogFilename != "" {
 		logfile, err := os.Create(args.LogFilename)
 		if err != nil {
 			log.Fatal(err)
 		}
-		logger = log.New(logfile, "", 0)
+		out = logfile
+	}
+	logger = NewLogger(out, level, args.LogFormat == "json")
+	if args.AuditLog != "" {
+		if err := logger.OpenAudit(args.AuditLog); err != nil {
+			log.Fatal(err)
+		}
 	}
 }
 
@@ -88,19 +358,220 @@ func LogArguments() {
 	logger.Println(string(blob))
 }
 
-func MatchesErcc(mate1, mate2 []string) bool {
-	return args.Ercc &&
-		(strings.Contains(mate1[2], "ERCC") || (mate2 != nil && strings.Contains(mate2[2], "ERCC")))
+// Combine -ercc and the -exclude-contigs patterns into a single expression.
+func CompileExclusions() error {
+	patterns := []string{}
+	if args.Ercc {
+		patterns = append(patterns, "ERCC")
+	}
+	for _, p := range args.ExcludeContigs {
+		patterns = append(patterns, "(?:"+p+")")
+	}
+	if len(patterns) == 0 {
+		return nil
+	}
+	re, err := regexp.Compile(strings.Join(patterns, "|"))
+	if err != nil {
+		return fmt.Errorf("bad contig exclusion pattern: %v", err)
+	}
+	excludedContigs = re
+	return nil
+}
+
+func CompileDecoys() error {
+	if args.DecoyContigs == "" {
+		return nil
+	}
+	re, err := regexp.Compile(args.DecoyContigs)
+	if err != nil {
+		return fmt.Errorf("bad -decoy-contigs pattern: %v", err)
+	}
+	decoyContigs = re
+	return nil
+}
+
+// Whether either mate is mapped to a contig matching re.
+func matchesContigs(re *regexp.Regexp, mate1, mate2 *Mate) bool {
+	return re != nil &&
+		(re.MatchString(mate1.Record[2]) || (mate2 != nil && re.MatchString(mate2.Record[2])))
+}
+
+func MatchesExcluded(mate1, mate2 *Mate) bool {
+	return matchesContigs(excludedContigs, mate1, mate2)
+}
+
+func MatchesDecoy(mate1, mate2 *Mate) bool {
+	return matchesContigs(decoyContigs, mate1, mate2)
+}
+
+// Tally an excluded read against each excluded contig its mates map to. A
+// pair with both mates on the same contig counts once.
+func CountExcluded(mate1, mate2 *Mate) {
+	contig1 := mate1.Record[2]
+	if excludedContigs.MatchString(contig1) {
+		excludedCounts[contig1]++
+	}
+	if mate2 != nil {
+		contig2 := mate2.Record[2]
+		if contig2 != contig1 && excludedContigs.MatchString(contig2) {
+			excludedCounts[contig2]++
+		}
+	}
+}
+
+func WriteExcludedCounts(filename string) error {
+	fp, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	contigs := make([]string, 0, len(excludedCounts))
+	for contig := range excludedCounts {
+		contigs = append(contigs, contig)
+	}
+	sort.Strings(contigs)
+	fmt.Fprintf(fp, "contig\treads\n")
+	for _, contig := range contigs {
+		fmt.Fprintf(fp, "%s\t%d\n", contig, excludedCounts[contig])
+	}
+	return fp.Close()
+}
+
+// What we learn about an input file from its header before streaming it.
+type Input struct {
+	Filename string
+	Header   string
+	Order    HeaderOrder
+	Sort     bool
+}
+
+// Read the header of every input file up front so that one that is clearly not
+// sorted by name fails before we've streamed millions of lines of the others.
+func CheckInputs(bamfiles []string) (map[string]*Input, error) {
+	inputs := make(map[string]*Input)
+	for _, bamfile := range bamfiles {
+		if err := CheckBgzfEOF(bamfile); err != nil {
+			return nil, err
+		}
+		header, err := ReadBamHeader(bamfile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", bamfile, err)
+		}
+		needsSort, err := CheckSortOrder(bamfile, header, args.AutoSort)
+		if err != nil {
+			return nil, err
+		}
+		inputs[bamfile] = &Input{
+			Filename: bamfile,
+			Header:   header,
+			Order:    ParseHeaderOrder(header),
+			Sort:     needsSort,
+		}
+	}
+	return inputs, nil
+}
+
+// Settle on how read names are ordered. With -sort-order auto we go by the SS
+// field of the headers, falling back to samtools' natural ordering.
+func ChooseNameOrder(inputs map[string]*Input) (string, error) {
+	if args.SortOrder != "auto" {
+		return args.SortOrder, nil
+	}
+	chosen := ""
+	chosenFrom := ""
+	for filename, input := range inputs {
+		if input.Sort {
+			// We'll be sorting this one ourselves in whatever order we pick.
+			continue
+		}
+		order := input.Order.NameOrder()
+		if order == "" {
+			continue
+		}
+		if chosen != "" && order != chosen {
+			return "", fmt.Errorf("%s is sorted in %s order but %s is sorted in %s order",
+				chosenFrom, chosen, filename, order)
+		}
+		chosen = order
+		chosenFrom = filename
+	}
+	if chosen == "" {
+		return "natural", nil
+	}
+	return chosen, nil
+}
+
+func sampleName() string {
+	if args.Fastq != "" {
+		return args.Fastq
+	}
+	if args.Sample == "" {
+		return "stdin"
+	}
+	return args.Sample
+}
+
+// A writer for one of the output BAM files, set up by the output flags.
+func NewOutputWriter() BamWriter {
+	return BamWriter{
+		Uncompressed: args.OutputUncompressed,
+		Level:        args.CompressionLevel,
+		Sort:         args.SortOutput,
+		TmpDir:       args.SortTmpDir,
+		Mem:          args.SortMem,
+	}
+}
+
+// Open a BAM file for scanning, sorting it by name on the fly if need be.
+func OpenInput(scanner *BamScanner, input *Input) error {
+	if input.Sort {
+		logger.Printf("%s is not sorted by name, sorting it with samtools sort\n", input.Filename)
+		return scanner.OpenSorting(input.Filename, args.SortTmpDir, args.SortMem, args.SortOrder == "lexicographic")
+	}
+	return scanner.OpenBam(input.Filename)
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "index":
+			indexMain(os.Args[2:])
+			return
+		case "validate":
+			validateMain(os.Args[2:])
+			return
+		case "explain":
+			explainMain(os.Args[2:])
+			return
+		case "bench":
+			benchMain(os.Args[2:])
+			return
+		case "simulate":
+			simulateMain(os.Args[2:])
+			return
+		case "stats-merge":
+			statsMergeMain(os.Args[2:])
+			return
+		case "stats-diff":
+			statsDiffMain(os.Args[2:])
+			return
+		}
+	}
+
 	var kept_percent float64
 	flag.Parse()
-	contamination := flag.Args()
+	contArgs := flag.Args()
 	startedAt := time.Now()
 
-	if len(contamination) == 0 {
-		logger.Println("must specify at least one contamination mapping BAM file")
+	if args.ContList != "" {
+		listed, err := ReadContaminantList(args.ContList)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		contArgs = append(contArgs, listed...)
+	}
+
+	if len(contArgs) == 0 {
+		logger.Println("must specify at least one contamination mapping BAM file, as an argument or in -cont-list")
 		os.Exit(1)
 	}
 
@@ -108,39 +579,542 @@ func main() {
 		logger.Println("must specify -output file")
 		os.Exit(1)
 	}
+	if args.CompressionLevel < -1 || args.CompressionLevel > 9 {
+		log.Println("-compression-level must be between 0 and 9")
+		os.Exit(1)
+	}
+	if args.IndexOutput && (!args.SortOutput || args.Output == "-" || IsObject(args.Output)) {
+		log.Println("-index-output requires -sort-output and a local -output file")
+		os.Exit(1)
+	}
+	if args.MinMappedFrac < 0 || args.MinMappedFrac > 1 {
+		log.Println("-min-mapped-frac must be a fraction from 0 to 1")
+		os.Exit(1)
+	}
+	if args.MaxNFrac < 0 || args.MaxNFrac > 1 {
+		log.Println("-max-n-frac must be a fraction from 0 to 1")
+		os.Exit(1)
+	}
+	if args.Dust < 0 {
+		log.Println("-dust can't be negative")
+		os.Exit(1)
+	}
+	if args.AmbiguousWindow < 0 {
+		log.Println("-ambiguous-window can't be negative")
+		os.Exit(1)
+	}
+	// -ties defaults to reject, so only one given on the command line
+	// contradicts -keep-if at-least.
+	ties_set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "ties" {
+			ties_set = true
+		}
+	})
+	switch args.Ties {
+	case "keep", "reject", "ambiguous":
+	default:
+		log.Println("-ties must be one of keep, reject or ambiguous")
+		os.Exit(1)
+	}
+	switch args.KeepIf {
+	case "", "greater", "at-least":
+	default:
+		log.Println("-keep-if must be greater or at-least")
+		os.Exit(1)
+	}
+	switch {
+	case args.KeepIf == "":
+	case args.Ties == "ambiguous":
+		log.Println("-keep-if can't be used with -ties ambiguous")
+		os.Exit(1)
+	case args.KeepIf == "greater" && args.Ties == "keep":
+		log.Println("-keep-if greater contradicts -ties keep")
+		os.Exit(1)
+	case args.KeepIf == "at-least" && ties_set && args.Ties == "reject":
+		log.Println("-keep-if at-least contradicts -ties reject")
+		os.Exit(1)
+	case args.KeepIf == "greater":
+		args.Ties = "reject"
+	case args.KeepIf == "at-least":
+		args.Ties = "keep"
+	}
+	if args.AmbiguousOutput != "" && args.AmbiguousWindow == 0 && args.Ties != "ambiguous" {
+		log.Println("-ambiguous-output requires -ambiguous-window or -ties ambiguous")
+		os.Exit(1)
+	}
+	if args.Singletons == "-" || args.UnmappedOutput == "-" || args.AmbiguousOutput == "-" {
+		log.Println("only -output can be written to stdout")
+		os.Exit(1)
+	}
+	if !args.Force {
+		outputs := []string{args.Output, args.Singletons, args.AmbiguousOutput}
+		if args.Unmapped == "separate" {
+			outputs = append(outputs, args.UnmappedOutput)
+		}
+		if args.FastqInterleaved {
+			outputs = append(outputs, args.FastqOut)
+		} else if args.FastqOut != "" {
+			outputs = append(outputs, args.FastqOut+"_R1.fastq.gz", args.FastqOut+"_R2.fastq.gz", args.FastqOut+"_singletons.fastq.gz")
+		}
+		for _, filename := range outputs {
+			if filename == "" || filename == "-" {
+				continue
+			}
+			if _, err := os.Stat(filename); err == nil {
+				log.Printf("%s already exists, use -force to overwrite it\n", filename)
+				os.Exit(1)
+			}
+		}
+	}
+
+	if args.SampleAlignment != "primary" && args.SampleAlignment != "best" {
+		log.Println("-sample-alignment must be primary or best")
+		os.Exit(1)
+	}
+	switch args.Unmapped {
+	case "drop", "keep":
+	case "separate":
+		if args.UnmappedOutput == "" {
+			log.Println("-unmapped separate requires -unmapped-output")
+			os.Exit(1)
+		}
+	default:
+		log.Println("-unmapped must be one of drop, keep or separate")
+		os.Exit(1)
+	}
+	switch args.Duplicates {
+	case "compare", "exclude", "inherit":
+	default:
+		log.Println("-duplicates must be one of compare, exclude or inherit")
+		os.Exit(1)
+	}
+	switch args.Length {
+	case "seq", "cigar":
+	default:
+		log.Println("-length must be seq or cigar")
+		os.Exit(1)
+	}
+	switch args.Deletions {
+	case "auto", "count", "ignore":
+	default:
+		log.Println("-deletions must be one of auto, count or ignore")
+		os.Exit(1)
+	}
+	switch args.Prefilter {
+	case "none", "bloom", "exact":
+	default:
+		log.Println("-prefilter must be one of none, bloom or exact")
+		os.Exit(1)
+	}
+	if args.Prefilter == "bloom" && args.BloomSize < 1 {
+		log.Println("-bloom-size must be at least 1")
+		os.Exit(1)
+	}
+	switch args.PairScore {
+	case "best", "sum", "mean":
+	default:
+		log.Println("-pair-score must be one of best, sum or mean")
+		os.Exit(1)
+	}
+	switch args.SortOrder {
+	case "auto", "natural", "lexicographic":
+	default:
+		log.Println("-sort-order must be one of auto, natural or lexicographic")
+		os.Exit(1)
+	}
+	if args.FastqInterleaved && args.FastqOut == "" {
+		log.Println("-fastq-interleaved requires -fastq-out")
+		os.Exit(1)
+	}
+	if args.FastqOut == "-" {
+		if !args.FastqInterleaved {
+			log.Println("-fastq-out can only go to stdout with -fastq-interleaved")
+			os.Exit(1)
+		}
+		if args.Output == "-" || args.ProgressJSON == "stdout" || args.Stats == "-" {
+			log.Println("-fastq-out can't go to stdout along with -output, -progress-json or -stats")
+			os.Exit(1)
+		}
+	}
+	if args.ProgressJSON == "stdout" && args.Output == "-" {
+		log.Println("-progress-json can't go to stdout with the output")
+		os.Exit(1)
+	}
+	if args.Stats == "-" && (args.Output == "-" || args.ProgressJSON == "stdout") {
+		log.Println("-stats can't go to stdout along with -output or -progress-json")
+		os.Exit(1)
+	}
+	if (len(args.SweepMargins) > 0 || len(args.SweepPenalties) > 0) && args.Sweep == "" {
+		log.Println("-sweep-margins and -sweep-edit-penalties require -sweep")
+		os.Exit(1)
+	}
+	if (args.Gtf == "") != (args.GeneCounts == "") {
+		log.Println("-gtf and -gene-counts go together")
+		os.Exit(1)
+	}
+	if args.HistogramBin <= 0 {
+		log.Println("-histogram-bin must be positive")
+		os.Exit(1)
+	}
+	if args.TruthROC != "" && args.Truth == "" {
+		log.Println("-truth-roc requires -truth")
+		os.Exit(1)
+	}
+	if args.MaxErrors != (ErrorBudget{}) && !args.SkipMalformed {
+		log.Println("-max-errors requires -skip-malformed")
+		os.Exit(1)
+	}
+	if args.ShortCircuit && (args.Sweep != "" || args.Truth != "" || args.Estimate || args.ScoreHistogram != "") {
+		log.Println("-short-circuit can't be used with -sweep, -truth, -estimate or -score-histogram, which need every read compared against every contamination file")
+		os.Exit(1)
+	}
+	if args.DecoyAction != "compare" && args.DecoyAction != "exclude" && args.DecoyAction != "keep" {
+		log.Println("-decoy-action must be compare, exclude or keep")
+		os.Exit(1)
+	}
+	if args.BlacklistAction != "ignore" && args.BlacklistAction != "flag" {
+		log.Println("-blacklist-action must be ignore or flag")
+		os.Exit(1)
+	}
+	if args.IntervalsAction != "remove" && args.IntervalsAction != "count" {
+		log.Println("-intervals-action must be remove or count")
+		os.Exit(1)
+	}
+	if args.Fastq != "" {
+		if args.Sample != "" || args.Reference == "" {
+			log.Println("-fastq takes the place of -sample and needs the -reference to align to")
+			os.Exit(1)
+		}
+		if args.Prefilter != "none" || args.AutoIndex || args.Checksums != "" || args.HeaderFrom != "" {
+			log.Println("-fastq can't be used with -prefilter, -auto-index, -checksums or -header-from, there being no BAMs to read")
+			os.Exit(1)
+		}
+		if args.AlignThreads < 1 {
+			log.Println("-align-threads must be at least 1")
+			os.Exit(1)
+		}
+	} else if args.Reference != "" {
+		log.Println("-reference requires -fastq")
+		os.Exit(1)
+	}
+	if (args.Kraken == "") != (args.KrakenTaxa == "") {
+		log.Println("-kraken and -kraken-taxa go together")
+		os.Exit(1)
+	}
+	if (args.KrakenReport != "" || args.KrakenRequire) && args.Kraken == "" {
+		log.Println("-kraken-report and -kraken-require require -kraken")
+		os.Exit(1)
+	}
+	if args.Backend != "samtools" && args.Backend != "sambamba" {
+		log.Println("-backend must be samtools or sambamba")
+		os.Exit(1)
+	}
+	samtoolsPath = args.SamtoolsPath
+	viewBackend = args.Backend
+	forceNative = args.Native
+	if args.NativeThreads < 0 {
+		log.Println("-native-threads can't be negative")
+		os.Exit(1)
+	}
+	if args.NativeThreads > 0 {
+		nativeThreads = args.NativeThreads
+	}
+	if args.HTTPRetries < 0 {
+		log.Println("-http-retries can't be negative")
+		os.Exit(1)
+	}
+	httpRetries = args.HTTPRetries
+	if args.ResultsDBReads && args.ResultsDB == "" {
+		log.Println("-results-db-reads requires -results-db")
+		os.Exit(1)
+	}
+
+	if args.MaxRecordSize <= 0 {
+		log.Println("-max-record-size must be positive")
+		os.Exit(1)
+	}
+	if args.LongRead && args.MaxRecordSize < 256 {
+		args.MaxRecordSize = 256
+	}
+	maxRecordSize = args.MaxRecordSize << 20
+	if args.SortWindow < 0 {
+		log.Println("-sort-window can't be negative")
+		os.Exit(1)
+	}
+	sortWindow = args.SortWindow
+	normalizeNames = args.NormalizeNames
+	strictRecords = args.Strict
+	if args.SetFlags&args.ClearFlags != 0 {
+		log.Println("-set-flags and -clear-flags can't both change the same FLAG bits")
+		os.Exit(1)
+	}
+	if args.AmbiguousSetFlags&args.AmbiguousClearFlags != 0 {
+		log.Println("-ambiguous-set-flags and -ambiguous-clear-flags can't both change the same FLAG bits")
+		os.Exit(1)
+	}
+	if (args.AmbiguousSetFlags != 0 || args.AmbiguousClearFlags != 0) && args.AmbiguousOutput == "" {
+		log.Println("-ambiguous-set-flags and -ambiguous-clear-flags require -ambiguous-output")
+		os.Exit(1)
+	}
+	keptFlags = FlagEdit{int(args.SetFlags), int(args.ClearFlags)}
+	ambiguousFlags = FlagEdit{int(args.AmbiguousSetFlags), int(args.AmbiguousClearFlags)}
+	if args.KeepTags != "" && args.StripTags != "" {
+		log.Println("-keep-tags and -strip-tags can't be used together")
+		os.Exit(1)
+	}
+	if args.KeepTags != "" || args.StripTags != "" {
+		list := args.StripTags
+		if args.KeepTags != "" {
+			list = args.KeepTags
+			if args.Annotate {
+				list += ",ZS,ZC,ZN"
+			}
+		}
+		filter, err := NewTagFilter(list, args.KeepTags != "")
+		if err != nil {
+			log.Println("-keep-tags/-strip-tags:", err)
+			os.Exit(1)
+		}
+		outputTags = filter
+	}
+	if !(args.Subsample > 0 && args.Subsample <= 1) {
+		log.Println("-subsample must be a fraction above 0 and at most 1")
+		os.Exit(1)
+	}
+	if args.MaxMemory != "" {
+		limit, err := ParseSize(args.MaxMemory)
+		if err != nil {
+			log.Println("-max-memory:", err)
+			os.Exit(1)
+		}
+		sorts := 0
+		if args.AutoSort || args.Fastq != "" {
+			sorts += 1 + len(contArgs)
+		}
+		if args.SortOutput {
+			sorts += 3
+		}
+		memoryBudget, err = NewMemoryBudget(limit, sorts, len(contArgs), args.SortMem)
+		if err != nil {
+			log.Println("-max-memory:", err)
+			os.Exit(1)
+		}
+		args.SortMem = memoryBudget.SortMem
+		windowBytes = memoryBudget.Window
+	}
 
 	OpenLogger()
 	LogArguments()
+	if args.ContigMap != "" {
+		names, err := ReadContigMap(args.ContigMap)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		contigMap = names
+		logger.Printf("renaming %d contigs as in %s\n", len(contigMap), args.ContigMap)
+	}
+	if args.MaxMemory != "" {
+		memoryBudget.Apply()
+		sorting := ""
+		if memoryBudget.SortMem != "" {
+			sorting = ", samtools sort -m " + memoryBudget.SortMem
+		}
+		logger.Printf("keeping to -max-memory %s: %s for contfilter%s\n", args.MaxMemory,
+			formatBytes(uint64(memoryBudget.Heap)), sorting)
+	}
 
-	scanner := BamScanner{}
-	if args.Sample == "" {
-		scanner.OpenStdin()
-	} else {
-		if err := scanner.OpenBam(args.Sample); err != nil {
+	if err := CompileExclusions(); err != nil {
+		logger.Fatal(err)
+	}
+	if err := CompileDecoys(); err != nil {
+		logger.Fatal(err)
+	}
+	if args.ExcludeCounts != "" && excludedContigs == nil {
+		logger.Println("-exclude-counts requires -ercc or -exclude-contigs")
+		os.Exit(1)
+	}
+	if args.DropExcludedSQ && excludedContigs == nil {
+		logger.Println("-drop-excluded-sq requires -ercc or -exclude-contigs")
+		os.Exit(1)
+	}
+
+	if args.Checksums != "" {
+		manifest, err := ReadChecksums(args.Checksums)
+		if err != nil {
 			logger.Fatal(err)
 		}
+		checksums = manifest
+	}
+
+	run, err := OpenRun(contArgs)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	contamination := run.Contamination
+	sources := run.Sources
+	scanner := run.Sample
+	sampleAligner := run.SampleAligner
+
+	var filters []NameFilter
+	if args.Prefilter != "none" {
+		filters = make([]NameFilter, len(contamination))
+		for c, cont := range contamination {
+			if cont.Index != nil || IsFasta(cont.Filename) {
+				continue
+			}
+			filters[c] = NewNameFilter(args.Prefilter, cont.Filename)
+			n, err := BuildNameFilter(cont.Filename, filters[c])
+			if err != nil {
+				logger.Fatal(err)
+			}
+			logger.Printf("prefiltering with %d mapped records from %s\n", n, cont.Filename)
+		}
+		benchmark(startedAt, "prefiltering")
 	}
 
 	reads_found := make([]int, len(contamination))
 	reads_filtered := make([]int, len(contamination))
-	contScanners := make([]BamScanner, len(contamination))
-	rejected := make([]bool, len(contamination))
-	found := make([]bool, len(contamination))
+	reads_prefiltered := make([]int, len(contamination))
+	reads_short_circuited := make([]int, len(contamination))
+	reads_blacklisted := make([]int, len(contamination))
+
+	header := run.SampleHeader
+	if args.Reheader != "" {
+		header, err = ReadHeaderFile(args.Reheader)
+		if err != nil {
+			logger.Fatal(err)
+		}
+	}
+	if len(args.KeepHeader) > 0 || len(args.DropHeader) > 0 {
+		header = FilterHeader(header, args.KeepHeader, args.DropHeader)
+	}
+	if args.DropExcludedSQ {
+		var dropped []string
+		header, dropped = DropSequences(header, excludedContigs)
+		logger.Printf("dropped %d excluded sequences from the output header\n", len(dropped))
+	}
+	if run.SampleSorted {
+		header = SetSortOrder(header, "queryname")
+	}
+	header = AddProgramLine(header, os.Args)
+
+	var mismatches *MismatchProfile
+	if args.MismatchProfile != "" {
+		mismatches = &MismatchProfile{}
+	}
 
-	for c := 0; c < len(contamination); c++ {
-		if err := contScanners[c].OpenBam(contamination[c]); err != nil {
+	var metrics *Metrics
+	if args.MetricsAddr != "" {
+		metrics = NewMetrics(contamination)
+		if err := metrics.Serve(args.MetricsAddr); err != nil {
 			logger.Fatal(err)
 		}
-		reads_found[c] = 0
-		reads_filtered[c] = 0
+		logger.Printf("serving metrics on %s/metrics\n", args.MetricsAddr)
 	}
 
-	header, err := ReadBamHeader(args.Sample)
+	var resultsDB *ResultsDB
+	if args.ResultsDB != "" {
+		resultsDB, err = OpenResultsDB(args.ResultsDB)
+		if err != nil {
+			logger.Fatal(err)
+		}
+	}
+
+	var decisions *DecisionWriter
+	if args.Decisions != "" || args.ResultsDBReads {
+		var readsDB *ResultsDB
+		if args.ResultsDBReads {
+			readsDB = resultsDB
+		}
+		decisions, err = NewDecisionWriter(args.Decisions, readsDB)
+		if err != nil {
+			logger.Fatal(err)
+		}
+	}
+
+	near_misses, err := NewNearMisses(args.NearMisses)
 	if err != nil {
 		logger.Fatal(err)
 	}
 
-	out := BamWriter{}
+	var sweep *Sweep
+	if args.Sweep != "" {
+		margins := args.SweepMargins
+		if len(margins) == 0 {
+			margins = FloatList{args.Margin}
+		}
+		penalties := args.SweepPenalties
+		if len(penalties) == 0 {
+			penalties = FloatList{args.Penalty}
+		}
+		sweep = NewSweep(margins, penalties)
+	}
+
+	var evaluation *Evaluation
+	if args.Truth != "" {
+		evaluation, err = LoadTruth(args.Truth)
+		if err != nil {
+			logger.Fatal(err)
+		}
+	}
+
+	var kraken *KrakenCheck
+	if args.Kraken != "" {
+		taxa, err := ReadKrakenTaxa(args.KrakenTaxa, args.KrakenReport)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		kraken, err = LoadKraken(args.Kraken, taxa)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		logger.Printf("kraken2 classified %d reads to the %d contamination taxa\n", len(kraken.contaminated), len(taxa))
+	}
+
+	// The score differences of the reads found in the contamination, for -estimate.
+	var score_diffs []float64
+
+	var contigCounts *ContigCounts
+	if args.ContigCounts != "" {
+		contigCounts = NewContigCounts(run.SampleHeader)
+	}
+
+	var annotation *Annotation
+	if args.Gtf != "" {
+		annotation, err = ReadAnnotation(args.Gtf, args.GtfFeature)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		logger.Printf("read %d genes from %s\n", len(annotation.Genes), args.Gtf)
+	}
+
+	var intervals *Annotation
+	if args.Intervals != "" {
+		intervals, err = ReadIntervals(args.Intervals)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		logger.Printf("read %d regions from %s\n", len(intervals.Genes), args.Intervals)
+	}
+
+	var histogram *ScoreHistogram
+	if args.ScoreHistogram != "" {
+		histogram = NewScoreHistogram(args.HistogramBin)
+	}
+
+	var dupStore *DuplicateStore
+	if args.Duplicates == "inherit" {
+		dupStore, err = NewDuplicateStore(args.SortTmpDir)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		dupStore.Max = memoryBudget.DupDecisions
+		// Duplicates get written after everything else.
+		header = SetSortOrder(header, "unsorted")
+	}
+
+	out := NewOutputWriter()
 	outfp, err := out.Open(args.Output)
 	if err != nil {
 		logger.Fatal(err)
@@ -148,236 +1122,625 @@ func main() {
 
 	io.WriteString(outfp, header)
 
+	// Reads left with only one mate can go to a file of their own.
+	singletons := NewOutputWriter()
+	var singletonsfp io.WriteCloser
+	if args.Singletons != "" {
+		singletonsfp, err = singletons.Open(args.Singletons)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		io.WriteString(singletonsfp, header)
+	}
+
+	var fastqOut *FastqWriter
+	if args.FastqOut != "" {
+		if args.FastqInterleaved {
+			fastqOut, err = NewInterleavedFastqWriter(args.FastqOut)
+		} else {
+			fastqOut, err = NewFastqWriter(args.FastqOut)
+		}
+		if err != nil {
+			logger.Fatal(err)
+		}
+	}
+
+	unmappedOut := NewOutputWriter()
+	var unmappedfp io.WriteCloser
+	if args.Unmapped == "separate" {
+		unmappedfp, err = unmappedOut.Open(args.UnmappedOutput)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		io.WriteString(unmappedfp, header)
+	}
+
+	// Reads neither kept nor rejected can go to a file of their own too.
+	ambiguousOut := NewOutputWriter()
+	var ambiguousfp io.WriteCloser
+	if args.AmbiguousOutput != "" {
+		ambiguousfp, err = ambiguousOut.Open(args.AmbiguousOutput)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		io.WriteString(ambiguousfp, header)
+	}
+
 	reads_kept := 0
+	reads_rejected := 0
+	reads_ambiguous := 0
 	read_mates_kept := 0
+	secondary_kept := 0
+	supplementary_kept := 0
+	singletons_kept := 0
+	unmapped := 0
+	duplicates := 0
+	duplicates_excluded := 0
+	duplicates_kept := 0
+	flag_filtered := 0
+	unmapped_mate_count := 0
 	total_reads := 0
 	total_read_mates := 0
-	ercc := 0
+	excluded := 0
+	in_intervals := 0
+	decoys := 0
 	considered := 0
 	too_short := 0
 	too_diverged := 0
+	too_little_mapped := 0
+	too_many_ns := 0
+	low_complexity := 0
+	malformed := 0
+	malformed_alignments := 0
+	first_malformed := ""
+	// The error that gives up on malformed records with -max-errors, saying
+	// what was seen of them.
+	too_many_malformed := func() error {
+		return fmt.Errorf("giving up after %d malformed reads and %d malformed contamination records "+
+			"in %d reads, more than -max-errors %s allows, the first being: %s; "+
+			"check the inputs are the intended files and -edit-tag or -score-tag suits them",
+			malformed, malformed_alignments, total_reads, args.MaxErrors.String(), first_malformed)
+	}
+
+	resume_after := ""
+	if args.Resume != "" {
+		checkpoint, err := ReadCheckpoint(args.Resume, sampleName())
+		if err != nil {
+			logger.Fatal(err)
+		}
+		resume_after = checkpoint.StoppedAfter
+		logger.Printf("resuming after read %s, where %s stopped\n", resume_after, checkpoint.Output)
+	}
+	if args.StartRead != "" && args.StopRead != "" && nameCmp(args.StartRead, args.StopRead) > 0 {
+		logger.Fatalf("-start-read %s comes after -stop-read %s in name order\n", args.StartRead, args.StopRead)
+	}
+	// The last read done, and whether -max-time stopped the run after it.
+	last_read := ""
+	timed_out := false
+	not_sampled := 0
 
+	progress, err := NewProgress(scanner, contamination)
+	if err != nil {
+		logger.Fatal(err)
+	}
 	err = func() error {
 		defer scanner.Done()
 		defer benchmark(startedAt, "processing")
 
+		// With -skip-malformed a read whose records can't be parsed is
+		// counted and dropped instead of ending the run.
+		skip_malformed := func(read string, err error) error {
+			if !args.SkipMalformed {
+				return err
+			}
+			total_reads++
+			malformed++
+			if first_malformed == "" {
+				first_malformed = err.Error()
+			}
+			decisions.Early(read, "rejected", "malformed")
+			if logger.Enabled(LevelDebug) {
+				logger.Debugf("malformed, skipping: %v\n", err)
+			}
+			if args.MaxErrors.Exceeded(malformed+malformed_alignments, total_reads, false) {
+				return too_many_malformed()
+			}
+			return nil
+		}
+
 		for {
-			if total_reads > 0 && total_reads%100000 == 0 {
-				kept_percent = float64(reads_kept) / float64(considered) * 100
-				logger.Printf("considered %d out of %d so far, kept %0.1f%%\n", considered, total_reads, kept_percent)
+			progress.Update(total_reads, considered, reads_kept, reads_filtered)
+			if total_reads%metricsInterval == 0 {
+				metrics.Update(total_reads, considered, reads_kept, reads_found, reads_filtered)
 			}
 			if args.Limit > 0 && args.Limit == total_reads {
+				if checksums != nil {
+					return scanner.Drain()
+				}
 				return nil
 			}
-
-			// Set up flags for outcomes wrt each potential source of contamination.
-			for c, _ := range contamination {
-				rejected[c] = false
-				found[c] = false
+			if args.MaxTime > 0 && last_read != "" && time.Since(startedAt) >= args.MaxTime {
+				timed_out = true
+				return nil
 			}
 
-			// Read the first mate in a paired end run.
-			mate1, err := scanner.Record()
+			// Gather all the alignments for the next read and sort them into mates.
+			group, err := scanner.Group()
 			if err != nil {
 				return fmt.Errorf("failed to read from sample BAM: %v after %d lines", err, total_reads)
 			}
-			if scanner.Closed {
+			if group == nil {
 				return nil
 			}
-			scanner.Ratchet()
-			read := mate1[0]
-			total_reads++
-			total_read_mates++
-
-			// See if we have the second mate of this pair.
-			mate2, err := scanner.Find(read)
+			read := group[0][0]
+			if resume_after != "" && nameCmp(read, resume_after) <= 0 {
+				continue
+			}
+			if args.StartRead != "" && nameCmp(read, args.StartRead) < 0 {
+				continue
+			}
+			if args.StopRead != "" && nameCmp(read, args.StopRead) > 0 {
+				if checksums != nil {
+					return scanner.Drain()
+				}
+				return nil
+			}
+			last_read = read
+			if args.Subsample < 1 && !Sampled(read, args.Subsample, args.Seed) {
+				not_sampled++
+				continue
+			}
+			if logger.Enabled(LevelTrace) {
+				logger.Tracef("found %d alignments for read %s:\n", len(group), read)
+				for _, record := range group {
+					logger.Traceln(strings.Join(record, "\t"))
+				}
+			}
+			if args.RequireFlags != 0 || args.ExcludeFlags != 0 {
+				group, err = FilterFlags(group, int(args.RequireFlags), int(args.ExcludeFlags))
+				if err != nil {
+					if err := skip_malformed(read, err); err != nil {
+						return err
+					}
+					continue
+				}
+				if len(group) == 0 {
+					total_reads++
+					flag_filtered++
+					decisions.Early(read, "rejected", "FLAG filters")
+					if logger.Enabled(LevelDebug) {
+						logger.Debugln("no alignments pass the FLAG filters, skipping")
+					}
+					continue
+				}
+			}
+			mate1, mate2, err := PickMates(group, sampleAligner)
 			if err != nil {
-				return fmt.Errorf("failed to read from sample BAM: %v after %d lines", err, total_reads)
+				if err := skip_malformed(read, err); err != nil {
+					return err
+				}
+				continue
 			}
+			total_reads++
+			total_read_mates++
 			if mate2 != nil {
-				scanner.Ratchet()
 				total_read_mates++
 			}
+			paired := IsPaired(mate1, mate2)
 
-			var mate1_len int
-			var mate1_edit_dist int
-			var mate2_len int
-			var mate2_edit_dist int
+			// Unmapped mates have no alignment to compare, so set them aside.
+			// Reads with no mapped mates at all are dealt with according to
+			// the -unmapped policy.
+			mate1, mate2, unmapped_mates := SplitUnmapped(mate1, mate2)
+			unmapped_mate_count += len(unmapped_mates)
+			if mate1 == nil {
+				unmapped++
+				if logger.Enabled(LevelDebug) {
+					logger.Debugln("unmapped, handling with -unmapped", args.Unmapped)
+				}
+				w := outfp
+				if args.Unmapped == "separate" {
+					w = unmappedfp
+				}
+				outcome := "kept"
+				switch args.Unmapped {
+				case "drop":
+					outcome = "rejected"
+				case "separate":
+					outcome = "separated"
+				}
+				decisions.Early(read, outcome, "unmapped")
+				if args.Unmapped != "drop" {
+					edit := keptFlags
+					if args.Unmapped == "separate" {
+						edit = FlagEdit{}
+					}
+					for _, mate := range unmapped_mates {
+						if _, _, err := WriteMate(w, mate, edit); err != nil {
+							return err
+						}
+					}
+				}
+				if args.Unmapped == "keep" {
+					if err := fastqOut.WriteMates(unmapped_mates...); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			var unmapped_mate *Mate
+			if len(unmapped_mates) > 0 {
+				unmapped_mate = unmapped_mates[0]
+			}
 
-			mate1_len, mate1_edit_dist, err = extract(mate1)
-			if err != nil {
-				return err
+			// PCR duplicates can be dropped, or made to follow the read they
+			// duplicate, rather than being compared in their own right.
+			is_duplicate := mate1.Flag&FlagDuplicate != 0 || (mate2 != nil && mate2.Flag&FlagDuplicate != 0)
+			var dup_key uint64
+			if is_duplicate {
+				duplicates++
 			}
-			if args.Verbose {
-				logger.Println("found read", read, "mate 1:")
-				logger.Println(strings.Join(mate1, "\t"))
+			if args.Duplicates == "exclude" && is_duplicate {
+				duplicates_excluded++
+				decisions.Early(read, "rejected", "duplicate")
+				if logger.Enabled(LevelDebug) {
+					logger.Debugln("duplicate, rejecting")
+				}
+				continue
 			}
-			if mate2 != nil {
-				mate2_len, mate2_edit_dist, err = extract(mate2)
+			if args.Duplicates == "inherit" {
+				dup_key, err = DuplicateKey(mate1, mate2)
 				if err != nil {
 					return err
 				}
-				if args.Verbose {
-					logger.Println("found read", read, "mate 2:")
-					logger.Println(strings.Join(mate2, "\t"))
+				if is_duplicate {
+					if logger.Enabled(LevelDebug) {
+						logger.Debugln("duplicate, setting aside until the end")
+					}
+					if mate2 == nil && unmapped_mate != nil && args.Unmapped == "keep" {
+						mate2 = unmapped_mate
+					}
+					if mate2 == nil {
+						if err := mate1.MakeSingleton(); err != nil {
+							return err
+						}
+					}
+					mates := []*Mate{mate1}
+					if mate2 != nil {
+						mates = append(mates, mate2)
+					}
+					if err := dupStore.Defer(dup_key, mate2 == nil && paired, mates...); err != nil {
+						return err
+					}
+					continue
+				}
+				if err := dupStore.Representative(dup_key); err != nil {
+					return err
 				}
 			}
 
-			// Filter for ERCC if either mate is mapped to ERCC.
-			if MatchesErcc(mate1, mate2) {
-				ercc++
-				if args.Verbose {
-					logger.Println("ERCC, rejecting")
+			// Filter for ERCC or other excluded contigs if either mate is mapped to one.
+			if MatchesExcluded(mate1, mate2) {
+				excluded++
+				decisions.Early(read, "rejected", "excluded contig")
+				if args.ExcludeCounts != "" {
+					CountExcluded(mate1, mate2)
+				}
+				if logger.Enabled(LevelDebug) {
+					logger.Debugln("excluded contig, rejecting")
 				}
 				continue
 			}
-
-			if mate1_len < args.MinLength {
-				// If we don't have mate2 or if it's also too short, we mark this pair as too short.
-				if mate2 == nil || mate2_len < args.MinLength {
-					if args.Verbose {
-						logger.Println("too short, rejecting")
+			// Decoy contigs soak up reads from sequence missing from the
+			// assembly, which may well be contamination too.
+			is_decoy := MatchesDecoy(mate1, mate2)
+			if is_decoy {
+				decoys++
+				if args.DecoyAction == "exclude" {
+					decisions.Early(read, "rejected", "decoy")
+					if logger.Enabled(LevelDebug) {
+						logger.Debugln("decoy contig, rejecting")
 					}
-					too_short++
 					continue
 				}
-				if args.Verbose {
-					logger.Println("promoting mate 2")
-				}
-				// Mate2 is okay, so we promote it to mate1, and forget mate2
-				mate1_len = mate2_len
-				mate1_edit_dist = mate2_edit_dist
-				mate1 = mate2
-				mate2 = nil
 			}
-			if mate2 != nil && mate2_len < args.MinLength {
-				// We have a mate2, but it doesn't meet the min length criteria, just forget it.
-				mate2 = nil
-				if args.Verbose {
-					logger.Println("mate 2 too short, forgetting")
+			keep_decoy := is_decoy && args.DecoyAction == "keep"
+			if intervals != nil {
+				covered, err := intervals.Covers(mate1, mate2)
+				if err != nil {
+					return fmt.Errorf("read %s: %v", read, err)
 				}
-			}
-			// We treate the filter for edit distance the same way as length.
-			if mate1_edit_dist > args.MaxDist {
-				if mate2 == nil || mate2_edit_dist > args.MaxDist {
-					too_diverged++
-					if args.Verbose {
-						logger.Println("too divergent, rejecting")
+				if covered {
+					in_intervals++
+					if args.IntervalsAction == "remove" {
+						decisions.Early(read, "rejected", "in intervals")
+						if logger.Enabled(LevelDebug) {
+							logger.Debugln("in -intervals, rejecting")
+						}
+						continue
 					}
-					continue
 				}
-				if args.Verbose {
-					logger.Println("promothing mate 2")
-				}
-				// Mate2 is okay, so we promote it to mate1, and forget mate2
-				mate1_len = mate2_len
-				mate1_edit_dist = mate2_edit_dist
-				mate1 = mate2
-				mate2 = nil
 			}
-			if mate2 != nil && mate2_edit_dist > args.MaxDist {
-				// We have a mate2, but it doesn't meet the max edit distance criteria, just forget it.
-				mate2 = nil
-				if args.Verbose {
-					logger.Println("mate 2, too diverged, forgetting")
-				}
+
+			var reason string
+			mate1, mate2, reason = DropWeakMates(mate1, mate2)
+			if reason != "" {
+				decisions.Early(read, "rejected", reason)
+			}
+			switch reason {
+			case "too short":
+				too_short++
+				continue
+			case "too diverged":
+				too_diverged++
+				continue
+			case "too little mapped":
+				too_little_mapped++
+				continue
+			case "too many Ns":
+				too_many_ns++
+				continue
+			case "low complexity":
+				low_complexity++
+				continue
 			}
 
 			// If we get this far it means the read met the preliminary filtering criteria.
 			considered++
 
 			// Compare agains the best score for the read pair.
-			mate1_score := float64(mate1_len) - float64(mate1_edit_dist)*args.Penalty
+			mate1_score := mate1.Score(args.Penalty)
 			var mate2_score float64
 			best_score := mate1_score
-			best_len := mate1_len
-			best_edit_dist := mate1_edit_dist
+			best_len := mate1.Len
+			best_edit_dist := mate1.EditDist
 
 			if mate2 != nil {
-				mate2_score = float64(mate2_len) - float64(mate2_edit_dist)*args.Penalty
+				mate2_score = mate2.Score(args.Penalty)
 				if mate2_score > mate1_score {
 					best_score = mate2_score
-					best_len = mate2_len
-					best_edit_dist = mate2_edit_dist
-					if args.Verbose {
-						logger.Printf("mate 2 has better score (%f) than mate 1 (%f)\n", mate2_score, mate1_score)
+					best_len = mate2.Len
+					best_edit_dist = mate2.EditDist
+					if logger.Enabled(LevelDebug) {
+						logger.Debugf("mate 2 has better score (%f) than mate 1 (%f)\n", mate2_score, mate1_score)
 					}
 				}
 			}
 
+			// With -pair-score a read with both mates is scored as a pair rather
+			// than by its best mate.
+			pair_scoring := args.PairScore != "best" && mate2 != nil
+			if pair_scoring {
+				best_score = PairScore(mate1_score, mate2_score)
+				if logger.Enabled(LevelDebug) {
+					logger.Debugf("pair has combined score %f\n", best_score)
+				}
+			}
+
 			// Reads in the sample BAM will be rejected if either mate in any of the
 			// contamination BAM files maps better than in the sampel BAM file.
 			was_rejected := false
-			for c := 0; c < len(contamination); c++ {
-				m := 0
-				for {
-					mate, err := contScanners[c].Find(read)
+			// Rejected by alignments outside any -blacklist regions.
+			clean_rejected := false
+			rejected_by := []int{}
+			sweep.Begin()
+			// Keep track of the best contaminant score for annotating the output.
+			best_cont_score := 0.0
+			best_cont := ""
+			// And how near the read came to being rejected.
+			slack := math.Inf(1)
+			score_diff := math.Inf(1)
+			for c, cont := range contamination {
+				// The scanners skip past the reads they aren't asked for, so
+				// they stay in step.
+				// A read near the margin may yet turn out ambiguous, unless
+				// another contaminant rejects it outright.
+				if args.ShortCircuit && was_rejected && rejectedOutright(slack) {
+					reads_short_circuited[c]++
+					continue
+				}
+				if keep_decoy {
+					continue
+				}
+				var records [][]string
+				if filters != nil && filters[c] != nil && !filters[c].Contains(read) {
+					reads_prefiltered[c]++
+				} else {
+					records, err = sources[c].Lookup(read)
 					if err != nil {
 						logger.Fatal(err)
 					}
-					if mate == nil {
-						// No more alignments for this read in this contamination mapping
-						break
+					if args.SkipMalformed {
+						var dropped int
+						var bad error
+						records, dropped, bad = DropMalformed(records, cont.Aligner)
+						malformed_alignments += dropped
+						if bad != nil && first_malformed == "" {
+							first_malformed = fmt.Sprintf("%s: %v", cont.Filename, bad)
+						}
+						if args.MaxErrors.Exceeded(malformed+malformed_alignments, total_reads, false) {
+							return too_many_malformed()
+						}
+					}
+				}
+				result, err := Compare(read, mate1, mate2, pair_scoring, cont, records)
+				if err != nil {
+					logger.Fatalf("failed to read from %s: %v", cont.Filename, err)
+				}
+				if err := sweep.Add(read, mate1, mate2, pair_scoring, cont, records); err != nil {
+					logger.Fatalf("failed to read from %s: %v", cont.Filename, err)
+				}
+				if result.Found {
+					reads_found[c]++
+				}
+				if result.Usable && (best_cont == "" || result.Score > best_cont_score) {
+					best_cont_score = result.Score
+					best_cont = cont.Filename
+				}
+				if result.Rejected {
+					reads_filtered[c]++
+					rejected_by = append(rejected_by, c)
+					was_rejected = true
+					if !result.Blacklisted {
+						clean_rejected = true
 					}
-					m++
-					if args.Verbose {
-						logger.Printf("found mapping %d for %s in %s\n", m, mate[0], contamination[c])
-						logger.Println(strings.Join(mate, "\t"))
+				}
+				if result.Blacklisted {
+					reads_blacklisted[c]++
+				}
+				slack = math.Min(slack, result.Slack())
+				if result.Usable {
+					score_diff = math.Min(score_diff, result.Advantage())
+				}
+			}
+			if args.Estimate && !math.IsInf(score_diff, 1) {
+				score_diffs = append(score_diffs, score_diff)
+			}
+			// Too close to the margin to call either way.
+			ambiguous := !keep_decoy && Ambiguous(slack)
+			if ambiguous {
+				if was_rejected {
+					for _, c := range rejected_by {
+						reads_filtered[c]--
 					}
-					if !found[c] {
-						found[c] = true
-						reads_found[c]++
+				}
+				was_rejected = false
+				reads_ambiguous++
+			}
+			kraken.Add(read, was_rejected, ambiguous)
+			unconfirmed := false
+			if was_rejected && args.KrakenRequire && !kraken.Contaminated(read) {
+				for _, c := range rejected_by {
+					reads_filtered[c]--
+				}
+				was_rejected = false
+				unconfirmed = true
+				kraken.Concordance.Unconfirmed++
+			}
+			if was_rejected {
+				reads_rejected++
+			}
+			sweep.End()
+			evaluation.Add(read, slack, ambiguous)
+			histogram.Add(score_diff, was_rejected, ambiguous)
+			if !ambiguous {
+				contigCounts.Add(mate1.Record[2], was_rejected)
+				if err := annotation.Add(mate1.Record, was_rejected); err != nil {
+					return fmt.Errorf("read %s: %v", read, err)
+				}
+			}
+			switch {
+			case ambiguous:
+				decisions.Scored(read, best_score, best_cont, best_cont_score, "ambiguous", ambiguousReason(slack))
+			case keep_decoy:
+				decisions.Scored(read, best_score, best_cont, best_cont_score, "kept", "decoy")
+			case unconfirmed:
+				decisions.Scored(read, best_score, best_cont, best_cont_score, "kept", "not confirmed by kraken2")
+			case was_rejected && !clean_rejected:
+				decisions.Scored(read, best_score, best_cont, best_cont_score, "rejected", "blacklisted region")
+			case was_rejected:
+				decisions.Scored(read, best_score, best_cont, best_cont_score, "rejected", "contamination")
+			case best_cont != "":
+				decisions.Scored(read, best_score, best_cont, best_cont_score, "kept", "better in sample")
+				near_misses.Add(read, best_score, best_cont, best_cont_score)
+			default:
+				decisions.Scored(read, best_score, best_cont, best_cont_score, "kept", "not in contamination")
+			}
+			if ambiguous {
+				if ambiguousfp != nil {
+					if mate2 == nil && unmapped_mate != nil && args.Unmapped == "keep" {
+						mate2 = unmapped_mate
 					}
-					length, edit_dist, err := extract(mate)
-					if err != nil {
-						logger.Fatalf("failed to read from %s: %v", contamination[c], err)
+					if mate2 == nil && paired {
+						if err := mate1.MakeSingleton(); err != nil {
+							return err
+						}
 					}
-					if length >= args.MinLength {
-						score := float64(length) - float64(edit_dist)*args.Penalty
-						if args.Verbose {
-							logger.Printf("mapping meets length criteria and has score %f\n", score)
+					for _, mate := range []*Mate{mate1, mate2} {
+						if mate == nil {
+							continue
 						}
-						if best_score <= score+args.Margin {
-							if args.Verbose {
-								logger.Println("mapping has better score")
-							}
-							if !rejected[c] {
-								reads_filtered[c]++
-								rejected[c] = true
-								was_rejected = true
-								if args.Verbose {
-									logger.Printf("read %s with length %d and edit distance %d was rejected "+
-										"with score %0.1f because in %s it had a score of %0.1f with length "+
-										"%d and edit distance %d\n",
-										read, best_len, best_edit_dist, best_score, contamination[c],
-										score, length, edit_dist)
-								}
-							}
-						} else {
-							if args.Verbose {
-								logger.Println("mapping has worse score")
-							}
+						if _, _, err := WriteMate(ambiguousfp, mate, ambiguousFlags); err != nil {
+							return err
 						}
 					}
 				}
+				continue
+			}
+			if mismatches != nil {
+				if err := mismatches.Add(was_rejected, mate1, mate2); err != nil {
+					return err
+				}
 			}
 			if !was_rejected {
 				// This read is okay, output it to the output BAM file.
-				_, err := fmt.Fprintf(outfp, "%s\n", strings.Join(mate1, "\t"))
+				if args.Annotate {
+					tags := []string{fmt.Sprintf("ZS:f:%g", best_score)}
+					if best_cont != "" {
+						tags = append(tags, fmt.Sprintf("ZC:f:%g", best_cont_score), "ZN:Z:"+best_cont)
+					}
+					mate1.AddTags(tags)
+					if mate2 != nil {
+						mate2.AddTags(tags)
+					}
+				}
+				w := outfp
+				if mate2 == nil && unmapped_mate != nil && args.Unmapped == "keep" {
+					// Write the unmapped mate alongside, leaving the pair intact.
+					mate2 = unmapped_mate
+					unmapped_mate = nil
+				}
+				if mate2 == nil {
+					// The other mate may have been dropped, so don't leave the
+					// one we write pointing at it.
+					if err := mate1.MakeSingleton(); err != nil {
+						return err
+					}
+					if paired {
+						singletons_kept++
+						if singletonsfp != nil {
+							w = singletonsfp
+						}
+					}
+				}
+				secondary, supplementary, err := WriteMate(w, mate1, keptFlags)
 				if err != nil {
 					return err
 				}
 				reads_kept++
+				if is_duplicate {
+					duplicates_kept++
+				}
+				if dupStore != nil {
+					if err := dupStore.RepresentativeKept(dup_key); err != nil {
+						return err
+					}
+				}
 				read_mates_kept++
+				secondary_kept += secondary
+				supplementary_kept += supplementary
 				if mate2 != nil {
-					_, err := fmt.Fprintf(outfp, "%s\n", strings.Join(mate2, "\t"))
+					secondary, supplementary, err := WriteMate(w, mate2, keptFlags)
 					if err != nil {
 						return err
 					}
 					read_mates_kept++
+					secondary_kept += secondary
+					supplementary_kept += supplementary
+				}
+				if err := fastqOut.WriteMates(mate1, mate2); err != nil {
+					return err
+				}
+				if unmapped_mate != nil && args.Unmapped == "separate" {
+					if err := unmapped_mate.MakeSingleton(); err != nil {
+						return err
+					}
+					if _, _, err := WriteMate(unmappedfp, unmapped_mate, FlagEdit{}); err != nil {
+						return err
+					}
 				}
-				if args.Verbose {
-					logger.Printf("kept read %s with length %d and edit distance %d and score %0.1f\n",
+				if logger.Enabled(LevelDebug) {
+					logger.Debugf("kept read %s with length %d and edit distance %d and score %0.1f\n",
 						read, best_len, best_edit_dist, best_score)
 				}
 			}
@@ -386,58 +1749,419 @@ func main() {
 	if err != nil {
 		logger.Fatal(err)
 	}
+	if args.Subsample < 1 {
+		logger.Printf("processed %d reads sampled at random, leaving out %d (-subsample %g, -seed %d)\n",
+			total_reads, not_sampled, args.Subsample, args.Seed)
+	}
+	if timed_out {
+		checkpoint := &Checkpoint{Sample: sampleName(), StoppedAfter: last_read, Output: args.Output}
+		filename := checkpointFilename()
+		if err := checkpoint.Write(filename); err != nil {
+			logger.Fatal(err)
+		}
+		logger.Warnf("stopped at -max-time %s after read %s, %d reads in; resume with -resume %s\n",
+			args.MaxTime, last_read, total_reads, filename)
+	}
+	// The rest of each contamination BAM is only read to verify it.
+	if checksums != nil && !timed_out {
+		for _, source := range sources {
+			if bam, ok := source.(*BamScanner); ok {
+				if err := bam.Drain(); err != nil {
+					logger.Fatal(err)
+				}
+			}
+		}
+	}
+	if args.MaxErrors.Exceeded(malformed+malformed_alignments, total_reads, true) {
+		logger.Fatal(too_many_malformed())
+	}
+	if scanner.Reordered > 0 {
+		logger.Warnf("%s was out of name order in %d places, put right with -sort-window\n", args.Sample, scanner.Reordered)
+	}
+	for c, source := range sources {
+		if bam, ok := source.(*BamScanner); ok && bam.Reordered > 0 {
+			logger.Warnf("%s was out of name order in %d places, put right with -sort-window\n", contamination[c].Filename, bam.Reordered)
+		}
+	}
+	// The reads compared against the contamination, leaving out duplicates
+	// decided by the reads they duplicate.
+	compared, compared_rejected := considered, reads_rejected
+	if dupStore != nil {
+		if err := dupStore.Resolve(outfp, singletonsfp, fastqOut, decisions); err != nil {
+			logger.Fatal(err)
+		}
+		// Their outcomes count in the run's totals like any other read's, so
+		// the totals match the output.
+		considered += dupStore.Deferred
+		reads_kept += dupStore.Kept + dupStore.Unresolved
+		reads_rejected += dupStore.Dropped
+		read_mates_kept += dupStore.KeptMates
+		secondary_kept += dupStore.KeptSecondary
+		supplementary_kept += dupStore.KeptSupplementary
+		singletons_kept += dupStore.KeptSingletons
+	}
+	progress.Done(total_reads, considered, reads_kept, reads_filtered)
+	metrics.Update(total_reads, considered, reads_kept, reads_found, reads_filtered)
+	if decisions != nil {
+		if err := decisions.Close(); err != nil {
+			logger.Fatal(err)
+		}
+	}
+	if err := near_misses.Close(); err != nil {
+		logger.Fatal(err)
+	}
 
-	outfp.Close()
+	if err := outfp.Close(); err != nil {
+		logger.Fatal(err)
+	}
 	out.Wait()
+	writers := []*BamWriter{&out}
+	if singletonsfp != nil {
+		if err := singletonsfp.Close(); err != nil {
+			logger.Fatal(err)
+		}
+		singletons.Wait()
+		writers = append(writers, &singletons)
+	}
+	if fastqOut != nil {
+		if err := fastqOut.Close(); err != nil {
+			logger.Fatal(err)
+		}
+	}
+	if ambiguousfp != nil {
+		if err := ambiguousfp.Close(); err != nil {
+			logger.Fatal(err)
+		}
+		ambiguousOut.Wait()
+		writers = append(writers, &ambiguousOut)
+	}
+	if unmappedfp != nil {
+		if err := unmappedfp.Close(); err != nil {
+			logger.Fatal(err)
+		}
+		unmappedOut.Wait()
+		writers = append(writers, &unmappedOut)
+	}
+	for _, w := range writers {
+		if err := w.Finish(); err != nil {
+			logger.Fatal(err)
+		}
+	}
+	if args.IndexOutput {
+		for _, w := range writers {
+			if err := w.Index(); err != nil {
+				logger.Fatal(err)
+			}
+		}
+	}
 
 	logger.Println("Preliminary filtering:")
-	if args.Ercc {
-		erccPerc := float64(ercc) / float64(total_reads) * 100
-		logger.Printf("filtered out %d ERCC reads (%0.1f%%) before comparing to contamination\n", ercc, erccPerc)
+	if args.RequireFlags != 0 || args.ExcludeFlags != 0 {
+		flagPerc := float64(flag_filtered) / float64(total_reads) * 100
+		logger.Printf("skipped %d reads (%0.1f%%) with no alignments passing the FLAG filters\n", flag_filtered, flagPerc)
+	}
+	unmappedPerc := float64(unmapped) / float64(total_reads) * 100
+	switch args.Unmapped {
+	case "drop":
+		logger.Printf("dropped %d unmapped reads (%0.1f%%)\n", unmapped, unmappedPerc)
+	case "keep":
+		logger.Printf("passed through %d unmapped reads (%0.1f%%)\n", unmapped, unmappedPerc)
+	case "separate":
+		logger.Printf("wrote %d unmapped reads (%0.1f%%) to %s\n", unmapped, unmappedPerc, args.UnmappedOutput)
+	}
+	logger.Printf("found %d unmapped read mates in all\n", unmapped_mate_count)
+	if decoys > 0 {
+		what := map[string]string{"compare": "compared", "exclude": "filtered out", "keep": "kept without comparing"}[args.DecoyAction]
+		logger.Printf("%s %d reads aligned to decoy contigs (%0.1f%%)\n", what, decoys,
+			float64(decoys)/float64(total_reads)*100)
+	}
+	if intervals != nil {
+		what := "filtered out"
+		if args.IntervalsAction == "count" {
+			what = "counted"
+		}
+		logger.Printf("%s %d reads aligned within %s (%0.1f%%)\n", what, in_intervals, args.Intervals,
+			float64(in_intervals)/float64(total_reads)*100)
+	}
+	if excludedContigs != nil {
+		excludedPerc := float64(excluded) / float64(total_reads) * 100
+		logger.Printf("filtered out %d reads mapped to excluded contigs (%0.1f%%) before comparing to contamination\n",
+			excluded, excludedPerc)
+		if args.ExcludeCounts != "" {
+			if err := WriteExcludedCounts(args.ExcludeCounts); err != nil {
+				logger.Fatal(err)
+			}
+			logger.Printf("wrote counts for %d excluded contigs to %s\n", len(excludedCounts), args.ExcludeCounts)
+		}
 	}
 
 	shortPerc := float64(too_short) / float64(total_reads) * 100
 	logger.Printf("filtered out %d reads (%0.1f%%) becase their alignment was too short\n", too_short, shortPerc)
 	divergedPerc := float64(too_diverged) / float64(total_reads) * 100
 	logger.Printf("filtered out %d reads (%0.1f%%) becase they were too diverged\n", too_diverged, divergedPerc)
+	if args.MinMappedFrac > 0 {
+		mappedPerc := float64(too_little_mapped) / float64(total_reads) * 100
+		logger.Printf("filtered out %d reads (%0.1f%%) with less than %g of their read aligned\n", too_little_mapped, mappedPerc, args.MinMappedFrac)
+	}
+	if args.MaxNFrac < 1 {
+		nsPerc := float64(too_many_ns) / float64(total_reads) * 100
+		logger.Printf("filtered out %d reads (%0.1f%%) with more than %g of their bases N\n", too_many_ns, nsPerc, args.MaxNFrac)
+	}
+	if args.Dust > 0 {
+		dustPerc := float64(low_complexity) / float64(total_reads) * 100
+		logger.Printf("filtered out %d reads (%0.1f%%) of low complexity, with DUST scores above %g\n", low_complexity, dustPerc, args.Dust)
+	}
+	if args.SkipMalformed {
+		logger.Printf("skipped %d malformed reads (%0.1f%%) and %d malformed contamination records\n",
+			malformed, float64(malformed)/float64(total_reads)*100, malformed_alignments)
+	}
+
+	dupPerc := float64(duplicates) / float64(total_reads) * 100
+	switch args.Duplicates {
+	case "compare":
+		logger.Printf("found %d duplicate reads (%0.1f%%), of which %d were kept\n", duplicates, dupPerc, duplicates_kept)
+	case "exclude":
+		logger.Printf("filtered out %d duplicate reads (%0.1f%%)\n", duplicates_excluded, dupPerc)
+	case "inherit":
+		logger.Printf("set aside %d duplicate reads (%0.1f%%): kept %d along with the read they duplicate, "+
+			"dropped %d, and kept %d whose original read wasn't seen\n",
+			dupStore.Deferred, dupPerc, dupStore.Kept, dupStore.Dropped, dupStore.Unresolved)
+		if dupStore.Spills > 0 {
+			logger.Printf("spilled the decisions for duplicates to disk %d times to keep to -max-memory\n", dupStore.Spills)
+		}
+	}
 
 	logger.Printf("%d reads remaining after preliminary filtering\n", considered)
 	logger.Println("Contamination filtering:")
+	if KeepComparison() == "at-least" {
+		logger.Println("kept reads scoring at least the best contaminant score plus the margin")
+	} else {
+		logger.Println("kept reads scoring greater than the best contaminant score plus the margin")
+	}
+	if compared > 0 {
+		logger.Printf("kept %d reads found in the contamination that scored better in the sample by more than the margin (%0.1f%%)\n",
+			near_misses.Count, float64(near_misses.Count)/float64(compared)*100)
+	}
+	if args.NearMisses != "" {
+		logger.Printf("wrote those reads and their scores to %s\n", args.NearMisses)
+	}
 	for c, cont := range contamination {
 		n := reads_filtered[c]
-		perc := float64(n) / float64(considered) * 100
-		found_perc := float64(reads_found[c]) / float64(considered) * 100
-		logger.Printf("found %d of %d reads in %s (%0.1f%%)\n", reads_found[c], considered, cont, found_perc)
-		logger.Printf("rejected %d of %d reads from %s (%0.1f%%)\n", reads_filtered[c], considered, cont, perc)
+		perc := float64(n) / float64(compared) * 100
+		found_perc := float64(reads_found[c]) / float64(compared) * 100
+		logger.Printf("found %d of %d reads in %s (%0.1f%%)\n", reads_found[c], compared, cont.Name(), found_perc)
+		if reads_found[c] == 0 && compared > 0 && !args.NormalizeNames {
+			logger.Warnf("none of the reads were found in %s: if its read names differ from the sample's by a /1 or /2 suffix or a comment, try -normalize-names\n", cont.Name())
+		} else if reads_found[c] == 0 && compared > 0 {
+			logger.Warnf("none of the reads were found in %s, even with -normalize-names: check it was aligned from the same reads as the sample\n", cont.Name())
+		}
+		logger.Printf("rejected %d of %d reads from %s (%0.1f%%)\n", reads_filtered[c], compared, cont.Name(), perc)
+		if filters != nil {
+			logger.Printf("skipped scanning %s for %d reads not in its prefilter\n", cont.Filename, reads_prefiltered[c])
+		}
+		if cont.Blacklist != nil && args.BlacklistAction == "ignore" {
+			logger.Printf("kept %d reads only alignments in blacklisted regions of %s would have rejected\n", reads_blacklisted[c], cont.Name())
+		} else if cont.Blacklist != nil {
+			logger.Printf("rejected %d reads only by alignments in blacklisted regions of %s\n", reads_blacklisted[c], cont.Name())
+		}
+		if args.ShortCircuit {
+			logger.Printf("skipped comparing %d reads already rejected against %s\n", reads_short_circuited[c], cont.Name())
+		}
 	}
 
 	kept_percent = float64(reads_kept) / float64(considered) * 100
 	total_percent := float64(reads_kept) / float64(total_reads) * 100
 	logger.Printf("kept %d of %d reads (%0.1f%%), which is %0.1f%% of the %d reads that met preliminary filtering\n",
 		reads_kept, total_reads, total_percent, kept_percent, considered)
+	if args.AmbiguousWindow > 0 || args.Ties == "ambiguous" {
+		ambiguous_percent := float64(reads_ambiguous) / float64(considered) * 100
+		called := fmt.Sprintf("within %g of the margin", args.AmbiguousWindow)
+		if args.AmbiguousWindow == 0 {
+			called = "tying with the margin"
+		}
+		if args.AmbiguousOutput != "" {
+			logger.Printf("wrote %d ambiguous reads (%0.1f%%) %s to %s\n",
+				reads_ambiguous, ambiguous_percent, called, args.AmbiguousOutput)
+		} else {
+			logger.Printf("left out %d ambiguous reads (%0.1f%%) %s\n", reads_ambiguous, ambiguous_percent, called)
+		}
+	}
 	total_mates_percent := float64(read_mates_kept) / float64(total_read_mates) * 100
 	logger.Printf("kept %d of %d read mates (%0.1f%%)", read_mates_kept, total_read_mates, total_mates_percent)
+	if !args.DropSecondary && !args.PrimaryOnly {
+		logger.Printf("kept %d secondary alignments of kept read mates\n", secondary_kept)
+	}
+	if !args.PrimaryOnly {
+		logger.Printf("kept %d supplementary alignments of kept read mates\n", supplementary_kept)
+	}
+	if args.Singletons != "" {
+		logger.Printf("wrote %d reads that lost their mate to %s\n", singletons_kept, args.Singletons)
+	} else {
+		logger.Printf("kept %d reads that lost their mate\n", singletons_kept)
+	}
+	if fastqOut != nil && args.FastqInterleaved {
+		logger.Printf("wrote %d read pairs and %d reads with one mate interleaved to %s\n",
+			fastqOut.Pairs, fastqOut.Singletons, args.FastqOut)
+	} else if fastqOut != nil {
+		logger.Printf("wrote %d read pairs to %s and %s, and %d reads with one mate to %s\n",
+			fastqOut.Pairs, fastqOut.Filenames[0], fastqOut.Filenames[1], fastqOut.Singletons, fastqOut.Filenames[2])
+	}
 	input_mates_per_pair := float64(total_read_mates) / float64(total_reads)
 	output_mates_per_pair := float64(read_mates_kept) / float64(reads_kept)
 	logger.Printf("observed %0.1f mates/read on the input end and %0.1f mates/read on the output end\n",
 		input_mates_per_pair, output_mates_per_pair)
 
+	if mismatches != nil {
+		if err := mismatches.Write(args.MismatchProfile); err != nil {
+			logger.Fatal(err)
+		}
+		logger.Printf("wrote mismatch profile of %d kept and %d rejected read mates to %s\n",
+			mismatches.Kept.Mates, mismatches.Rejected.Mates, args.MismatchProfile)
+	}
+
+	if contigCounts != nil {
+		if err := contigCounts.Write(args.ContigCounts); err != nil {
+			logger.Fatal(err)
+		}
+		logger.Printf("wrote kept and rejected counts by contig to %s\n", args.ContigCounts)
+	}
+
+	if annotation != nil {
+		if err := annotation.Write(args.GeneCounts); err != nil {
+			logger.Fatal(err)
+		}
+		logger.Printf("wrote kept and rejected counts by gene to %s\n", args.GeneCounts)
+	}
+
+	if histogram != nil {
+		if err := histogram.Write(args.ScoreHistogram); err != nil {
+			logger.Fatal(err)
+		}
+		logger.Printf("wrote score differences to %s: %d reads within %g of the margin, %d not found in the contamination\n",
+			args.ScoreHistogram, histogram.Borderline(args.Margin), args.HistogramBin, histogram.NotFound)
+	}
+
+	if args.Estimate {
+		estimate, err := EstimateContamination(score_diffs, compared, args.Margin)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		logger.Printf("estimated %0.2f%% of the %d reads compared are contaminated (95%% CI %0.2f%% to %0.2f%%), "+
+			"against %0.2f%% rejected\n", estimate.Fraction*100, compared, estimate.Low*100, estimate.High*100,
+			float64(compared_rejected)/float64(compared)*100)
+		if reads_ambiguous > 0 {
+			logger.Printf("and %0.2f%% called ambiguous\n", float64(reads_ambiguous)/float64(compared)*100)
+		}
+		if !estimate.Converged {
+			logger.Warnf("the contamination estimate didn't converge after %d iterations\n", estimate.Iterations)
+		}
+		logger.Printf("score difference of contaminated reads %0.1f (sd %0.1f), of clean reads %0.1f (sd %0.1f)\n",
+			estimate.Means[0], estimate.Sds[0], estimate.Means[1], estimate.Sds[1])
+	}
+
+	if kraken != nil {
+		kraken.Log()
+	}
+	if evaluation != nil {
+		evaluation.Log()
+		if args.TruthROC != "" {
+			if err := evaluation.WriteROC(args.TruthROC); err != nil {
+				logger.Fatal(err)
+			}
+			logger.Printf("wrote precision and recall by margin to %s\n", args.TruthROC)
+		}
+	}
+
+	if sweep != nil {
+		if err := sweep.Write(args.Sweep); err != nil {
+			logger.Fatal(err)
+		}
+		logger.Printf("wrote kept and rejected counts for %d margin and edit penalty combinations to %s\n",
+			len(sweep.Rejected), args.Sweep)
+	}
+
+	stats := &RunStats{
+		Version:             StatsVersion,
+		Contfilter:          Version,
+		Sample:              sampleName(),
+		TotalReads:          total_reads,
+		TotalMates:          total_read_mates,
+		FlagFiltered:        flag_filtered,
+		Unmapped:            unmapped,
+		UnmappedMates:       unmapped_mate_count,
+		Duplicates:          duplicates,
+		Excluded:            excluded,
+		InIntervals:         in_intervals,
+		Decoys:              decoys,
+		TooShort:            too_short,
+		TooDiverged:         too_diverged,
+		TooLittleMapped:     too_little_mapped,
+		TooManyNs:           too_many_ns,
+		LowComplexity:       low_complexity,
+		Malformed:           malformed,
+		MalformedAlignments: malformed_alignments,
+		Considered:          considered,
+		Kept:                reads_kept,
+		Rejected:            reads_rejected,
+		Ambiguous:           reads_ambiguous,
+		KeepIf:              KeepComparison(),
+		NearMisses:          near_misses.Count,
+		KeptMates:           read_mates_kept,
+		Secondary:           secondary_kept,
+		Supplementary:       supplementary_kept,
+		Singletons:          singletons_kept,
+		SampleChecksum:      scanner.Checksum,
+		Resources:           ReadResources(),
+		ResumedAfter:        resume_after,
+		NotSampled:          not_sampled,
+	}
+	if timed_out {
+		stats.Partial = true
+		stats.StoppedAfter = last_read
+	}
+	if kraken != nil {
+		stats.Kraken = &kraken.Concordance
+	}
+	for c, cont := range contamination {
+		stats.Contaminants = append(stats.Contaminants, ContaminantStats{
+			Filename:    cont.Filename,
+			Label:       cont.Label,
+			Found:       reads_found[c],
+			Rejected:    reads_filtered[c],
+			Prefiltered: reads_prefiltered[c],
+			Skipped:     reads_short_circuited[c],
+			Blacklisted: reads_blacklisted[c],
+		})
+		if bam, ok := sources[c].(*BamScanner); ok {
+			stats.Contaminants[c].Checksum = bam.Checksum
+		}
+	}
+	stats.Resources.Log()
 	logger.Println("machine parsable stats:")
-	stats := []int{
-		total_reads,
-		total_read_mates,
-		ercc,
-		too_short,
-		too_diverged,
-		considered,
-		reads_kept,
-		read_mates_kept,
-	}
-	stats = append(stats, reads_found...)
-	stats = append(stats, reads_filtered...)
-	statsStr := "stats"
-	for _, s := range stats {
-		statsStr += fmt.Sprintf("\t%d", s)
-	}
-	logger.Println(statsStr)
+	logger.Println("stats\t" + stats.String())
+	if args.Stats != "" {
+		if err := stats.Write(args.Stats); err != nil {
+			logger.Fatal(err)
+		}
+	}
+
+	if resultsDB != nil {
+		if err := resultsDB.Finish(stats); err != nil {
+			logger.Fatal(err)
+		}
+		logger.Printf("recorded run %s in %s\n", resultsDB.RunID, args.ResultsDB)
+	}
+	failures := stats.Failures(args.FailRejectedAbove, args.FailKeptBelow)
+	for _, failure := range failures {
+		logger.Errorf("failed: %s\n", failure)
+	}
+	if err := logger.Close(); err != nil {
+		log.Fatal(err)
+	}
+	if len(failures) > 0 {
+		os.Exit(3)
+	}
+	if timed_out {
+		os.Exit(4)
+	}
 }
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// How many of the compared reads aligned to each sample contig were kept and
+// rejected, for -contig-counts. Reads go by the contig of their first mate.
+type ContigCounts struct {
+	header []string // contigs in @SQ order
+	kept   map[string]int
+	reject map[string]int
+}
+
+func NewContigCounts(header string) *ContigCounts {
+	c := &ContigCounts{kept: make(map[string]int), reject: make(map[string]int)}
+	for _, line := range strings.Split(header, "\n") {
+		if !strings.HasPrefix(line, "@SQ\t") {
+			continue
+		}
+		for _, field := range strings.Split(line, "\t")[1:] {
+			if strings.HasPrefix(field, "SN:") {
+				c.header = append(c.header, field[3:])
+			}
+		}
+	}
+	return c
+}
+
+// Count a read. This does nothing without -contig-counts.
+func (c *ContigCounts) Add(contig string, rejected bool) {
+	if c == nil {
+		return
+	}
+	if rejected {
+		c.reject[contig]++
+	} else {
+		c.kept[contig]++
+	}
+}
+
+// Write the counts in header order, leaving out contigs with no reads, and
+// then any contigs missing from the header.
+func (c *ContigCounts) Write(filename string) error {
+	fp, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	contigs := []string{}
+	for _, contig := range c.header {
+		seen[contig] = true
+		contigs = append(contigs, contig)
+	}
+	others := []string{}
+	for _, counts := range []map[string]int{c.kept, c.reject} {
+		for contig := range counts {
+			if !seen[contig] {
+				seen[contig] = true
+				others = append(others, contig)
+			}
+		}
+	}
+	sort.Strings(others)
+	contigs = append(contigs, others...)
+
+	w := bufio.NewWriter(fp)
+	fmt.Fprintln(w, "contig\treads\tkept\trejected\trejected_percent")
+	for _, contig := range contigs {
+		kept, rejected := c.kept[contig], c.reject[contig]
+		if kept+rejected == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%0.2f\n", contig, kept+rejected, kept, rejected,
+			float64(rejected)/float64(kept+rejected)*100)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return fp.Close()
+}
+
+// Contig names to use in place of others, from -contig-map, or nil.
+var contigMap map[string]string
+
+// Read a map of contig names, a line for each of the name to replace and the
+// one to replace it with, such as "1 chr1" or "MT chrM".
+func ReadContigMap(filename string) (map[string]string, error) {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	names := make(map[string]string)
+	scanner := bufio.NewScanner(fp)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s line %d: expected a contig name and the name to use instead", filename, line)
+		}
+		if to, ok := names[fields[0]]; ok && to != fields[1] {
+			return nil, fmt.Errorf("%s line %d: %s is already renamed to %s", filename, line, fields[0], to)
+		}
+		names[fields[0]] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// Rename the RNAME and RNEXT of a record by -contig-map.
+func renameContigs(record []string) {
+	for _, i := range []int{2, 6} {
+		if to, ok := contigMap[record[i]]; ok {
+			record[i] = to
+		}
+	}
+}
+
+// Rename the contig of an @SQ header line by -contig-map.
+func renameSequence(line string) string {
+	fields := strings.Split(line, "\t")
+	for i, field := range fields {
+		if strings.HasPrefix(field, "SN:") {
+			if to, ok := contigMap[field[3:]]; ok {
+				fields[i] = "SN:" + to
+				return strings.Join(fields, "\t")
+			}
+		}
+	}
+	return line
+}
+
+// Rename the contigs of a header's @SQ lines by -contig-map.
+func RenameSequences(header string) string {
+	if contigMap == nil {
+		return header
+	}
+	lines := strings.Split(header, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, "@SQ\t") {
+			lines[i] = renameSequence(line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
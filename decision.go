@@ -0,0 +1,407 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Forget mates too short or too diverged to go by, per -min-len and
+// -max-edit-dist, promoting mate 2 when only mate 1 fails. Returns why the
+// read is rejected if neither mate passes.
+func DropWeakMates(mate1, mate2 *Mate) (*Mate, *Mate, string) {
+	if mate1.Len < args.MinLength {
+		// If we don't have mate2 or if it's also too short, we mark this pair as too short.
+		if mate2 == nil || mate2.Len < args.MinLength {
+			if logger.Enabled(LevelDebug) {
+				logger.Debugln("too short, rejecting")
+			}
+			return nil, nil, "too short"
+		}
+		if logger.Enabled(LevelDebug) {
+			logger.Debugln("promoting mate 2")
+		}
+		// Mate2 is okay, so we promote it to mate1, and forget mate2
+		mate1 = mate2
+		mate2 = nil
+	}
+	if mate2 != nil && mate2.Len < args.MinLength {
+		// We have a mate2, but it doesn't meet the min length criteria, just forget it.
+		mate2 = nil
+		if logger.Enabled(LevelDebug) {
+			logger.Debugln("mate 2 too short, forgetting")
+		}
+	}
+	// We treate the filter for edit distance the same way as length.
+	if mate1.EditDist > args.MaxDist {
+		if mate2 == nil || mate2.EditDist > args.MaxDist {
+			if logger.Enabled(LevelDebug) {
+				logger.Debugln("too divergent, rejecting")
+			}
+			return nil, nil, "too diverged"
+		}
+		if logger.Enabled(LevelDebug) {
+			logger.Debugln("promothing mate 2")
+		}
+		// Mate2 is okay, so we promote it to mate1, and forget mate2
+		mate1 = mate2
+		mate2 = nil
+	}
+	if mate2 != nil && mate2.EditDist > args.MaxDist {
+		// We have a mate2, but it doesn't meet the max edit distance criteria, just forget it.
+		mate2 = nil
+		if logger.Enabled(LevelDebug) {
+			logger.Debugln("mate 2, too diverged, forgetting")
+		}
+	}
+	if args.MinMappedFrac > 0 {
+		if mate1, mate2 = dropMates(mate1, mate2, tooLittleMapped, "too little mapped"); mate1 == nil {
+			return nil, nil, "too little mapped"
+		}
+	}
+	// Mates mostly of Ns or of little complexity match everything weakly, so
+	// they're no more to go by.
+	if args.MaxNFrac < 1 {
+		if mate1, mate2 = dropMates(mate1, mate2, tooManyNs, "too many Ns"); mate1 == nil {
+			return nil, nil, "too many Ns"
+		}
+	}
+	if args.Dust > 0 {
+		if mate1, mate2 = dropMates(mate1, mate2, lowComplexity, "low complexity"); mate1 == nil {
+			return nil, nil, "low complexity"
+		}
+	}
+	return mate1, mate2, ""
+}
+
+// Forget the mates that fail, promoting mate 2 if only mate 1 does.
+func dropMates(mate1, mate2 *Mate, fails func(*Mate) bool, reason string) (*Mate, *Mate) {
+	if mate2 != nil && fails(mate2) {
+		if logger.Enabled(LevelDebug) {
+			logger.Debugf("mate 2 %s, forgetting\n", reason)
+		}
+		mate2 = nil
+	}
+	if fails(mate1) {
+		if mate2 == nil && logger.Enabled(LevelDebug) {
+			logger.Debugf("%s, rejecting\n", reason)
+		} else if logger.Enabled(LevelDebug) {
+			logger.Debugln("promoting mate 2")
+		}
+		return mate2, nil
+	}
+	return mate1, mate2
+}
+
+// Whether less than -min-mapped-frac of the mate's read aligned, by its CIGAR.
+// This goes by the fraction of the read whatever its length, where -min-len
+// goes by bases.
+func tooLittleMapped(mate *Mate) bool {
+	ops, err := ParseCigar(mate.Record[5])
+	if err != nil {
+		return false
+	}
+	length := ReadLength(ops)
+	return length > 0 && float64(AlignedLength(ops, false)) < args.MinMappedFrac*float64(length)
+}
+
+// Whether more than -max-n-frac of the mate's bases are N.
+func tooManyNs(mate *Mate) bool {
+	seq := mate.Record[9]
+	if seq == "*" {
+		return false
+	}
+	ns := 0
+	for i := 0; i < len(seq); i++ {
+		if seq[i] == 'N' || seq[i] == 'n' {
+			ns++
+		}
+	}
+	return float64(ns) > args.MaxNFrac*float64(len(seq))
+}
+
+// Whether the mate's sequence is of low complexity by DUST: in some window of
+// 64 bases (or the whole of a shorter read) the triplets repeat enough to
+// score above -dust.
+func lowComplexity(mate *Mate) bool {
+	return DustScore(mate.Record[9]) > args.Dust
+}
+
+const dustWindow = 64
+
+// The highest DUST score of any window of the sequence: the number of pairs
+// of identical triplets, over one less than the number of triplets. A run of
+// one base scores about half the window, and random sequence under 1.
+// Triplets with an N don't count.
+func DustScore(seq string) float64 {
+	if len(seq) < 4 || seq == "*" {
+		return 0
+	}
+	code := func(i int) int {
+		t := 0
+		for _, c := range []byte(seq[i : i+3]) {
+			var b int
+			switch c {
+			case 'A', 'a':
+				b = 0
+			case 'C', 'c':
+				b = 1
+			case 'G', 'g':
+				b = 2
+			case 'T', 't':
+				b = 3
+			default:
+				return -1
+			}
+			t = t<<2 | b
+		}
+		return t
+	}
+	var counts [64]int
+	pairs := 0
+	triplets := len(seq) - 2
+	window := dustWindow - 2
+	if triplets < window {
+		window = triplets
+	}
+	best := 0.0
+	for i := 0; i < triplets; i++ {
+		if t := code(i); t >= 0 {
+			pairs += counts[t]
+			counts[t]++
+		}
+		if i >= window {
+			if t := code(i - window); t >= 0 {
+				counts[t]--
+				pairs -= counts[t]
+			}
+		}
+		if i >= window-1 {
+			best = math.Max(best, float64(pairs)/float64(window-1))
+		}
+	}
+	return best
+}
+
+// How a read compared against one contamination mapping.
+type Comparison struct {
+	SampleScore float64 // the read's score with this mapping's parameters
+	Margin      float64 // how much better than the contaminant it has to score
+	Found       bool    // the read has mapped alignments in this mapping
+	Usable      bool    // and at least one good enough to count
+	Score       float64 // the best usable alignment's score, or pair score
+	Weight      float64 // the mapping's, which the sample's advantage over Score is divided by
+	Rejected    bool
+	// Only alignments in -blacklist regions reject it, which with
+	// -blacklist-action ignore leaves it not rejected.
+	Blacklisted bool
+}
+
+// Compare a read's sample mates against its records in a contamination
+// mapping. With pair scoring the read is compared as a pair, otherwise one
+// usable alignment scoring within the margin of the sample rejects it.
+func Compare(read string, mate1, mate2 *Mate, pair bool, cont *Contaminant, records [][]string) (*Comparison, error) {
+	return compare(read, mate1, mate2, pair, cont, records, true)
+}
+
+// Compare, logging what it finds only when verbose.
+func compare(read string, mate1, mate2 *Mate, pair bool, cont *Contaminant, records [][]string, verbose bool) (*Comparison, error) {
+	if cont.Blacklist != nil {
+		return compareBlacklisted(read, mate1, mate2, pair, cont, records, verbose)
+	}
+	result := &Comparison{Weight: cont.Weight}
+	// Parameter overrides for this contaminant may change the sample's score too.
+	sampleLen := 0.0
+	result.SampleScore, sampleLen = SampleScore(mate1, mate2, cont.Penalty, pair)
+	result.Margin = cont.RequiredMargin(sampleLen)
+
+	alignments := [][]string{}
+	for _, record := range records {
+		if flag, err := recordFlag(record); err != nil {
+			return nil, err
+		} else if flag&FlagUnmapped != 0 {
+			continue
+		}
+		alignments = append(alignments, record)
+		result.Found = true
+		if verbose && logger.Enabled(LevelTrace) {
+			logger.Tracef("found mapping %d for %s in %s\n", len(alignments), record[0], cont.Filename)
+			logger.Traceln(strings.Join(record, "\t"))
+		}
+	}
+
+	if pair {
+		score, ok, err := ContaminantPairScore(alignments, cont)
+		if err != nil {
+			return nil, err
+		}
+		result.Usable = ok
+		result.Score = score
+		result.Rejected = ok && rejectedBy(result.slackAgainst(score))
+		if result.Rejected && verbose && logger.Enabled(LevelDebug) {
+			logger.Debugf("read %s with pair score %0.1f was rejected because in %s it had "+
+				"a pair score of %0.1f\n", read, result.SampleScore, cont.Filename, score)
+		} else if ok && verbose && logger.Enabled(LevelDebug) {
+			logger.Debugf("pair has worse score (%0.1f) in %s\n", score, cont.Filename)
+		}
+		return result, nil
+	}
+
+	best := mate1
+	if mate2 != nil && mate2.Score(cont.Penalty) > mate1.Score(cont.Penalty) {
+		best = mate2
+	}
+	for _, record := range alignments {
+		alignment, err := ParseAlignment(record, cont.Aligner)
+		if err != nil {
+			return nil, err
+		}
+		if !cont.Usable(alignment) {
+			continue
+		}
+		score := alignment.Score(cont.Penalty)
+		if !result.Usable || score > result.Score {
+			result.Usable = true
+			result.Score = score
+		}
+		if verbose && logger.Enabled(LevelTrace) {
+			logger.Tracef("mapping meets length criteria and has score %f\n", score)
+		}
+		if rejectedBy(result.slackAgainst(score)) {
+			if verbose && logger.Enabled(LevelTrace) {
+				logger.Traceln("mapping has better score")
+			}
+			if !result.Rejected && verbose && logger.Enabled(LevelDebug) {
+				logger.Debugf("read %s with length %d and edit distance %d was rejected "+
+					"with score %0.1f because in %s it had a score of %0.1f with length "+
+					"%d and edit distance %d\n",
+					read, best.Len, best.EditDist, result.SampleScore, cont.Filename,
+					score, alignment.Len, alignment.EditDist)
+			}
+			result.Rejected = true
+		} else if verbose && logger.Enabled(LevelTrace) {
+			logger.Traceln("mapping has worse score")
+		}
+	}
+	return result, nil
+}
+
+// Compare a read both with and without its alignments in the contaminant's
+// blacklisted regions, going by the former with -blacklist-action flag and
+// the latter with ignore.
+func compareBlacklisted(read string, mate1, mate2 *Mate, pair bool, cont *Contaminant, records [][]string, verbose bool) (*Comparison, error) {
+	unlisted := *cont
+	unlisted.Blacklist = nil
+	outside := [][]string{}
+	for _, record := range records {
+		genes, err := cont.Blacklist.Overlapping(record)
+		if err != nil {
+			return nil, err
+		}
+		if len(genes) == 0 {
+			outside = append(outside, record)
+		}
+	}
+	ignore := args.BlacklistAction == "ignore"
+	all, err := compare(read, mate1, mate2, pair, &unlisted, records, verbose && !ignore)
+	if err != nil {
+		return nil, err
+	}
+	clean, err := compare(read, mate1, mate2, pair, &unlisted, outside, verbose && ignore)
+	if err != nil {
+		return nil, err
+	}
+	result := all
+	if ignore {
+		result = clean
+		result.Found = all.Found
+	}
+	result.Blacklisted = all.Rejected && !clean.Rejected
+	if result.Blacklisted && verbose && logger.Enabled(LevelDebug) {
+		if ignore {
+			logger.Debugf("not rejecting read %s by its alignments in blacklisted regions of %s\n", read, cont.Filename)
+		} else {
+			logger.Debugf("read %s was rejected only by alignments in blacklisted regions of %s\n", read, cont.Filename)
+		}
+	}
+	return result, nil
+}
+
+// Whether a read is rejected with this much slack (see Slack), which for an
+// exact tie goes by -ties. Ties called ambiguous are rejected here, until the
+// read is called ambiguous once all the contaminants are compared.
+func rejectedBy(slack float64) bool {
+	if args.Ties == "keep" {
+		return slack < 0
+	}
+	return slack <= 0
+}
+
+// Whether a read whose closest contaminant left it this much slack is too
+// close to the margin to call, by -ambiguous-window or -ties ambiguous.
+func Ambiguous(slack float64) bool {
+	return (args.AmbiguousWindow > 0 && math.Abs(slack) <= args.AmbiguousWindow) || (args.Ties == "ambiguous" && slack == 0)
+}
+
+// Why an ambiguous read is, for the decisions and explain.
+func ambiguousReason(slack float64) string {
+	if slack == 0 && args.AmbiguousWindow == 0 {
+		return "tie"
+	}
+	return "within -ambiguous-window of the margin"
+}
+
+// Whether a read rejected with this much slack stays rejected whatever the
+// other contaminants show, rather than possibly being called ambiguous, so
+// -short-circuit can skip them.
+func rejectedOutright(slack float64) bool {
+	if args.AmbiguousWindow == 0 && args.Ties != "ambiguous" {
+		return rejectedBy(slack)
+	}
+	return slack < -args.AmbiguousWindow
+}
+
+// How a read's sample score must compare to the best contaminant score plus
+// the margin for it to be kept, as -keep-if takes it, for the log and stats.
+func KeepComparison() string {
+	if args.Ties == "keep" {
+		return "at-least"
+	}
+	return "greater"
+}
+
+// How far the sample score clears the contaminant's score plus the margin:
+// the read is rejected when this is zero or less. Infinite when there's no
+// usable alignment to compare against.
+func (c *Comparison) Slack() float64 {
+	if !c.Usable {
+		return math.Inf(1)
+	}
+	return c.slackAgainst(c.Score)
+}
+
+// How much better the sample scores than the contaminant, divided by the
+// contaminant's weight, so a weight below 1 asks the contaminant to come
+// closer before it's within the margin. Going by the difference, the weight
+// means the same whatever the sign of the scores, as with -score-tag AS.
+func (c *Comparison) Advantage() float64 {
+	return (c.SampleScore - c.Score) / c.Weight
+}
+
+func (c *Comparison) slackAgainst(score float64) float64 {
+	return (c.SampleScore-score)/c.Weight - c.Margin
+}
+
+func (c *Comparison) String() string {
+	if !c.Usable {
+		if c.Found {
+			return "no usable alignment"
+		}
+		return "not found"
+	}
+	verdict := "kept"
+	if c.Rejected {
+		verdict = "rejected"
+	}
+	return fmt.Sprintf("%s: sample score %0.1f against %0.1f with margin %0.1f", verdict, c.SampleScore, c.Score, c.Margin)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// A table of what happened to every read for -decisions, gzipped when the
+// file name ends in .gz or in Parquet when it ends in .parquet, and with
+// -results-db-reads also in the results database. Columns are the read name,
+// its sample score, the best scoring contaminant and its score, the outcome and
+// the reason for it, with NA (or null) for scores that weren't computed.
+type DecisionWriter struct {
+	fp      *os.File
+	gz      *gzip.Writer
+	w       *bufio.Writer
+	parquet *ParquetWriter
+	db      *ResultsDB
+	err     error
+}
+
+var decisionColumns = []ParquetColumn{
+	{Name: "read", Type: parquetByteArray},
+	{Name: "sample_score", Type: parquetDouble, Optional: true},
+	{Name: "contaminant", Type: parquetByteArray, Optional: true},
+	{Name: "contaminant_score", Type: parquetDouble, Optional: true},
+	{Name: "outcome", Type: parquetByteArray},
+	{Name: "reason", Type: parquetByteArray},
+}
+
+// Either the file name or the database may be missing.
+func NewDecisionWriter(filename string, db *ResultsDB) (*DecisionWriter, error) {
+	d := &DecisionWriter{db: db}
+	if filename == "" {
+		return d, nil
+	}
+	if strings.HasSuffix(filename, ".parquet") {
+		parquet, err := NewParquetWriter(filename, decisionColumns)
+		if err != nil {
+			return nil, err
+		}
+		d.parquet = parquet
+		return d, nil
+	}
+	fp, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	d.fp = fp
+	var w io.Writer = fp
+	if strings.HasSuffix(filename, ".gz") {
+		d.gz = gzip.NewWriter(fp)
+		w = d.gz
+	}
+	d.w = bufio.NewWriter(w)
+	fmt.Fprintf(d.w, "read\tsample_score\tcontaminant\tcontaminant_score\toutcome\treason\n")
+	return d, nil
+}
+
+// Record a read that was settled before it was scored. Like Scored, this does
+// nothing on a nil writer so callers needn't check for -decisions.
+func (d *DecisionWriter) Early(read, outcome, reason string) {
+	if d == nil {
+		return
+	}
+	d.add(read, nil, nil, nil, outcome, reason)
+}
+
+// Record a read that was compared against the contamination. The contaminant
+// is empty if the read had no usable alignment in any of it.
+func (d *DecisionWriter) Scored(read string, score float64, cont string, contScore float64, outcome, reason string) {
+	if d == nil {
+		return
+	}
+	if cont == "" {
+		d.add(read, score, nil, nil, outcome, reason)
+	} else {
+		d.add(read, score, cont, contScore, outcome, reason)
+	}
+}
+
+// Write a row of strings, float64s or nil for NA.
+func (d *DecisionWriter) add(values ...interface{}) {
+	if d.db != nil {
+		d.db.Decision(values...)
+	}
+	if d.parquet != nil {
+		d.keep(d.parquet.Add(values...))
+	}
+	if d.w != nil {
+		fields := make([]string, len(values))
+		for i, v := range values {
+			switch v := v.(type) {
+			case nil:
+				fields[i] = "NA"
+			case float64:
+				fields[i] = fmt.Sprintf("%g", v)
+			default:
+				fields[i] = fmt.Sprint(v)
+			}
+		}
+		fmt.Fprintln(d.w, strings.Join(fields, "\t"))
+	}
+}
+
+// Hang on to the first error writing, to return from Close. The TSV's bufio
+// writer does the same for itself.
+func (d *DecisionWriter) keep(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+// Close the file, if any. The results database is finished separately.
+func (d *DecisionWriter) Close() error {
+	if d.parquet != nil {
+		if d.err != nil {
+			return d.err
+		}
+		return d.parquet.Close()
+	}
+	if d.w == nil {
+		return nil
+	}
+	if err := d.w.Flush(); err != nil {
+		return err
+	}
+	if d.gz != nil {
+		if err := d.gz.Close(); err != nil {
+			return err
+		}
+	}
+	return d.fp.Close()
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Identify the fragment a read comes from by where its mates start, the way
+// duplicate marking does: the unclipped 5' position and strand of each mate.
+// A duplicate gets the same key as the read it duplicates.
+func DuplicateKey(mate1, mate2 *Mate) (uint64, error) {
+	ends := []string{}
+	for _, mate := range []*Mate{mate1, mate2} {
+		if mate == nil {
+			continue
+		}
+		pos, err := UnclippedFivePrime(mate.Record, mate.Flag)
+		if err != nil {
+			return 0, err
+		}
+		strand := "+"
+		if mate.Flag&FlagReverse != 0 {
+			strand = "-"
+		}
+		ends = append(ends, mate.Record[2]+":"+strconv.Itoa(pos)+strand)
+	}
+	sort.Strings(ends)
+	h := fnv.New64a()
+	io.WriteString(h, strings.Join(ends, "\t"))
+	return h.Sum64(), nil
+}
+
+// With -duplicates inherit, reads flagged as PCR duplicates aren't compared to
+// the contamination at all. They're set aside in a temporary file and written
+// at the end if the read they duplicate was kept. This holds a decision for
+// every non-duplicate read in memory, or with -max-memory, up to so many of
+// them before they're spilled to disk.
+type DuplicateStore struct {
+	decisions  map[uint64]bool
+	fp         *os.File
+	w          *bufio.Writer
+	dir        string
+	Max        int        // decisions to hold in memory, or 0 for no limit
+	spilled    []*os.File // each sorted by key
+	merged     *os.File   // all of spilled, once we're resolving
+	count      int64      // entries in merged
+	Deferred   int
+	Kept       int
+	Dropped    int
+	Unresolved int
+	Spills     int
+	// What was written of the kept ones, for the run's totals.
+	KeptMates         int
+	KeptSecondary     int
+	KeptSupplementary int
+	KeptSingletons    int
+}
+
+func NewDuplicateStore(dir string) (*DuplicateStore, error) {
+	fp, err := os.CreateTemp(dir, "contfilter-duplicates-*.sam")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file for duplicates: %v", err)
+	}
+	return &DuplicateStore{
+		decisions: make(map[uint64]bool),
+		fp:        fp,
+		w:         bufio.NewWriter(fp),
+		dir:       dir,
+	}, nil
+}
+
+// Note a non-duplicate read, which starts out as not kept.
+func (d *DuplicateStore) Representative(key uint64) error {
+	if _, ok := d.decisions[key]; !ok {
+		d.decisions[key] = false
+	}
+	return d.checkSpill()
+}
+
+func (d *DuplicateStore) RepresentativeKept(key uint64) error {
+	d.decisions[key] = true
+	return d.checkSpill()
+}
+
+// The size of a spilled decision: the key, then whether it was kept.
+const dupEntrySize = 9
+
+func (d *DuplicateStore) checkSpill() error {
+	if d.Max == 0 || len(d.decisions) < d.Max {
+		return nil
+	}
+	return d.spill()
+}
+
+// Write the decisions in memory out to a file of their own, sorted by key.
+// A read's decision can end up in more than one file, when it's kept after
+// being spilled as not kept yet, and it was kept if any of them say so.
+func (d *DuplicateStore) spill() error {
+	fp, err := os.CreateTemp(d.dir, "contfilter-decisions-*.bin")
+	if err != nil {
+		return fmt.Errorf("failed to create file for duplicate decisions: %v", err)
+	}
+	d.spilled = append(d.spilled, fp)
+	d.Spills++
+	keys := make([]uint64, 0, len(d.decisions))
+	for key := range d.decisions {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	w := bufio.NewWriter(fp)
+	var entry [dupEntrySize]byte
+	for _, key := range keys {
+		binary.BigEndian.PutUint64(entry[:8], key)
+		entry[8] = 0
+		if d.decisions[key] {
+			entry[8] = 1
+		}
+		if _, err := w.Write(entry[:]); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	d.decisions = make(map[uint64]bool)
+	return nil
+}
+
+// A spilled file being merged, at its next entry.
+type dupRun struct {
+	r     *bufio.Reader
+	key   uint64
+	kept  bool
+	empty bool
+}
+
+func (run *dupRun) advance() error {
+	var entry [dupEntrySize]byte
+	if _, err := io.ReadFull(run.r, entry[:]); err == io.EOF {
+		run.empty = true
+		return nil
+	} else if err != nil {
+		return err
+	}
+	run.key = binary.BigEndian.Uint64(entry[:8])
+	run.kept = entry[8] == 1
+	return nil
+}
+
+// Merge the spilled decisions into one file sorted by key, with a read kept
+// if any of them say so, for Resolve to look them up in.
+func (d *DuplicateStore) merge() error {
+	if len(d.decisions) > 0 {
+		if err := d.spill(); err != nil {
+			return err
+		}
+	}
+	runs := []*dupRun{}
+	for _, fp := range d.spilled {
+		if _, err := fp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		run := &dupRun{r: bufio.NewReader(fp)}
+		if err := run.advance(); err != nil {
+			return err
+		}
+		runs = append(runs, run)
+	}
+	fp, err := os.CreateTemp(d.dir, "contfilter-decisions-*.bin")
+	if err != nil {
+		return fmt.Errorf("failed to create file for duplicate decisions: %v", err)
+	}
+	d.merged = fp
+	w := bufio.NewWriter(fp)
+	var entry [dupEntrySize]byte
+	for {
+		next := -1
+		for i, run := range runs {
+			if !run.empty && (next < 0 || run.key < runs[next].key) {
+				next = i
+			}
+		}
+		if next < 0 {
+			break
+		}
+		key := runs[next].key
+		kept := false
+		for _, run := range runs {
+			for !run.empty && run.key == key {
+				kept = kept || run.kept
+				if err := run.advance(); err != nil {
+					return err
+				}
+			}
+		}
+		binary.BigEndian.PutUint64(entry[:8], key)
+		entry[8] = 0
+		if kept {
+			entry[8] = 1
+		}
+		if _, err := w.Write(entry[:]); err != nil {
+			return err
+		}
+		d.count++
+	}
+	return w.Flush()
+}
+
+// The decision for a key, and whether there is one.
+func (d *DuplicateStore) decision(key uint64) (bool, bool, error) {
+	if d.merged == nil {
+		kept, found := d.decisions[key]
+		return kept, found, nil
+	}
+	var entry [dupEntrySize]byte
+	var err error
+	i := sort.Search(int(d.count), func(i int) bool {
+		if err != nil {
+			return true
+		}
+		_, err = d.merged.ReadAt(entry[:], int64(i)*dupEntrySize)
+		return binary.BigEndian.Uint64(entry[:8]) >= key
+	})
+	if err != nil {
+		return false, false, err
+	}
+	if i == int(d.count) {
+		return false, false, nil
+	}
+	if _, err := d.merged.ReadAt(entry[:], int64(i)*dupEntrySize); err != nil {
+		return false, false, err
+	}
+	if binary.BigEndian.Uint64(entry[:8]) != key {
+		return false, false, nil
+	}
+	return entry[8] == 1, true, nil
+}
+
+// Remove the files of spilled decisions.
+func (d *DuplicateStore) removeSpilled() {
+	files := d.spilled
+	if d.merged != nil {
+		files = append(files, d.merged)
+	}
+	for _, fp := range files {
+		fp.Close()
+		os.Remove(fp.Name())
+	}
+}
+
+// Set aside the alignments of a duplicate read, noting whether it's a pair
+// with only one mate left, which goes to -singletons if kept.
+func (d *DuplicateStore) Defer(key uint64, singleton bool, mates ...*Mate) error {
+	d.Deferred++
+	kind := "p"
+	if singleton {
+		kind = "s"
+	}
+	for _, mate := range mates {
+		// Only written if the representative is kept.
+		records, _, _, err := mate.OutputRecords(keptFlags)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			if _, err := fmt.Fprintf(d.w, "%016x\t%s\t%s\n", key, kind, strings.Join(record, "\t")); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Write out the duplicates whose representative was kept, along with any
+// whose representative never turned up, and remove the temporary file.
+// Singletons go to singletons instead, if not nil, like the reads decided as
+// they came, and they all go to -fastq-out too, if given. Each read's outcome
+// goes to decisions now it's known.
+func (d *DuplicateStore) Resolve(out, singletons io.Writer, fastq *FastqWriter, decisions *DecisionWriter) error {
+	defer os.Remove(d.fp.Name())
+	defer d.fp.Close()
+	defer d.removeSpilled()
+	if err := d.w.Flush(); err != nil {
+		return err
+	}
+	if len(d.spilled) > 0 {
+		if err := d.merge(); err != nil {
+			return fmt.Errorf("failed to merge spilled duplicate decisions: %v", err)
+		}
+	}
+	if _, err := d.fp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(d.fp)
+	// Room for a record as long as we'd read, plus the key and kind before it.
+	scanner.Buffer(make([]byte, 64*1024), maxRecordSize+19)
+	last := ""
+	keep := false
+	w := out
+	primaries := [][]string{}
+	for scanner.Scan() {
+		line := scanner.Text()
+		i := strings.IndexByte(line, '\t')
+		if i < 0 || len(line) < i+3 || line[i+2] != '\t' {
+			return fmt.Errorf("corrupt duplicates file %s", d.fp.Name())
+		}
+		kind := line[i+1]
+		record := line[i+3:]
+		read := record[:strings.IndexByte(record+"\t", '\t')]
+		if read != last {
+			if len(primaries) > 0 {
+				if err := fastq.Write(primaries...); err != nil {
+					return err
+				}
+				primaries = primaries[:0]
+			}
+			key, err := strconv.ParseUint(line[:i], 16, 64)
+			if err != nil {
+				return fmt.Errorf("corrupt duplicates file %s", d.fp.Name())
+			}
+			kept, found, err := d.decision(key)
+			if err != nil {
+				return err
+			}
+			switch {
+			case !found:
+				d.Unresolved++
+				keep = true
+				decisions.Early(read, "kept", "duplicate of a read not seen")
+			case kept:
+				d.Kept++
+				keep = true
+				decisions.Early(read, "kept", "duplicate of a kept read")
+			default:
+				d.Dropped++
+				keep = false
+				decisions.Early(read, "rejected", "duplicate of a rejected read")
+			}
+			w = out
+			if kind == 's' && singletons != nil {
+				w = singletons
+			}
+			if keep && kind == 's' {
+				d.KeptSingletons++
+			}
+			last = read
+		}
+		if keep {
+			if _, err := io.WriteString(w, record+"\n"); err != nil {
+				return err
+			}
+			fields := strings.Split(record, "\t")
+			flag, err := recordFlag(fields)
+			if err != nil {
+				return fmt.Errorf("corrupt duplicates file %s: %v", d.fp.Name(), err)
+			}
+			switch {
+			case flag&FlagSecondary != 0:
+				d.KeptSecondary++
+			case flag&FlagSupplementary != 0:
+				d.KeptSupplementary++
+			default:
+				d.KeptMates++
+				if fastq != nil {
+					primaries = append(primaries, fields)
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return scanError(d.fp.Name(), err)
+	}
+	if len(primaries) > 0 {
+		return fastq.Write(primaries...)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testMate(record string) *Mate {
+	fields := strings.Split(record, "\t")
+	flag, _ := recordFlag(fields)
+	return &Mate{Record: fields, Flag: flag}
+}
+
+// Duplicates resolve the same however many files the decisions are spilled
+// to, including a representative kept after it was spilled as not kept yet.
+func TestDuplicateStoreSpills(t *testing.T) {
+	for max, spills := range map[int]int{0: 0, 1: 12, 3: 3} {
+		dir := t.TempDir()
+		store, err := NewDuplicateStore(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.Max = max
+		steps := []struct {
+			key  uint64
+			kept bool
+		}{
+			{1, false}, {1, true}, {2, false}, {3, false},
+			{4, false}, {4, true}, {5, false}, {6, false},
+			{2, true}, {7, false}, {7, true}, {8, false},
+		}
+		for _, step := range steps {
+			if step.kept {
+				err = store.RepresentativeKept(step.key)
+			} else {
+				err = store.Representative(step.key)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if store.Spills != spills {
+			t.Errorf("Max %d: spilled %d times, want %d", max, store.Spills, spills)
+		}
+
+		deferred := []struct {
+			key       uint64
+			singleton bool
+			records   []string
+		}{
+			{1, false, []string{"dupA\t1024\tchr1\t100\t60\t4M\t*\t0\t0\tACGT\tIIII"}},
+			{2, false, []string{"dupB\t1024\tchr1\t200\t60\t4M\t*\t0\t0\tACGT\tIIII"}},
+			{3, false, []string{"dupC\t1024\tchr1\t300\t60\t4M\t*\t0\t0\tACGT\tIIII"}},
+			{99, false, []string{"dupD\t1024\tchr1\t400\t60\t4M\t*\t0\t0\tACGT\tIIII"}},
+			{5, true, []string{"dupE\t1097\tchr1\t500\t60\t4M\t=\t600\t104\tACGT\tIIII"}},
+			{7, true, []string{"dupF\t1097\tchr1\t700\t60\t4M\t=\t800\t104\tACGT\tIIII"}},
+			{4, false, []string{
+				"dupG\t1123\tchr1\t900\t60\t4M\t=\t1000\t104\tACGT\tIIII",
+				"dupG\t1171\tchr1\t1000\t60\t4M\t=\t900\t-104\tACGT\tIIII",
+			}},
+		}
+		for _, dup := range deferred {
+			mates := []*Mate{}
+			for _, record := range dup.records {
+				mates = append(mates, testMate(record))
+			}
+			if len(mates) == 2 {
+				mates[1].Secondary = [][]string{strings.Split("dupG\t1427\tchr2\t50\t0\t4M\t=\t900\t0\tACGT\tIIII", "\t")}
+			}
+			if err := store.Defer(dup.key, dup.singleton, mates...); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		decisionsFile := filepath.Join(t.TempDir(), "decisions.tsv")
+		decisions, err := NewDecisionWriter(decisionsFile, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out, singletons strings.Builder
+		if err := store.Resolve(&out, &singletons, nil, decisions); err != nil {
+			t.Fatal(err)
+		}
+		if err := decisions.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		names := func(sam string) string {
+			reads := []string{}
+			for _, line := range strings.Split(strings.TrimSpace(sam), "\n") {
+				reads = append(reads, strings.SplitN(line, "\t", 3)[:2]...)
+			}
+			return strings.Join(reads, " ")
+		}
+		if got, want := names(out.String()), "dupA 1024 dupB 1024 dupD 1024 dupG 1123 dupG 1171 dupG 1427"; got != want {
+			t.Errorf("Max %d: wrote %s, want %s", max, got, want)
+		}
+		if got, want := names(singletons.String()), "dupF 1097"; got != want {
+			t.Errorf("Max %d: wrote singletons %s, want %s", max, got, want)
+		}
+		counts := []struct {
+			name      string
+			got, want int
+		}{
+			{"Deferred", store.Deferred, 7},
+			{"Kept", store.Kept, 4},
+			{"Dropped", store.Dropped, 2},
+			{"Unresolved", store.Unresolved, 1},
+			{"KeptMates", store.KeptMates, 6},
+			{"KeptSecondary", store.KeptSecondary, 1},
+			{"KeptSingletons", store.KeptSingletons, 1},
+		}
+		for _, c := range counts {
+			if c.got != c.want {
+				t.Errorf("Max %d: %s %d, want %d", max, c.name, c.got, c.want)
+			}
+		}
+
+		table, err := os.ReadFile(decisionsFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "read\tsample_score\tcontaminant\tcontaminant_score\toutcome\treason\n" +
+			"dupA\tNA\tNA\tNA\tkept\tduplicate of a kept read\n" +
+			"dupB\tNA\tNA\tNA\tkept\tduplicate of a kept read\n" +
+			"dupC\tNA\tNA\tNA\trejected\tduplicate of a rejected read\n" +
+			"dupD\tNA\tNA\tNA\tkept\tduplicate of a read not seen\n" +
+			"dupE\tNA\tNA\tNA\trejected\tduplicate of a rejected read\n" +
+			"dupF\tNA\tNA\tNA\tkept\tduplicate of a kept read\n" +
+			"dupG\tNA\tNA\tNA\tkept\tduplicate of a kept read\n"
+		if string(table) != want {
+			t.Errorf("Max %d: decisions\n%s\nwant\n%s", max, table, want)
+		}
+
+		if left, _ := os.ReadDir(dir); len(left) > 0 {
+			t.Errorf("Max %d: left %d temporary files behind", max, len(left))
+		}
+	}
+}
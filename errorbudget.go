@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// How many malformed records -skip-malformed may pass over before giving up
+// with -max-errors: a number of them, or a fraction of the reads when below 1.
+// The zero value allows any number.
+type ErrorBudget struct {
+	Count    int
+	Fraction float64
+}
+
+// A fraction isn't held against the run until this many reads are in, so a
+// bad record near the start doesn't end it.
+const errorBudgetMinReads = 1000
+
+func (b *ErrorBudget) String() string {
+	if b.Fraction > 0 {
+		return strconv.FormatFloat(b.Fraction, 'g', -1, 64)
+	}
+	return strconv.Itoa(b.Count)
+}
+
+func (b *ErrorBudget) Set(value string) error {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return err
+	}
+	switch {
+	case v <= 0:
+		return fmt.Errorf("must be positive")
+	case v < 1:
+		b.Fraction, b.Count = v, 0
+	case v == float64(int(v)):
+		b.Count, b.Fraction = int(v), 0
+	default:
+		return fmt.Errorf("must be a whole number of records or a fraction below 1")
+	}
+	return nil
+}
+
+// Whether the malformed records so far are more than allowed. A fraction is
+// checked at the end of the run however few reads there were.
+func (b *ErrorBudget) Exceeded(errors, reads int, final bool) bool {
+	if b.Count > 0 {
+		return errors > b.Count
+	}
+	if b.Fraction > 0 && reads > 0 && (final || reads >= errorBudgetMinReads) {
+		return float64(errors)/float64(reads) > b.Fraction
+	}
+	return false
+}
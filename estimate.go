@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// An estimate of the fraction of reads that are contamination, from a two
+// component normal mixture fit by EM to how much better each read scores in
+// the sample than in the contamination. Reads without a usable contamination
+// alignment are taken to be clean. Reads between the two components count
+// for each by how likely they are to belong to it, rather than all one way as
+// in the filter.
+type MixtureEstimate struct {
+	Fraction   float64 // of the reads considered
+	Low, High  float64 // 95% confidence interval
+	Iterations int
+	Converged  bool
+	Means      [2]float64 // contaminated, clean
+	Sds        [2]float64
+}
+
+// Scores are sums of whole numbers of edits, so don't let a component shrink
+// to a spike on one of them.
+const minMixtureSd = 0.5
+
+func normalDensity(x, mean, sd float64) float64 {
+	z := (x - mean) / sd
+	return math.Exp(-z*z/2) / (sd * math.Sqrt(2*math.Pi))
+}
+
+// Fit the mixture to the score differences of the reads found in the
+// contamination, starting from the split the margin makes.
+func EstimateContamination(diffs []float64, considered int, margin float64) (*MixtureEstimate, error) {
+	if considered == 0 {
+		return nil, fmt.Errorf("no reads to estimate contamination from")
+	}
+	e := &MixtureEstimate{}
+	if len(diffs) == 0 {
+		return e, nil
+	}
+	var sums, squares, counts [2]float64
+	for _, d := range diffs {
+		k := 1
+		if d <= margin {
+			k = 0
+		}
+		sums[k] += d
+		squares[k] += d * d
+		counts[k]++
+	}
+	weight := math.Min(math.Max(counts[0]/float64(len(diffs)), 0.01), 0.99)
+	for k := range sums {
+		if counts[k] == 0 {
+			// Start an empty component a little way to its side of the margin.
+			e.Means[k] = margin + float64(2*k-1)*2
+			e.Sds[k] = 1
+			continue
+		}
+		e.Means[k] = sums[k] / counts[k]
+		e.Sds[k] = math.Max(math.Sqrt(squares[k]/counts[k]-e.Means[k]*e.Means[k]), minMixtureSd)
+	}
+
+	resp := make([]float64, len(diffs))
+	prev := math.Inf(-1)
+	for e.Iterations = 1; e.Iterations <= 1000; e.Iterations++ {
+		// E step: how likely each read is to be contamination.
+		loglik := 0.0
+		for i, d := range diffs {
+			pc := weight * normalDensity(d, e.Means[0], e.Sds[0])
+			ps := (1 - weight) * normalDensity(d, e.Means[1], e.Sds[1])
+			total := pc + ps
+			if total == 0 {
+				// Far out in both tails; go by which mean is nearer.
+				resp[i] = 0
+				if math.Abs(d-e.Means[0]) < math.Abs(d-e.Means[1]) {
+					resp[i] = 1
+				}
+				continue
+			}
+			resp[i] = pc / total
+			loglik += math.Log(total)
+		}
+		// M step.
+		sums, squares, counts = [2]float64{}, [2]float64{}, [2]float64{}
+		for i, d := range diffs {
+			w := [2]float64{resp[i], 1 - resp[i]}
+			for k := range w {
+				sums[k] += w[k] * d
+				squares[k] += w[k] * d * d
+				counts[k] += w[k]
+			}
+		}
+		weight = counts[0] / float64(len(diffs))
+		for k := range sums {
+			if counts[k] > 0 {
+				e.Means[k] = sums[k] / counts[k]
+				e.Sds[k] = math.Max(math.Sqrt(math.Max(squares[k]/counts[k]-e.Means[k]*e.Means[k], 0)), minMixtureSd)
+			}
+		}
+		if math.Abs(loglik-prev) < 1e-8*math.Abs(loglik) {
+			e.Converged = true
+			break
+		}
+		prev = loglik
+	}
+
+	// The standard error of the weight from the observed information, holding
+	// the components fixed.
+	info := 0.0
+	for _, d := range diffs {
+		fc := normalDensity(d, e.Means[0], e.Sds[0])
+		fs := normalDensity(d, e.Means[1], e.Sds[1])
+		total := weight*fc + (1-weight)*fs
+		if total > 0 {
+			info += (fc - fs) * (fc - fs) / (total * total)
+		}
+	}
+	se := 0.0
+	if info > 0 {
+		se = 1 / math.Sqrt(info)
+	}
+	found := float64(len(diffs)) / float64(considered)
+	e.Fraction = weight * found
+	e.Low = math.Max(weight-1.96*se, 0) * found
+	e.High = math.Min(weight+1.96*se, 1) * found
+	return e, nil
+}
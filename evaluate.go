@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Known origins of reads for -truth, to measure how well the filter does. A
+// contaminated read counts as a true positive when it's rejected. Only reads
+// that get as far as being compared against the contamination are counted.
+type Evaluation struct {
+	truth     map[string]bool
+	Unlabeled int
+	positive  []float64 // the slack of each contaminated read, see Comparison.Slack
+	negative  []float64
+	// Reads called ambiguous, which are neither rejected nor kept, and so
+	// left out of the confusion matrices.
+	AmbiguousPositive int
+	AmbiguousNegative int
+}
+
+// Read a table of read names and whether each is contaminated (true/false or
+// 1/0), such as contfilter simulate writes. A header line is skipped.
+func LoadTruth(filename string) (*Evaluation, error) {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	e := &Evaluation{truth: make(map[string]bool)}
+	scanner := bufio.NewScanner(fp)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s line %d: expected a read name and whether it's contaminated", filename, line)
+		}
+		contaminated, err := strconv.ParseBool(fields[1])
+		if err != nil {
+			if line == 1 {
+				continue
+			}
+			return nil, fmt.Errorf("%s line %d: %v", filename, line, err)
+		}
+		name := fields[0]
+		if normalizeNames {
+			name = NormalizeName(name)
+		}
+		e.truth[name] = contaminated
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Count a compared read by how far it was from being rejected. This does
+// nothing without -truth.
+func (e *Evaluation) Add(read string, slack float64, ambiguous bool) {
+	if e == nil {
+		return
+	}
+	contaminated, ok := e.truth[read]
+	switch {
+	case !ok:
+		e.Unlabeled++
+	case ambiguous && contaminated:
+		e.AmbiguousPositive++
+	case ambiguous:
+		e.AmbiguousNegative++
+	case contaminated:
+		e.positive = append(e.positive, slack)
+	default:
+		e.negative = append(e.negative, slack)
+	}
+}
+
+// The confusion matrix if the margin were greater by extra.
+func (e *Evaluation) Counts(extra float64) (tp, fp, fn, tn int) {
+	for _, slack := range e.positive {
+		if rejectedBy(slack - extra) {
+			tp++
+		} else {
+			fn++
+		}
+	}
+	for _, slack := range e.negative {
+		if rejectedBy(slack - extra) {
+			fp++
+		} else {
+			tn++
+		}
+	}
+	return
+}
+
+func ratio(a, b int) float64 {
+	if b == 0 {
+		return math.NaN()
+	}
+	return float64(a) / float64(b)
+}
+
+func (e *Evaluation) Log() {
+	tp, fp, fn, tn := e.Counts(0)
+	logger.Printf("of %d labeled reads compared, rejected %d of %d contaminated and %d of %d clean (%d unlabeled)\n",
+		len(e.positive)+len(e.negative), tp, tp+fn, fp, fp+tn, e.Unlabeled)
+	if e.AmbiguousPositive+e.AmbiguousNegative > 0 {
+		logger.Printf("called %d contaminated and %d clean labeled reads ambiguous, leaving them out of the counts\n",
+			e.AmbiguousPositive, e.AmbiguousNegative)
+	}
+	logger.Printf("precision %0.4f, recall %0.4f\n", ratio(tp, tp+fp), ratio(tp, tp+fn))
+}
+
+// Write the confusion matrix with each extra margin that changes it: every
+// slack seen, so the table runs from rejecting nearly nothing to everything
+// that maps to the contamination at all.
+func (e *Evaluation) WriteROC(filename string) error {
+	seen := make(map[float64]bool)
+	thresholds := []float64{}
+	for _, slacks := range [][]float64{e.positive, e.negative} {
+		for _, slack := range slacks {
+			if !math.IsInf(slack, 1) && !seen[slack] {
+				seen[slack] = true
+				thresholds = append(thresholds, slack)
+			}
+		}
+	}
+	sort.Float64s(thresholds)
+
+	fp, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(fp)
+	fmt.Fprintln(w, "extra_margin\ttrue_pos\tfalse_pos\tfalse_neg\ttrue_neg\tprecision\trecall\tfalse_pos_rate")
+	// A read rejected at one margin is at every larger one too, so with the
+	// slacks sorted, each threshold only moves on past the reads it adds.
+	sort.Float64s(e.positive)
+	sort.Float64s(e.negative)
+	tp, falsePos := 0, 0
+	for _, t := range thresholds {
+		for tp < len(e.positive) && rejectedBy(e.positive[tp]-t) {
+			tp++
+		}
+		for falsePos < len(e.negative) && rejectedBy(e.negative[falsePos]-t) {
+			falsePos++
+		}
+		fn, tn := len(e.positive)-tp, len(e.negative)-falsePos
+		fmt.Fprintf(w, "%g\t%d\t%d\t%d\t%d\t%0.4f\t%0.4f\t%0.4f\n", t, tp, falsePos, fn, tn,
+			ratio(tp, tp+falsePos), ratio(tp, tp+fn), ratio(falsePos, falsePos+tn))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return fp.Close()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Each row of the ROC table agrees with counting afresh at its margin, with
+// and without ties rejected.
+func TestWriteROC(t *testing.T) {
+	saved := args.Ties
+	defer func() { args.Ties = saved }()
+	inf := math.Inf(1)
+	for ties, rejected := range map[string]string{"reject": "7 5 1 2", "keep": "7 4 1 3"} {
+		args.Ties = ties
+		e := &Evaluation{
+			positive: []float64{3, -2, 0, 0, inf, -7.5, 3, 1},
+			negative: []float64{5, inf, 0, 12, -1, 3, inf},
+		}
+		filename := filepath.Join(t.TempDir(), "roc.tsv")
+		if err := e.WriteROC(filename); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		// A row for every distinct finite slack, in order.
+		thresholds := []string{"-7.5", "-2", "-1", "0", "1", "3", "5", "12"}
+		if len(lines) != len(thresholds)+1 {
+			t.Fatalf("-ties %s: %d rows, want %d:\n%s", ties, len(lines)-1, len(thresholds), data)
+		}
+		for i, line := range lines[1:] {
+			fields := strings.Split(line, "\t")
+			if fields[0] != thresholds[i] {
+				t.Errorf("-ties %s: row %d is for %s, want %s", ties, i+1, fields[0], thresholds[i])
+			}
+			extra, _ := strconv.ParseFloat(fields[0], 64)
+			tp, fp, fn, tn := e.Counts(extra)
+			want := []int{tp, fp, fn, tn}
+			for j, field := range fields[1:5] {
+				if field != strconv.Itoa(want[j]) {
+					t.Errorf("-ties %s: at %s got %v, want %v", ties, fields[0], fields[1:5], want)
+					break
+				}
+			}
+		}
+		// By the largest margin, everything but the reads that never came
+		// close is rejected, unless it's a tie that -ties keep keeps.
+		last := strings.Split(lines[len(lines)-1], "\t")
+		if strings.Join(last[1:5], " ") != rejected {
+			t.Errorf("-ties %s: last row %v, want %s", ties, last[1:5], rejected)
+		}
+	}
+}
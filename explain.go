@@ -0,0 +1,141 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strings"
+)
+
+// One line about an alignment for contfilter explain.
+func describeAlignment(record []string, aligner *Aligner, penalty float64) string {
+	desc := fmt.Sprintf("FLAG %s %s:%s %s", record[1], record[2], record[3], record[5])
+	flag, err := recordFlag(record)
+	if err != nil || flag&FlagUnmapped != 0 {
+		return desc + " unmapped"
+	}
+	a, err := ParseAlignment(record, aligner)
+	if err != nil {
+		return desc + " " + err.Error()
+	}
+	return fmt.Sprintf("%s length %d edit distance %d score %0.1f", desc, a.Len, a.EditDist, a.Score(penalty))
+}
+
+// contfilter explain -read NAME [options] cont1.bam ...
+//
+// Look a single read up in the sample and each contamination mapping and go
+// through the decision the filter would make about it, taking the same options.
+func explainMain(argv []string) {
+	var read string
+	flag.StringVar(&read, "read", "", "name of the read to explain (required)")
+	flag.CommandLine.Parse(argv)
+	contArgs := flag.Args()
+	if read == "" || len(contArgs) == 0 {
+		log.Println("usage: contfilter explain -read NAME [options] cont1.bam[:key=value,...] cont2.bam ...")
+		os.Exit(1)
+	}
+	OpenLogger()
+	if err := CompileExclusions(); err != nil {
+		logger.Fatal(err)
+	}
+	run, err := OpenRun(contArgs)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	verdict, err := Explain(read, run)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	fmt.Printf("decision: %s\n", verdict)
+}
+
+// Print what goes into the decision about a read and return it.
+func Explain(read string, run *Run) (string, error) {
+	group, err := run.Sample.Lookup(read)
+	if err != nil {
+		return "", err
+	}
+	if len(group) == 0 {
+		return "", fmt.Errorf("read %s isn't in %s", read, sampleName())
+	}
+	fmt.Printf("read %s has %d records in %s:\n", read, len(group), sampleName())
+	for _, record := range group {
+		fmt.Printf("  %s\n", describeAlignment(record, run.SampleAligner, args.Penalty))
+	}
+
+	if args.RequireFlags != 0 || args.ExcludeFlags != 0 {
+		group, err = FilterFlags(group, int(args.RequireFlags), int(args.ExcludeFlags))
+		if err != nil {
+			return "", err
+		}
+		if len(group) == 0 {
+			return "rejected, no alignments pass the FLAG filters", nil
+		}
+	}
+	mate1, mate2, err := PickMates(group, run.SampleAligner)
+	if err != nil {
+		return "", err
+	}
+	mate1, mate2, _ = SplitUnmapped(mate1, mate2)
+	if mate1 == nil {
+		return "unmapped, handled with -unmapped " + args.Unmapped, nil
+	}
+	if mate1.Flag&FlagDuplicate != 0 || (mate2 != nil && mate2.Flag&FlagDuplicate != 0) {
+		switch args.Duplicates {
+		case "exclude":
+			return "rejected as a duplicate", nil
+		case "inherit":
+			return "duplicate, kept only if the read it duplicates is", nil
+		}
+	}
+	if MatchesExcluded(mate1, mate2) {
+		return "rejected, maps to an excluded contig", nil
+	}
+	mate1, mate2, reason := DropWeakMates(mate1, mate2)
+	if reason != "" {
+		return "rejected, " + reason, nil
+	}
+	pair := args.PairScore != "best" && mate2 != nil
+	fmt.Printf("scoring mate 1 by %s\n", describeAlignment(mate1.Record, run.SampleAligner, args.Penalty))
+	if mate2 != nil {
+		fmt.Printf("scoring mate 2 by %s\n", describeAlignment(mate2.Record, run.SampleAligner, args.Penalty))
+	}
+	if pair {
+		fmt.Printf("scoring the pair by the %s of its mates\n", args.PairScore)
+	}
+
+	rejectedBy := []string{}
+	slack := math.Inf(1)
+	for c, cont := range run.Contamination {
+		records, err := run.Sources[c].Lookup(read)
+		if err != nil {
+			return "", err
+		}
+		fmt.Printf("%d records in %s:\n", len(records), cont.Filename)
+		for _, record := range records {
+			usable := ""
+			if a, err := ParseAlignment(record, cont.Aligner); err == nil && !cont.Usable(a) {
+				usable = " (not usable)"
+			}
+			fmt.Printf("  %s%s\n", describeAlignment(record, cont.Aligner, cont.Penalty), usable)
+		}
+		result, err := Compare(read, mate1, mate2, pair, cont, records)
+		if err != nil {
+			return "", fmt.Errorf("failed to read from %s: %v", cont.Filename, err)
+		}
+		fmt.Printf("  %s\n", result)
+		slack = math.Min(slack, result.Slack())
+		if result.Rejected {
+			rejectedBy = append(rejectedBy, cont.Filename)
+		}
+	}
+	if Ambiguous(slack) {
+		return "ambiguous, " + ambiguousReason(slack), nil
+	}
+	if len(rejectedBy) > 0 {
+		return "rejected, maps as well or better to " + strings.Join(rejectedBy, ", "), nil
+	}
+	return "kept", nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Writes kept reads as bgzipped FASTQ for -fastq-out, pairs to R1 and R2
+// files and reads with one mate to a singletons file, ready to realign
+// without going through samtools fastq. A read is written as its primary
+// alignment had it, so bases hard clipped from that are lost.
+type FastqWriter struct {
+	Filenames  [3]string // R1, R2 and singletons, all the one file if interleaved
+	Pairs      int
+	Singletons int
+	files      []*os.File
+	ws         []io.WriteCloser
+	streams    [3]int // which of ws each of Filenames is
+}
+
+func NewFastqWriter(prefix string) (*FastqWriter, error) {
+	f := &FastqWriter{}
+	for i, suffix := range []string{"_R1.fastq.gz", "_R2.fastq.gz", "_singletons.fastq.gz"} {
+		f.Filenames[i] = prefix + suffix
+		f.streams[i] = i
+		if err := f.open(f.Filenames[i]); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// A writer of pairs interleaved, each mate 1 followed by its mate 2, with
+// reads that have one mate among them, as bwa mem -p and the like take it.
+// It writes to one file, bgzipped if it ends in .gz, or to stdout for -.
+func NewInterleavedFastqWriter(filename string) (*FastqWriter, error) {
+	f := &FastqWriter{Filenames: [3]string{filename, filename, filename}}
+	if err := f.open(filename); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *FastqWriter) open(filename string) error {
+	fp := os.Stdout
+	if filename != "-" {
+		var err error
+		if fp, err = os.Create(filename); err != nil {
+			return err
+		}
+		f.files = append(f.files, fp)
+	}
+	if !strings.HasSuffix(filename, ".gz") {
+		f.ws = append(f.ws, newFlushCloser(nopCloser{fp}, outputBuffer))
+		return nil
+	}
+	z, err := NewBgzfWriter(fp, args.CompressionLevel, nativeThreads)
+	if err != nil {
+		return err
+	}
+	f.ws = append(f.ws, newFlushCloser(z, outputBuffer))
+	return nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// Write the primary alignments of the mates of a kept read. This does
+// nothing without -fastq-out.
+func (f *FastqWriter) WriteMates(mates ...*Mate) error {
+	if f == nil {
+		return nil
+	}
+	records := [][]string{}
+	for _, mate := range mates {
+		if mate != nil {
+			records = append(records, mate.Primary())
+		}
+	}
+	return f.Write(records...)
+}
+
+// Write a read from its mates' primary alignments, one of them a singleton
+// and two a pair.
+func (f *FastqWriter) Write(records ...[]string) error {
+	if f == nil {
+		return nil
+	}
+	switch len(records) {
+	case 1:
+		f.Singletons++
+		return writeFastq(f.ws[f.streams[2]], records[0])
+	case 2:
+		if flag, err := recordFlag(records[0]); err != nil {
+			return err
+		} else if flag&FlagRead2 != 0 {
+			records[0], records[1] = records[1], records[0]
+		}
+		f.Pairs++
+		if err := writeFastq(f.ws[f.streams[0]], records[0]); err != nil {
+			return err
+		}
+		return writeFastq(f.ws[f.streams[1]], records[1])
+	}
+	return fmt.Errorf("can't write a read of %d mates as FASTQ", len(records))
+}
+
+// Write an alignment's read as it was sequenced, undoing the reverse
+// complementing of reads aligned to the reverse strand. Missing base
+// qualities are written as 1, as samtools fastq does.
+func writeFastq(w io.Writer, record []string) error {
+	if len(record) < 11 {
+		return fmt.Errorf("too few fields")
+	}
+	flag, err := recordFlag(record)
+	if err != nil {
+		return err
+	}
+	seq, qual := record[9], record[10]
+	if seq == "*" {
+		return fmt.Errorf("read %s has no sequence to write as FASTQ", record[0])
+	}
+	entry := make([]byte, 0, len(record[0])+2*len(seq)+6)
+	entry = append(entry, '@')
+	entry = append(entry, record[0]...)
+	entry = append(entry, '\n')
+	reverse := flag&FlagReverse != 0
+	for i := range seq {
+		if reverse {
+			entry = append(entry, complement(seq[len(seq)-1-i]))
+		} else {
+			entry = append(entry, seq[i])
+		}
+	}
+	entry = append(entry, "\n+\n"...)
+	for i := range seq {
+		switch {
+		case qual == "*":
+			entry = append(entry, '"')
+		case reverse:
+			entry = append(entry, qual[len(qual)-1-i])
+		default:
+			entry = append(entry, qual[i])
+		}
+	}
+	entry = append(entry, '\n')
+	_, err = w.Write(entry)
+	return err
+}
+
+func complement(base byte) byte {
+	switch base {
+	case 'A':
+		return 'T'
+	case 'C':
+		return 'G'
+	case 'G':
+		return 'C'
+	case 'T':
+		return 'A'
+	case 'a':
+		return 't'
+	case 'c':
+		return 'g'
+	case 'g':
+		return 'c'
+	case 't':
+		return 'a'
+	}
+	return base
+}
+
+func (f *FastqWriter) Close() error {
+	for _, w := range f.ws {
+		if err := w.Close(); err != nil {
+			return err
+		}
+	}
+	for _, fp := range f.files {
+		if err := fp.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
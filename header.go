@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// The ordering fields of a SAM header's @HD line.
+type HeaderOrder struct {
+	SortOrder  string // SO: unknown, unsorted, queryname or coordinate
+	GroupOrder string // GO: none, query or reference
+	SubSort    string // SS: e.g. queryname:natural
+}
+
+func ParseHeaderOrder(header string) HeaderOrder {
+	order := HeaderOrder{}
+	for _, line := range strings.Split(header, "\n") {
+		if !strings.HasPrefix(line, "@HD\t") {
+			continue
+		}
+		for _, field := range strings.Split(line, "\t")[1:] {
+			switch {
+			case strings.HasPrefix(field, "SO:"):
+				order.SortOrder = field[3:]
+			case strings.HasPrefix(field, "GO:"):
+				order.GroupOrder = field[3:]
+			case strings.HasPrefix(field, "SS:"):
+				order.SubSort = field[3:]
+			}
+		}
+		break
+	}
+	return order
+}
+
+func (o HeaderOrder) NameSorted() bool {
+	return o.SortOrder == "queryname"
+}
+
+// The read name ordering the SS field declares, natural or lexicographic, or ""
+// when it doesn't say.
+func (o HeaderOrder) NameOrder() string {
+	if !o.NameSorted() || !strings.HasPrefix(o.SubSort, "queryname:") {
+		return ""
+	}
+	switch sub := o.SubSort[len("queryname:"):]; {
+	case strings.HasPrefix(sub, "natural"):
+		return "natural"
+	case strings.HasPrefix(sub, "lexicographic"):
+		return "lexicographic"
+	}
+	return ""
+}
+
+// Explain why a file can't be streamed as is, or return "" when the header
+// gives no reason to think it isn't sorted by name.
+func (o HeaderOrder) Problem() string {
+	switch o.SortOrder {
+	case "queryname":
+		return ""
+	case "coordinate":
+		return "is coordinate-sorted (@HD SO:coordinate)"
+	case "unsorted":
+		if o.GroupOrder == "query" {
+			return "is grouped but not sorted by read name (@HD SO:unsorted GO:query)"
+		}
+		return "is unsorted (@HD SO:unsorted)"
+	}
+	return ""
+}
+
+// Check the @HD line of an input before we start streaming it. Returns whether
+// the input needs to go through samtools sort -n, or an error when it's clearly
+// not sorted by name and sorting it wasn't requested.
+func CheckSortOrder(bamfile, header string, autoSort bool) (bool, error) {
+	order := ParseHeaderOrder(header)
+	if order.NameSorted() {
+		return false, nil
+	}
+	if autoSort {
+		return true, nil
+	}
+	if problem := order.Problem(); problem != "" {
+		return false, fmt.Errorf("%s %s; name-sort it with samtools sort -n or use -auto-sort", bamfile, problem)
+	}
+	return false, nil
+}
+
+// Rewrite the SO field of the @HD line, adding an @HD line if there is none.
+func SetSortOrder(header, order string) string {
+	lines := strings.Split(header, "\n")
+	for i, line := range lines {
+		if !strings.HasPrefix(line, "@HD\t") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		found := false
+		for j, field := range fields {
+			if strings.HasPrefix(field, "SO:") {
+				fields[j] = "SO:" + order
+				found = true
+			}
+		}
+		if !found {
+			fields = append(fields, "SO:"+order)
+		}
+		lines[i] = strings.Join(fields, "\t")
+		return strings.Join(lines, "\n")
+	}
+	return "@HD\tVN:1.6\tSO:" + order + "\n" + header
+}
+
+// Append an @PG line recording this run, chained to the last program already
+// in the header and with an ID that doesn't clash with any of them.
+func AddProgramLine(header string, commandLine []string) string {
+	ids := map[string]bool{}
+	last := ""
+	for _, line := range strings.Split(header, "\n") {
+		if !strings.HasPrefix(line, "@PG\t") {
+			continue
+		}
+		for _, field := range strings.Split(line, "\t")[1:] {
+			if strings.HasPrefix(field, "ID:") {
+				ids[field[3:]] = true
+				last = field[3:]
+			}
+		}
+	}
+	id := "contfilter"
+	for n := 1; ids[id]; n++ {
+		id = fmt.Sprintf("contfilter.%d", n)
+	}
+	fields := []string{"@PG", "ID:" + id, "PN:contfilter"}
+	if last != "" {
+		fields = append(fields, "PP:"+last)
+	}
+	// Tabs and newlines would break the header.
+	cl := strings.Join(commandLine, " ")
+	cl = strings.NewReplacer("\t", " ", "\n", " ").Replace(cl)
+	fields = append(fields, "VN:"+Version, "CL:"+cl)
+	if header != "" && !strings.HasSuffix(header, "\n") {
+		header += "\n"
+	}
+	return header + strings.Join(fields, "\t") + "\n"
+}
+
+// The header for -reheader: the @ lines of a SAM file, or the header of a BAM
+// or CRAM file.
+func ReadHeaderFile(filename string) (string, error) {
+	if strings.HasSuffix(filename, ".bam") || strings.HasSuffix(filename, ".cram") {
+		return ReadBamHeader(filename)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	lines := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "@") {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) == 0 {
+		return "", fmt.Errorf("no header lines in %s", filename)
+	}
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// Pick the header lines to write for -keep-header and -drop-header. With keep
+// patterns only the @HD line and lines matching one of them are kept. Lines
+// matching a drop pattern go either way.
+func FilterHeader(header string, keep, drop []string) string {
+	matches := func(patterns []string, line string) bool {
+		for _, p := range patterns {
+			if regexp.MustCompile(p).MatchString(line) {
+				return true
+			}
+		}
+		return false
+	}
+	lines := []string{}
+	for _, line := range strings.Split(strings.TrimSuffix(header, "\n"), "\n") {
+		if len(keep) > 0 && !strings.HasPrefix(line, "@HD\t") && !matches(keep, line) {
+			continue
+		}
+		if matches(drop, line) {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// Drop the @SQ lines of sequences whose names match, for -drop-excluded-sq.
+// Returns the names dropped.
+func DropSequences(header string, re *regexp.Regexp) (string, []string) {
+	lines := []string{}
+	dropped := []string{}
+	for _, line := range strings.Split(strings.TrimSuffix(header, "\n"), "\n") {
+		if strings.HasPrefix(line, "@SQ\t") {
+			name := ""
+			for _, field := range strings.Split(line, "\t")[1:] {
+				if strings.HasPrefix(field, "SN:") {
+					name = field[3:]
+				}
+			}
+			if re.MatchString(name) {
+				dropped = append(dropped, name)
+				continue
+			}
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n") + "\n", dropped
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+)
+
+// Counts of the compared reads by how much better they score in the sample
+// than in the best scoring contamination mapping, for -score-histogram.
+type ScoreHistogram struct {
+	Width     float64
+	NotFound  int // reads with no usable contamination alignment
+	reads     map[int]int
+	rejected  map[int]int
+	ambiguous map[int]int
+}
+
+func NewScoreHistogram(width float64) *ScoreHistogram {
+	return &ScoreHistogram{Width: width, reads: make(map[int]int), rejected: make(map[int]int), ambiguous: make(map[int]int)}
+}
+
+// Count a read, with an infinite difference when it wasn't found. This does
+// nothing without -score-histogram.
+func (h *ScoreHistogram) Add(diff float64, rejected, ambiguous bool) {
+	if h == nil {
+		return
+	}
+	if math.IsInf(diff, 1) {
+		h.NotFound++
+		return
+	}
+	bin := int(math.Floor(diff / h.Width))
+	h.reads[bin]++
+	if rejected {
+		h.rejected[bin]++
+	}
+	if ambiguous {
+		h.ambiguous[bin]++
+	}
+}
+
+// How many reads fall within a bin's width either side of the margin.
+func (h *ScoreHistogram) Borderline(margin float64) int {
+	n := 0
+	for bin, count := range h.reads {
+		low := float64(bin) * h.Width
+		if low+h.Width > margin-h.Width && low < margin+h.Width {
+			n += count
+		}
+	}
+	return n
+}
+
+// Write a row per bin from the lowest to the highest difference, empty ones
+// included, and a last one with NA bounds for the reads not found.
+func (h *ScoreHistogram) Write(filename string) error {
+	bins := []int{}
+	for bin := range h.reads {
+		bins = append(bins, bin)
+	}
+	sort.Ints(bins)
+	fp, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(fp)
+	fmt.Fprintln(w, "low\thigh\treads\trejected\tambiguous")
+	if len(bins) > 0 {
+		for bin := bins[0]; bin <= bins[len(bins)-1]; bin++ {
+			low := float64(bin) * h.Width
+			fmt.Fprintf(w, "%g\t%g\t%d\t%d\t%d\n", low, low+h.Width, h.reads[bin], h.rejected[bin], h.ambiguous[bin])
+		}
+	}
+	fmt.Fprintf(w, "NA\tNA\t%d\t0\t0\n", h.NotFound)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return fp.Close()
+}
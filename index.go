@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A read name index of a contamination BAM, written by `contfilter index`. It
+// holds the header and every mapped record, so all the scoring options still
+// apply when reading from it, followed by a table of (name hash, offset,
+// length) for each record sorted by hash and a fixed size trailer:
+//
+//	header | records | table | header length, table offset, count, flags, magic
+//
+// The filter looks reads up in it directly rather than streaming the BAM in
+// step with the sample, so the BAM needn't be sorted by name. Indexes from
+// before the flags (CFIDX001) are read as having none set.
+const (
+	indexMagic   = "CFIDX002"
+	indexMagicV1 = "CFIDX001"
+)
+
+const (
+	indexEntrySize     = 20
+	indexTrailerSize   = 40
+	indexTrailerSizeV1 = 32
+)
+
+// Index flags: the names were hashed as -normalize-names has them.
+const indexNormalizedNames = 1
+
+type indexEntry struct {
+	Hash   uint64
+	Offset uint64
+	Length uint32
+}
+
+func nameHash(name string) uint64 {
+	h := fnv.New64a()
+	io.WriteString(h, name)
+	return h.Sum64()
+}
+
+// Where the index of a BAM file goes by default.
+func IndexFilename(bamfile string) string {
+	return bamfile + ".cfi"
+}
+
+// Write the index under a temporary name beside where it goes, and only move
+// it into place once it's whole, so a failed or killed run never leaves a
+// truncated index newer than the BAM for later runs to trip over.
+func WriteIndex(bamfile, indexfile string) (int, error) {
+	fp, err := os.CreateTemp(filepath.Dir(indexfile), filepath.Base(indexfile)+".*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	n, err := writeIndex(bamfile, fp)
+	if err == nil {
+		err = fp.Close()
+	}
+	if err == nil {
+		err = os.Rename(fp.Name(), indexfile)
+	}
+	if err != nil {
+		fp.Close()
+		os.Remove(fp.Name())
+		return 0, err
+	}
+	return n, nil
+}
+
+func writeIndex(bamfile string, fp *os.File) (int, error) {
+	w := bufio.NewWriter(fp)
+
+	header, err := ReadBamHeader(bamfile)
+	if err != nil {
+		return 0, err
+	}
+	w.WriteString(header)
+	offset := uint64(len(header))
+
+	cmd := openView(bamfile)
+	input, err := cmd.StdoutPipe()
+	if err != nil {
+		return 0, fmt.Errorf("failed creating pipe: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("command failed to start: %v", err)
+	}
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 64*1024), maxRecordSize)
+	entries := []indexEntry{}
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '@' {
+			continue
+		}
+		record := strings.SplitN(line, "\t", 3)
+		flag, err := recordFlag(record)
+		if err != nil {
+			cmd.Wait()
+			return 0, fmt.Errorf("%s: %v", bamfile, err)
+		}
+		if flag&FlagUnmapped != 0 {
+			continue
+		}
+		name := record[0]
+		if normalizeNames {
+			name = NormalizeName(name)
+		}
+		entries = append(entries, indexEntry{nameHash(name), offset, uint32(len(line))})
+		w.WriteString(line)
+		w.WriteByte('\n')
+		offset += uint64(len(line)) + 1
+	}
+	if err := scanner.Err(); err != nil {
+		cmd.Wait()
+		return 0, scanError(bamfile, err)
+	}
+	if err := cmd.Wait(); err != nil {
+		return 0, fmt.Errorf("samtools view %s failed: %v", bamfile, err)
+	}
+
+	// Stable so a read's records come back in the order they were in the BAM.
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Hash < entries[j].Hash
+	})
+	for _, e := range entries {
+		if err := binary.Write(w, binary.LittleEndian, e); err != nil {
+			return 0, err
+		}
+	}
+	var flags uint64
+	if normalizeNames {
+		flags |= indexNormalizedNames
+	}
+	trailer := []uint64{uint64(len(header)), offset, uint64(len(entries)), flags}
+	if err := binary.Write(w, binary.LittleEndian, trailer); err != nil {
+		return 0, err
+	}
+	w.WriteString(indexMagic)
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+	return len(entries), nil
+}
+
+type IndexReader struct {
+	Filename    string
+	Header      string
+	fp          *os.File
+	tableOffset int64
+	count       int
+}
+
+func OpenIndex(indexfile string) (*IndexReader, error) {
+	fp, err := os.Open(indexfile)
+	if err != nil {
+		return nil, err
+	}
+	info, err := fp.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < indexTrailerSizeV1 {
+		return nil, fmt.Errorf("%s is not a contfilter index", indexfile)
+	}
+	magic := make([]byte, len(indexMagic))
+	if _, err := fp.ReadAt(magic, info.Size()-int64(len(magic))); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", indexfile, err)
+	}
+	size := int64(indexTrailerSize)
+	switch {
+	case string(magic) == indexMagicV1:
+		size = indexTrailerSizeV1
+	case string(magic) != indexMagic || info.Size() < indexTrailerSize:
+		return nil, fmt.Errorf("%s is not a contfilter index", indexfile)
+	}
+	trailer := make([]byte, size)
+	if _, err := fp.ReadAt(trailer, info.Size()-size); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", indexfile, err)
+	}
+	var flags uint64
+	if size == indexTrailerSize {
+		flags = binary.LittleEndian.Uint64(trailer[24:])
+	}
+	normalized := flags&indexNormalizedNames != 0
+	if normalized && !normalizeNames {
+		return nil, fmt.Errorf("%s was indexed with -normalize-names, so filter with -normalize-names or re-index without it", indexfile)
+	} else if !normalized && normalizeNames {
+		return nil, fmt.Errorf("%s was indexed without -normalize-names, so re-index it with contfilter index -normalize-names", indexfile)
+	}
+	headerLen := binary.LittleEndian.Uint64(trailer[0:])
+	header := make([]byte, headerLen)
+	if _, err := fp.ReadAt(header, 0); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", indexfile, err)
+	}
+	return &IndexReader{
+		Filename:    indexfile,
+		Header:      string(header),
+		fp:          fp,
+		tableOffset: int64(binary.LittleEndian.Uint64(trailer[8:])),
+		count:       int(binary.LittleEndian.Uint64(trailer[16:])),
+	}, nil
+}
+
+func (r *IndexReader) entry(i int) (indexEntry, error) {
+	buf := make([]byte, indexEntrySize)
+	if _, err := r.fp.ReadAt(buf, r.tableOffset+int64(i)*indexEntrySize); err != nil {
+		return indexEntry{}, fmt.Errorf("failed to read %s: %v", r.Filename, err)
+	}
+	return indexEntry{
+		Hash:   binary.LittleEndian.Uint64(buf[0:]),
+		Offset: binary.LittleEndian.Uint64(buf[8:]),
+		Length: binary.LittleEndian.Uint32(buf[16:]),
+	}, nil
+}
+
+// All the mapped records for a read, by binary search of the table.
+func (r *IndexReader) Lookup(read string) ([][]string, error) {
+	hash := nameHash(read)
+	var err error
+	i := sort.Search(r.count, func(i int) bool {
+		e, lookupErr := r.entry(i)
+		if lookupErr != nil {
+			err = lookupErr
+			return true
+		}
+		return e.Hash >= hash
+	})
+	if err != nil {
+		return nil, err
+	}
+	records := [][]string{}
+	for ; i < r.count; i++ {
+		e, err := r.entry(i)
+		if err != nil {
+			return nil, err
+		}
+		if e.Hash != hash {
+			break
+		}
+		line := make([]byte, e.Length)
+		if _, err := r.fp.ReadAt(line, int64(e.Offset)); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", r.Filename, err)
+		}
+		record := strings.Split(string(line), "\t")
+		if normalizeNames {
+			record[0] = NormalizeName(record[0])
+		}
+		// Different names can share a hash.
+		if record[0] == read {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// Open the index of a contamination BAM when there is one, warning about and
+// ignoring one that's older than the BAM. The index is the BAM's name plus
+// .cfi unless given (by the index= setting), when it must be there unless
+// -auto-index is to write it.
+func FindIndex(bamfile, indexfile string) (*IndexReader, error) {
+	given := indexfile != ""
+	if !given {
+		indexfile = IndexFilename(bamfile)
+	}
+	indexInfo, err := os.Stat(indexfile)
+	if err != nil {
+		if given && !args.AutoIndex {
+			return nil, err
+		}
+		return nil, nil
+	}
+	if bamInfo, err := os.Stat(bamfile); err == nil && bamInfo.ModTime().After(indexInfo.ModTime()) {
+		logger.Warnf("ignoring %s, which is older than %s\n", indexfile, bamfile)
+		return nil, nil
+	}
+	return OpenIndex(indexfile)
+}
+
+// With -auto-index, index a contamination BAM that isn't sorted by name (as it
+// would be coordinate-sorted straight out of an aligner) so it needn't be. The
+// index is left next to the BAM (or where index= says) for the next run to use.
+func AutoIndex(bamfile, indexfile string) (*IndexReader, error) {
+	header, err := ReadBamHeader(bamfile)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", bamfile, err)
+	}
+	needsSort, err := CheckSortOrder(bamfile, header, true)
+	if err != nil || !needsSort {
+		return nil, err
+	}
+	if indexfile == "" {
+		indexfile = IndexFilename(bamfile)
+	}
+	logger.Printf("%s is not sorted by name, indexing it in %s\n", bamfile, indexfile)
+	n, err := WriteIndex(bamfile, indexfile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to index %s: %v", bamfile, err)
+	}
+	logger.Printf("indexed %d records of %s\n", n, bamfile)
+	return OpenIndex(indexfile)
+}
+
+// contfilter index [-o out.cfi] [-normalize-names] cont.bam
+func indexMain(argv []string) {
+	flags := flag.NewFlagSet("index", flag.ExitOnError)
+	output := flags.String("o", "", "write the index here (default the BAM file name plus .cfi), for the filter to find with cont.bam:index=out.cfi")
+	flags.BoolVar(&normalizeNames, "normalize-names", false, "index reads by name without any /1 or /2 suffix or comment, for filtering with -normalize-names")
+	flags.Usage = func() {
+		log.Println("usage: contfilter index [-o out.cfi] [-normalize-names] cont.bam")
+		flags.PrintDefaults()
+	}
+	flags.Parse(argv)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	bamfile := flags.Arg(0)
+	if *output == "" {
+		*output = IndexFilename(bamfile)
+	}
+	// Records can be as long as with -long-read.
+	maxRecordSize = 256 * 1024 * 1024
+	n, err := WriteIndex(bamfile, *output)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("indexed %d records of %s in %s\n", n, bamfile, *output)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Read natively, so the tests don't depend on samtools.
+func useNative(t *testing.T) {
+	saved := forceNative
+	forceNative = true
+	t.Cleanup(func() { forceNative = saved })
+}
+
+func TestIndexRoundTrip(t *testing.T) {
+	useNative(t)
+	dir := t.TempDir()
+	bamfile := filepath.Join(dir, "cont.bam")
+	if err := os.WriteFile(bamfile, encodeTestBAM(t, testSAMHeader+testSAMRecords, 1), 0666); err != nil {
+		t.Fatal(err)
+	}
+	indexfile := IndexFilename(bamfile)
+	n, err := WriteIndex(bamfile, indexfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// All but the unmapped read4 and read2's unmapped mate.
+	if n != 4 {
+		t.Errorf("indexed %d records, want 4", n)
+	}
+	if leftover, _ := filepath.Glob(indexfile + ".*.tmp"); len(leftover) > 0 {
+		t.Errorf("left behind %v", leftover)
+	}
+	index, err := OpenIndex(indexfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index.Header != testSAMHeader {
+		t.Errorf("header %q, want %q", index.Header, testSAMHeader)
+	}
+	for _, test := range []struct {
+		read  string
+		flags []string
+	}{
+		{"read1", []string{"99", "147"}},
+		{"read2", []string{"73"}},
+		{"read3", []string{"65"}},
+		{"read4", nil},
+		{"read5", nil},
+	} {
+		records, err := index.Lookup(test.read)
+		if err != nil {
+			t.Fatal(err)
+		}
+		flags := []string{}
+		for _, record := range records {
+			if record[0] != test.read {
+				t.Errorf("looking up %s gave a record of %s", test.read, record[0])
+			}
+			flags = append(flags, record[1])
+		}
+		if strings.Join(flags, ",") != strings.Join(test.flags, ",") {
+			t.Errorf("%s has records with flags %v, want %v", test.read, flags, test.flags)
+		}
+	}
+}
+
+// Write an index by hand, with each record under the hash given for it
+// rather than that of its name.
+func writeTestIndex(t *testing.T, filename, header string, records []string, hashes []uint64) {
+	t.Helper()
+	var b bytes.Buffer
+	b.WriteString(header)
+	entries := []indexEntry{}
+	for i, record := range records {
+		entries = append(entries, indexEntry{hashes[i], uint64(b.Len()), uint32(len(record))})
+		b.WriteString(record + "\n")
+	}
+	table := uint64(b.Len())
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Hash < entries[j].Hash })
+	for _, e := range entries {
+		binary.Write(&b, binary.LittleEndian, e)
+	}
+	binary.Write(&b, binary.LittleEndian, []uint64{uint64(len(header)), table, uint64(len(entries)), 0})
+	b.WriteString(indexMagic)
+	if err := os.WriteFile(filename, b.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Reads whose names share a hash are told apart by name, however their
+// records are interleaved in the table.
+func TestIndexLookupCollision(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "collide.cfi")
+	records := []string{
+		"other\t0\tchr1\t1\t60\t4M\t*\t0\t0\tACGT\tIIII",
+		"readA\t99\tchr1\t100\t60\t4M\t=\t200\t104\tACGT\tIIII",
+		"other\t16\tchr1\t5\t60\t4M\t*\t0\t0\tACGT\tIIII",
+		"readA\t147\tchr1\t200\t60\t4M\t=\t100\t-104\tACGT\tIIII",
+		"readB\t0\tchr1\t300\t60\t4M\t*\t0\t0\tACGT\tIIII",
+	}
+	collision := nameHash("readA")
+	hashes := []uint64{collision, collision, collision, collision, nameHash("readB")}
+	writeTestIndex(t, filename, testSAMHeader, records, hashes)
+	index, err := OpenIndex(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := index.Lookup("readA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 || found[0][1] != "99" || found[1][1] != "147" {
+		t.Errorf("readA has records %v, want its two", found)
+	}
+	found, err = index.Lookup("readB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0][0] != "readB" {
+		t.Errorf("readB has records %v, want its one", found)
+	}
+}
+
+func TestOpenIndexV1(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "v1.cfi")
+	record := "readA\t0\tchr1\t1\t60\t4M\t*\t0\t0\tACGT\tIIII"
+	var b bytes.Buffer
+	b.WriteString(testSAMHeader)
+	b.WriteString(record + "\n")
+	binary.Write(&b, binary.LittleEndian, indexEntry{nameHash("readA"), uint64(len(testSAMHeader)), uint32(len(record))})
+	binary.Write(&b, binary.LittleEndian, []uint64{uint64(len(testSAMHeader)), uint64(len(testSAMHeader) + len(record) + 1), 1})
+	b.WriteString(indexMagicV1)
+	if err := os.WriteFile(filename, b.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+	index, err := OpenIndex(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found, err := index.Lookup("readA"); err != nil || len(found) != 1 {
+		t.Errorf("readA has records %v (%v), want its one", found, err)
+	}
+
+	// A version 1 index has no flags, so it can't have normalized names.
+	normalizeNames = true
+	defer func() { normalizeNames = false }()
+	if _, err := OpenIndex(filename); err == nil {
+		t.Error("opened an index without normalized names with -normalize-names")
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Kraken2's taxonomic classification of the sample's reads for -kraken, to
+// check the rejections made by alignment against. Only reads classified to
+// the -kraken-taxa are kept, which is what we compare by.
+type KrakenCheck struct {
+	contaminated map[string]bool
+	Concordance  KrakenConcordance
+}
+
+// How reads compared against the contamination were called by alignment and
+// by Kraken2.
+type KrakenConcordance struct {
+	Both          int `json:"both"`
+	AlignmentOnly int `json:"alignment_only"`
+	KrakenOnly    int `json:"kraken_only"`
+	Neither       int `json:"neither"`
+	// Kept with -kraken-require, being rejected by alignment alone.
+	Unconfirmed int `json:"kept_unconfirmed"`
+	// Called ambiguous by alignment, and so in none of the above, by whether
+	// kraken2 classified them to the contamination.
+	AmbiguousKraken  int `json:"ambiguous_kraken,omitempty"`
+	AmbiguousNeither int `json:"ambiguous_neither,omitempty"`
+}
+
+func (c *KrakenConcordance) Add(other *KrakenConcordance) {
+	c.Both += other.Both
+	c.AlignmentOnly += other.AlignmentOnly
+	c.KrakenOnly += other.KrakenOnly
+	c.Neither += other.Neither
+	c.Unconfirmed += other.Unconfirmed
+	c.AmbiguousKraken += other.AmbiguousKraken
+	c.AmbiguousNeither += other.AmbiguousNeither
+}
+
+// The taxon IDs of the contamination from a comma separated list, along with
+// all the taxa under them in a Kraken2 (or Bracken) report if one is given.
+func ReadKrakenTaxa(ids, report string) (map[string]bool, error) {
+	taxa := make(map[string]bool)
+	for _, id := range strings.Split(ids, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			taxa[id] = true
+		}
+	}
+	if report == "" {
+		return taxa, nil
+	}
+	fp, err := os.Open(report)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	// The report lists taxa depth first, with the name indented two spaces
+	// for each level. The taxa up from the current line, by how far indented
+	// and whether included.
+	type level struct {
+		indent int
+		in     bool
+	}
+	parents := []level{}
+	scanner := bufio.NewScanner(fp)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 6 {
+			return nil, fmt.Errorf("%s line %d: expected a Kraken2 report line of 6 or more fields", report, line)
+		}
+		name := fields[len(fields)-1]
+		indent := len(name) - len(strings.TrimLeft(name, " "))
+		for len(parents) > 0 && parents[len(parents)-1].indent >= indent {
+			parents = parents[:len(parents)-1]
+		}
+		id := strings.TrimSpace(fields[4])
+		in := taxa[id] || (len(parents) > 0 && parents[len(parents)-1].in)
+		if in {
+			taxa[id] = true
+		}
+		parents = append(parents, level{indent, in})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return taxa, nil
+}
+
+// Read the per-read output of kraken2 --output, a line for each read (or
+// pair) saying whether it was classified, its name and the taxon ID.
+func LoadKraken(filename string, taxa map[string]bool) (*KrakenCheck, error) {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	k := &KrakenCheck{contaminated: make(map[string]bool)}
+	scanner := bufio.NewScanner(fp)
+	scanner.Buffer(make([]byte, 64*1024), maxRecordSize)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.SplitN(scanner.Text(), "\t", 4)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("%s line %d: expected a Kraken2 classification", filename, line)
+		}
+		if fields[0] != "C" {
+			continue
+		}
+		// With --use-names the ID is given as "Name (taxid 9606)".
+		id := fields[2]
+		if i := strings.LastIndex(id, "(taxid "); i >= 0 {
+			id = strings.TrimSuffix(id[i+len("(taxid "):], ")")
+		}
+		if taxa[id] {
+			read := strings.TrimSuffix(strings.TrimSuffix(fields[1], "/1"), "/2")
+			if normalizeNames {
+				read = NormalizeName(fields[1])
+			}
+			k.contaminated[read] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Whether Kraken2 classified a read to the contamination. This is false
+// without -kraken.
+func (k *KrakenCheck) Contaminated(read string) bool {
+	if k == nil {
+		return false
+	}
+	return k.contaminated[read]
+}
+
+// Count a compared read by whether alignment rejected it. This does nothing
+// without -kraken.
+func (k *KrakenCheck) Add(read string, rejected, ambiguous bool) {
+	if k == nil {
+		return
+	}
+	switch kraken := k.contaminated[read]; {
+	case ambiguous && kraken:
+		k.Concordance.AmbiguousKraken++
+	case ambiguous:
+		k.Concordance.AmbiguousNeither++
+	case rejected && kraken:
+		k.Concordance.Both++
+	case rejected:
+		k.Concordance.AlignmentOnly++
+	case kraken:
+		k.Concordance.KrakenOnly++
+	default:
+		k.Concordance.Neither++
+	}
+}
+
+func (k *KrakenCheck) Log() {
+	c := k.Concordance
+	total := c.Both + c.AlignmentOnly + c.KrakenOnly + c.Neither
+	logger.Printf("kraken2 agreed on %d of %d reads compared (%0.2f%%): %d contaminated by both, %d by alignment only, %d by kraken2 only, %d by neither\n",
+		c.Both+c.Neither, total, percent(c.Both+c.Neither, total), c.Both, c.AlignmentOnly, c.KrakenOnly, c.Neither)
+	if c.AmbiguousKraken+c.AmbiguousNeither > 0 {
+		logger.Printf("of the %d reads called ambiguous, kraken2 classified %d to the contamination\n",
+			c.AmbiguousKraken+c.AmbiguousNeither, c.AmbiguousKraken)
+	}
+	if args.KrakenRequire {
+		logger.Printf("kept %d reads rejected by alignment that kraken2 didn't classify to the contamination\n", c.Unconfirmed)
+	}
+}
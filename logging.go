@@ -0,0 +1,160 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How much to log, from only errors up to every alignment looked at. Debug is
+// what happens to each read and trace adds the records that went into it.
+type Level int
+
+const (
+	LevelError Level = iota
+	LevelWarn
+	LevelInfo
+	LevelDebug
+	LevelTrace
+)
+
+var levelNames = []string{"error", "warn", "info", "debug", "trace"}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+func ParseLevel(name string) (Level, error) {
+	for l, n := range levelNames {
+		if n == name {
+			return Level(l), nil
+		}
+	}
+	return 0, fmt.Errorf("log level must be one of %s", strings.Join(levelNames, ", "))
+}
+
+// The log, either as plain text, which is just the messages with warnings
+// marked, or as JSON lines with a time and level on each message. Print and
+// friends log at info so it can stand in for a log.Logger. With an audit log
+// the debug and trace messages about each read go there instead.
+type Logger struct {
+	mu        sync.Mutex
+	out       io.Writer
+	level     Level
+	json      bool
+	audit     *gzip.Writer
+	auditFile *os.File
+}
+
+func NewLogger(out io.Writer, level Level, asJSON bool) *Logger {
+	return &Logger{out: out, level: level, json: asJSON}
+}
+
+// Send debug and trace messages to a gzipped file of their own.
+func (l *Logger) OpenAudit(filename string) error {
+	fp, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	l.auditFile = fp
+	l.audit = gzip.NewWriter(fp)
+	return nil
+}
+
+// Finish the audit log, if any.
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.audit == nil {
+		return nil
+	}
+	if err := l.audit.Close(); err != nil {
+		return err
+	}
+	l.audit = nil
+	return l.auditFile.Close()
+}
+
+func (l *Logger) Enabled(level Level) bool {
+	return level <= l.level
+}
+
+func (l *Logger) output(level Level, msg string) {
+	if !l.Enabled(level) {
+		return
+	}
+	msg = strings.TrimSuffix(msg, "\n")
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := l.out
+	if l.audit != nil && level >= LevelDebug {
+		out = l.audit
+	}
+	if l.json {
+		line, _ := json.Marshal(struct {
+			Time  string `json:"time"`
+			Level string `json:"level"`
+			Msg   string `json:"msg"`
+		}{time.Now().Format(time.RFC3339Nano), level.String(), msg})
+		out.Write(append(line, '\n'))
+		return
+	}
+	if level == LevelWarn {
+		msg = "warning: " + msg
+	}
+	io.WriteString(out, msg+"\n")
+}
+
+func (l *Logger) Print(v ...interface{}) {
+	l.output(LevelInfo, fmt.Sprint(v...))
+}
+
+func (l *Logger) Printf(format string, v ...interface{}) {
+	l.output(LevelInfo, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Println(v ...interface{}) {
+	l.output(LevelInfo, fmt.Sprintln(v...))
+}
+
+func (l *Logger) Errorf(format string, v ...interface{}) {
+	l.output(LevelError, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Warnf(format string, v ...interface{}) {
+	l.output(LevelWarn, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Debugf(format string, v ...interface{}) {
+	l.output(LevelDebug, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Debugln(v ...interface{}) {
+	l.output(LevelDebug, fmt.Sprintln(v...))
+}
+
+func (l *Logger) Tracef(format string, v ...interface{}) {
+	l.output(LevelTrace, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Traceln(v ...interface{}) {
+	l.output(LevelTrace, fmt.Sprintln(v...))
+}
+
+// Log an error and exit, finishing the audit log so it can still be read.
+func (l *Logger) Fatal(v ...interface{}) {
+	l.output(LevelError, fmt.Sprint(v...))
+	l.Close()
+	os.Exit(1)
+}
+
+func (l *Logger) Fatalf(format string, v ...interface{}) {
+	l.output(LevelError, fmt.Sprintf(format, v...))
+	l.Close()
+	os.Exit(1)
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// A Mate collects the alignments of one end of a read.
+type Mate struct {
+	Record        []string   // the alignment we score this mate by
+	Secondary     [][]string // its other alignments, written out along with it
+	Supplementary [][]string // chimeric pieces of the alignment, always kept with it
+	Flag          int
+	Alignment
+}
+
+// Read all the records sharing the next read name. Returns nil at the end of
+// the file.
+func (s *BamScanner) Group() ([][]string, error) {
+	record, err := s.Record()
+	if err != nil || s.Closed {
+		return nil, err
+	}
+	s.Ratchet()
+	group := [][]string{record}
+	for {
+		record, err := s.Find(record[0])
+		if err != nil {
+			return nil, err
+		}
+		if record == nil {
+			return group, nil
+		}
+		group = append(group, record)
+	}
+}
+
+// Keep only the alignments with all of the require bits and none of the
+// exclude bits set in their FLAG.
+func FilterFlags(group [][]string, require, exclude int) ([][]string, error) {
+	kept := group[:0]
+	for _, record := range group {
+		flag, err := recordFlag(record)
+		if err != nil {
+			return nil, err
+		}
+		if flag&require == require && flag&exclude == 0 {
+			kept = append(kept, record)
+		}
+	}
+	return kept, nil
+}
+
+// Sort the alignments of a read into its mates, using the READ1/READ2 flags
+// when they are set. Within each mate we score the primary alignment unless
+// -sample-alignment best asks for the best scoring one. Supplementary
+// alignments are never scored, they just follow the mate they belong to. If
+// only one mate is present it's returned as mate1.
+func PickMates(group [][]string, aligner *Aligner) (*Mate, *Mate, error) {
+	var byMate [2][][]string
+	var primaries [2]int
+	for _, record := range group {
+		flag, err := recordFlag(record)
+		if err != nil {
+			return nil, nil, err
+		}
+		primary := flag&(FlagSecondary|FlagSupplementary) == 0
+		m := 0
+		switch {
+		case flag&FlagRead2 != 0:
+			m = 1
+		case flag&FlagRead1 == 0 && primary && primaries[0] > 0:
+			// Without mate flags we take the second primary alignment as mate 2.
+			m = 1
+		}
+		if primary {
+			primaries[m]++
+		}
+		byMate[m] = append(byMate[m], record)
+	}
+	mates := []*Mate{}
+	for m := 0; m < 2; m++ {
+		if len(byMate[m]) == 0 {
+			continue
+		}
+		mate, err := pickAlignment(byMate[m], aligner)
+		if err != nil {
+			return nil, nil, err
+		}
+		mates = append(mates, mate)
+	}
+	if len(mates) == 1 {
+		return mates[0], nil, nil
+	}
+	return mates[0], mates[1], nil
+}
+
+func pickAlignment(records [][]string, aligner *Aligner) (*Mate, error) {
+	best := -1
+	var bestScore float64
+	mate := &Mate{}
+	supplementary := make([]bool, len(records))
+	for i, record := range records {
+		flag, err := recordFlag(record)
+		if err != nil {
+			return nil, err
+		}
+		if flag&FlagSupplementary != 0 {
+			supplementary[i] = true
+			continue
+		}
+		if flag&FlagUnmapped != 0 {
+			// There is nothing to score, but this may be all we have.
+			if best < 0 {
+				best = i
+			}
+			continue
+		}
+		if args.SampleAlignment == "primary" {
+			if flag&FlagSecondary == 0 && best < 0 {
+				best = i
+			}
+			continue
+		}
+		a, err := ParseAlignment(record, aligner)
+		if err != nil {
+			return nil, err
+		}
+		score := a.Score(args.Penalty)
+		if best < 0 || score > bestScore {
+			best = i
+			bestScore = score
+		}
+	}
+	if best < 0 {
+		// No primary alignment for this mate, so fall back to the first
+		// secondary one, or failing that a supplementary one.
+		best = 0
+		for i := range records {
+			if !supplementary[i] {
+				best = i
+				break
+			}
+		}
+	}
+	mate.Record = records[best]
+	for i, record := range records {
+		switch {
+		case i == best:
+		case supplementary[i]:
+			mate.Supplementary = append(mate.Supplementary, record)
+		default:
+			mate.Secondary = append(mate.Secondary, record)
+		}
+	}
+	var err error
+	if mate.Flag, err = recordFlag(mate.Record); err != nil {
+		return nil, err
+	}
+	if mate.Unmapped() {
+		return mate, nil
+	}
+	a, err := ParseAlignment(mate.Record, aligner)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %v", mate.Record[0], err)
+	}
+	mate.Alignment = *a
+	return mate, nil
+}
+
+func (m *Mate) Unmapped() bool {
+	return m.Flag&FlagUnmapped != 0
+}
+
+// Set aside the mates that didn't map, returning the mapped ones (mate1 first
+// again) and the unmapped ones.
+func SplitUnmapped(mate1, mate2 *Mate) (*Mate, *Mate, []*Mate) {
+	mapped := []*Mate{}
+	unmapped := []*Mate{}
+	for _, mate := range []*Mate{mate1, mate2} {
+		if mate == nil {
+			continue
+		}
+		if mate.Unmapped() {
+			unmapped = append(unmapped, mate)
+		} else {
+			mapped = append(mapped, mate)
+		}
+	}
+	for len(mapped) < 2 {
+		mapped = append(mapped, nil)
+	}
+	return mapped[0], mapped[1], unmapped
+}
+
+// Whether a read was sequenced as a pair, going by having both mates or by
+// the FLAG of the one it has.
+func IsPaired(mate1, mate2 *Mate) bool {
+	return mate2 != nil || mate1.Flag&FlagPaired != 0
+}
+
+// Append optional fields to all of a mate's alignments.
+func (m *Mate) AddTags(tags []string) {
+	m.Record = append(m.Record, tags...)
+	for i := range m.Secondary {
+		m.Secondary[i] = append(m.Secondary[i], tags...)
+	}
+	for i := range m.Supplementary {
+		m.Supplementary[i] = append(m.Supplementary[i], tags...)
+	}
+}
+
+// Strip the pairing information from all of a mate's alignments when it's
+// written without the other mate.
+func (m *Mate) MakeSingleton() error {
+	var err error
+	if m.Record, err = MakeSingleton(m.Record); err != nil {
+		return err
+	}
+	for _, records := range [][][]string{m.Secondary, m.Supplementary} {
+		for i := range records {
+			if records[i], err = MakeSingleton(records[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// The records of a mate to write out, and how many of them are secondary and
+// supplementary alignments written along with the one it was scored by.
+// Supplementary alignments share the fate of their primary so that chimeric
+// reads are never half filtered. With -primary-only it's just the primary
+// alignment, whichever the mate was scored by. Tags are left out as
+// -keep-tags or -strip-tags say, and FLAG bits changed as edit says.
+func (m *Mate) OutputRecords(edit FlagEdit) ([][]string, int, int, error) {
+	if args.PrimaryOnly {
+		record, err := outputRecord(m.Primary(), edit)
+		return [][]string{record}, 0, 0, err
+	}
+	records := [][]string{m.Record}
+	records = append(records, m.Supplementary...)
+	secondary := 0
+	if !args.DropSecondary {
+		records = append(records, m.Secondary...)
+		secondary = len(m.Secondary)
+	}
+	for i := range records {
+		var err error
+		if records[i], err = outputRecord(records[i], edit); err != nil {
+			return nil, 0, 0, err
+		}
+	}
+	return records, secondary, len(m.Supplementary), nil
+}
+
+func outputRecord(record []string, edit FlagEdit) ([]string, error) {
+	return EditFlag(outputTags.Apply(record), edit.Set, edit.Clear)
+}
+
+// FLAG bits to set and clear on the records written for reads with some
+// outcome: -set-flags and -clear-flags for kept reads, and
+// -ambiguous-set-flags and -ambiguous-clear-flags for ambiguous ones. Others
+// are written with the FLAGs they came with.
+type FlagEdit struct {
+	Set, Clear int
+}
+
+var keptFlags, ambiguousFlags FlagEdit
+
+// The mate's primary alignment, or the one it was scored by if it has none.
+func (m *Mate) Primary() []string {
+	if flag, err := recordFlag(m.Record); err == nil && flag&FlagSecondary == 0 {
+		return m.Record
+	}
+	for _, record := range m.Secondary {
+		if flag, err := recordFlag(record); err == nil && flag&FlagSecondary == 0 {
+			return record
+		}
+	}
+	return m.Record
+}
+
+// Write a mate's alignments to the output, returning how many secondary and
+// supplementary alignments were written along with the one it was scored by.
+func WriteMate(w io.Writer, mate *Mate, edit FlagEdit) (int, int, error) {
+	records, secondary, supplementary, err := mate.OutputRecords(edit)
+	if err != nil {
+		return 0, 0, err
+	}
+	// All of them in one write.
+	size := 0
+	for _, record := range records {
+		for _, field := range record {
+			size += len(field) + 1
+		}
+	}
+	batch := make([]byte, 0, size)
+	for _, record := range records {
+		for i, field := range record {
+			if i > 0 {
+				batch = append(batch, '\t')
+			}
+			batch = append(batch, field...)
+		}
+		batch = append(batch, '\n')
+	}
+	if _, err := w.Write(batch); err != nil {
+		return 0, 0, err
+	}
+	return secondary, supplementary, nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+)
+
+// Walk an alignment's CIGAR and MD tag together, calling fn with the query
+// position of every base aligned to the reference and whether it mismatches.
+// Returns the length of the read as sequenced, counting clipped bases.
+func walkMD(record []string, fn func(qpos int, mismatch bool)) (int, error) {
+	md, ok := findTag(record, "MD")
+	if !ok {
+		return 0, fmt.Errorf("missing MD tag")
+	}
+	// Expand MD into one entry per aligned (not deleted) reference base.
+	mismatches := []bool{}
+	n := 0
+	for i := 0; i < len(md); i++ {
+		c := md[i]
+		switch {
+		case c >= '0' && c <= '9':
+			n = n*10 + int(c-'0')
+			continue
+		case c == '^':
+			for i+1 < len(md) && (md[i+1] < '0' || md[i+1] > '9') {
+				i++
+			}
+		default:
+			for ; n > 0; n-- {
+				mismatches = append(mismatches, false)
+			}
+			mismatches = append(mismatches, true)
+			continue
+		}
+		for ; n > 0; n-- {
+			mismatches = append(mismatches, false)
+		}
+	}
+	for ; n > 0; n-- {
+		mismatches = append(mismatches, false)
+	}
+
+	ops, err := ParseCigar(record[5])
+	if err != nil {
+		return 0, err
+	}
+	qpos := 0
+	aligned := 0
+	for _, op := range ops {
+		switch op.Op {
+		case 'M', '=', 'X':
+			for i := 0; i < op.Len; i++ {
+				if aligned >= len(mismatches) {
+					return 0, fmt.Errorf("MD tag %s doesn't match CIGAR %s", md, record[5])
+				}
+				fn(qpos, mismatches[aligned])
+				qpos++
+				aligned++
+			}
+		case 'I', 'S', 'H':
+			qpos += op.Len
+		}
+	}
+	if aligned != len(mismatches) {
+		return 0, fmt.Errorf("MD tag %s doesn't match CIGAR %s", md, record[5])
+	}
+	return qpos, nil
+}
+
+// How much of an alignment's edit distance is owed to low-quality mismatches,
+// for -quality-weight: the sum over its mismatches of the probability that the
+// base call is wrong. Reads without qualities get no discount.
+func QualityDiscount(record []string) (float64, error) {
+	qual := record[10]
+	if qual == "*" {
+		return 0, nil
+	}
+	ops, err := ParseCigar(record[5])
+	if err != nil {
+		return 0, err
+	}
+	// walkMD counts hard clipped bases, which aren't in QUAL.
+	offset := 0
+	if len(ops) > 0 && ops[0].Op == 'H' {
+		offset = ops[0].Len
+	}
+	discount := 0.0
+	_, err = walkMD(record, func(qpos int, mismatch bool) {
+		i := qpos - offset
+		if !mismatch || i < 0 || i >= len(qual) {
+			return
+		}
+		discount += math.Pow(10, -float64(qual[i]-33)/10)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return discount, nil
+}
+
+// Counts of aligned bases and mismatches by sequencing cycle.
+type CycleProfile struct {
+	Aligned    []int
+	Mismatches []int
+	Mates      int
+}
+
+func (p *CycleProfile) Add(record []string, flag int) error {
+	type event struct {
+		qpos     int
+		mismatch bool
+	}
+	events := []event{}
+	length, err := walkMD(record, func(qpos int, mismatch bool) {
+		events = append(events, event{qpos, mismatch})
+	})
+	if err != nil {
+		return err
+	}
+	for len(p.Aligned) < length {
+		p.Aligned = append(p.Aligned, 0)
+		p.Mismatches = append(p.Mismatches, 0)
+	}
+	for _, e := range events {
+		// Reverse strand alignments have the read reversed relative to how it
+		// was sequenced.
+		cycle := e.qpos
+		if flag&FlagReverse != 0 {
+			cycle = length - 1 - e.qpos
+		}
+		p.Aligned[cycle]++
+		if e.mismatch {
+			p.Mismatches[cycle]++
+		}
+	}
+	p.Mates++
+	return nil
+}
+
+// Where along the reads the mismatches of kept and rejected reads fall, for
+// -mismatch-profile. Damage or adapter read-through shows up as mismatches
+// piling up at the read ends.
+type MismatchProfile struct {
+	Kept     CycleProfile
+	Rejected CycleProfile
+}
+
+func (p *MismatchProfile) Add(rejected bool, mates ...*Mate) error {
+	profile := &p.Kept
+	if rejected {
+		profile = &p.Rejected
+	}
+	for _, mate := range mates {
+		if mate == nil {
+			continue
+		}
+		if err := profile.Add(mate.Record, mate.Flag); err != nil {
+			return fmt.Errorf("read %s: %v", mate.Record[0], err)
+		}
+	}
+	return nil
+}
+
+func (p *MismatchProfile) Write(filename string) error {
+	fp, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	cycles := len(p.Kept.Aligned)
+	if len(p.Rejected.Aligned) > cycles {
+		cycles = len(p.Rejected.Aligned)
+	}
+	rate := func(profile *CycleProfile, i int) (int, int, float64) {
+		if i >= len(profile.Aligned) || profile.Aligned[i] == 0 {
+			return 0, 0, 0
+		}
+		return profile.Aligned[i], profile.Mismatches[i], float64(profile.Mismatches[i]) / float64(profile.Aligned[i])
+	}
+	fmt.Fprintf(fp, "cycle\tkept_aligned\tkept_mismatches\tkept_rate\trejected_aligned\trejected_mismatches\trejected_rate\n")
+	for i := 0; i < cycles; i++ {
+		ka, km, kr := rate(&p.Kept, i)
+		ra, rm, rr := rate(&p.Rejected, i)
+		fmt.Fprintf(fp, "%d\t%d\t%d\t%0.5f\t%d\t%d\t%0.5f\n", i+1, ka, km, kr, ra, rm, rr)
+	}
+	return fp.Close()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// A size in bytes like 512M, 8G or 8GB (powers of 1024), or a plain number
+// of bytes.
+func ParseSize(value string) (int64, error) {
+	s := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "B")
+	shift := 0
+	if n := len(s); n > 0 {
+		if i := strings.IndexByte("KMGT", s[n-1]); i >= 0 {
+			shift = 10 * (i + 1)
+			s = s[:n-1]
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("bad size %q, expected e.g. 512M or 8G", value)
+	}
+	return int64(n * float64(int64(1)<<uint(shift))), nil
+}
+
+// The share of -max-memory kept to by each user of it, or all zero without
+// it.
+type MemoryBudget struct {
+	Heap         int64 // the Go runtime's soft limit
+	SortMem      string
+	DupDecisions int   // how many duplicate decisions to hold before spilling them to disk
+	NameSet      int64 // bytes of each -prefilter exact name set before it becomes a bloom filter
+	Window       int64 // bytes of each input's -sort-window before it's cut short
+}
+
+var memoryBudget MemoryBudget
+
+// About what a duplicate decision costs in the map holding them.
+const dupDecisionSize = 48
+
+// Split -max-memory up between contfilter's own heap and the samtools sorts
+// that may be running alongside it (sorts of them), which get half between
+// them unless -sort-mem says how much, when that much is set aside for each.
+// Of the heap, a quarter each goes to the duplicate decisions, the exact name
+// sets of the conts contamination files, and the sort windows of those and
+// the sample.
+func NewMemoryBudget(limit int64, sorts, conts int, sortMem string) (MemoryBudget, error) {
+	b := MemoryBudget{Heap: limit, SortMem: sortMem}
+	if sortMem == "" && sorts > 0 {
+		b.Heap = limit / 2
+		// samtools sort goes a little over its -m.
+		perSort := limit / 2 / int64(sorts) * 4 / 5
+		if perSort < 1<<20 {
+			perSort = 1 << 20
+		}
+		b.SortMem = fmt.Sprintf("%dM", perSort>>20)
+	} else if sorts > 0 {
+		perSort, err := ParseSize(sortMem)
+		if err != nil {
+			return b, fmt.Errorf("-sort-mem: %v", err)
+		}
+		b.Heap = limit - int64(sorts)*perSort*5/4
+		if b.Heap < limit/10 {
+			return b, fmt.Errorf("%d samtools sorts with -sort-mem %s leave too little of %s for contfilter", sorts, sortMem, formatBytes(uint64(limit)))
+		}
+	}
+	b.DupDecisions = int(b.Heap / 4 / dupDecisionSize)
+	if conts > 0 {
+		b.NameSet = b.Heap / 4 / int64(conts)
+	}
+	b.Window = b.Heap / 4 / int64(1+conts)
+	return b, nil
+}
+
+// Have the garbage collector work harder to keep the heap under the budget,
+// rather than let it grow until the process is killed.
+func (b MemoryBudget) Apply() {
+	debug.SetMemoryLimit(b.Heap)
+}
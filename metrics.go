@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Counts for -metrics-addr, served in the Prometheus text format. The main
+// loop copies its counts in every so often rather than on every read.
+type Metrics struct {
+	mu            sync.Mutex
+	started       time.Time
+	contamination []string
+	reads         int
+	considered    int
+	kept          int
+	found         []int
+	rejected      []int
+}
+
+// How many reads go by between updates.
+const metricsInterval = 1000
+
+func NewMetrics(contamination []*Contaminant) *Metrics {
+	m := &Metrics{
+		started:  time.Now(),
+		found:    make([]int, len(contamination)),
+		rejected: make([]int, len(contamination)),
+	}
+	for _, cont := range contamination {
+		m.contamination = append(m.contamination, cont.Filename)
+	}
+	return m
+}
+
+// Start serving /metrics on addr, e.g. :9090, in the background.
+func (m *Metrics) Serve(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for metrics on %s: %v", addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	go http.Serve(listener, mux)
+	return nil
+}
+
+func (m *Metrics) Update(reads, considered, kept int, found, rejected []int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reads = reads
+	m.considered = considered
+	m.kept = kept
+	copy(m.found, found)
+	copy(m.rejected, rejected)
+}
+
+// Escape a label value.
+func promLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP contfilter_info The version of contfilter and the sample being filtered.")
+	fmt.Fprintln(w, "# TYPE contfilter_info gauge")
+	fmt.Fprintf(w, "contfilter_info{version=\"%s\",sample=\"%s\"} 1\n", promLabel(Version), promLabel(sampleName()))
+
+	counter := func(name, help string, value int) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+	}
+	counter("contfilter_reads_total", "Sample reads processed.", m.reads)
+	counter("contfilter_reads_considered_total", "Sample reads left after preliminary filtering.", m.considered)
+	counter("contfilter_reads_kept_total", "Sample reads kept.", m.kept)
+
+	perContaminant := func(name, help string, values []int) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		for c, cont := range m.contamination {
+			fmt.Fprintf(w, "%s{contaminant=\"%s\"} %d\n", name, promLabel(cont), values[c])
+		}
+	}
+	perContaminant("contfilter_reads_found_total", "Considered reads found in each contamination mapping.", m.found)
+	perContaminant("contfilter_reads_rejected_total", "Considered reads rejected by each contamination mapping.", m.rejected)
+
+	elapsed := time.Since(m.started).Seconds()
+	fmt.Fprintln(w, "# HELP contfilter_reads_per_second Sample reads processed per second since the start.")
+	fmt.Fprintln(w, "# TYPE contfilter_reads_per_second gauge")
+	fmt.Fprintf(w, "contfilter_reads_per_second %g\n", float64(m.reads)/elapsed)
+}
@@ -0,0 +1,992 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Reading and writing BAM in Go rather than through samtools, for -native or
+// when samtools isn't installed, as on Windows or in a bare container. Sorting
+// and indexing still take samtools.
+
+// Whether to read and write BAM natively, set by -native.
+var forceNative = false
+
+var nativeOnce sync.Once
+var nativeFound bool
+
+func nativeIO() bool {
+	nativeOnce.Do(func() {
+		_, err := exec.LookPath(samtoolsPath)
+		nativeFound = err != nil
+	})
+	return forceNative || nativeFound
+}
+
+func needsSamtools(what string) error {
+	return fmt.Errorf("%s takes samtools, which isn't being used (see -native)", what)
+}
+
+// Open a SAM view of a BAM (or SAM, or gzipped SAM) stream: the header if
+// header is set, then each record, as samtools view would give them.
+func openNativeView(r io.Reader, header bool) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		w := bufio.NewWriterSize(pw, 256*1024)
+		err := DecodeSAM(r, w, header, true)
+		if err == nil {
+			err = w.Flush()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// Write the SAM text of a BAM stream, with the header if header is set and
+// the records if records is. Input that isn't BAM is taken to be SAM, gzipped
+// or not, and passed through.
+func DecodeSAM(r io.Reader, w io.Writer, header, records bool) error {
+	br := bufio.NewReaderSize(r, 256*1024)
+	magic, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if len(magic) < 2 || magic[0] != 0x1f || magic[1] != 0x8b {
+		return copySAM(br, w, header, records)
+	}
+	gz, err := openGunzip(br)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	in := bufio.NewReaderSize(gz, 256*1024)
+	if magic, err := in.Peek(4); err != nil || string(magic) != "BAM\x01" {
+		return copySAM(in, w, header, records)
+	}
+	in.Discard(4)
+	text, refs, err := readBamHeader(in)
+	if err != nil {
+		return err
+	}
+	if header {
+		if _, err := io.WriteString(w, text); err != nil {
+			return err
+		}
+	}
+	if !records {
+		return nil
+	}
+	var block []byte
+	line := []byte{}
+	for {
+		var size int32
+		if err := binary.Read(in, binary.LittleEndian, &size); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("truncated BAM record: %v", err)
+		}
+		if size < 32 {
+			return fmt.Errorf("bad BAM record size %d", size)
+		}
+		if cap(block) < int(size) {
+			block = make([]byte, size)
+		}
+		block = block[:size]
+		if _, err := io.ReadFull(in, block); err != nil {
+			return fmt.Errorf("truncated BAM record: %v", err)
+		}
+		line, err = appendSAMRecord(line[:0], block, refs)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(line); err != nil {
+			return err
+		}
+	}
+}
+
+// Pass SAM text through, leaving out the header or records as asked.
+func copySAM(r *bufio.Reader, w io.Writer, header, records bool) error {
+	if header && records {
+		_, err := io.Copy(w, r)
+		return err
+	}
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			if line[0] != '@' && !records {
+				return nil
+			}
+			if (line[0] == '@') == header || (line[0] != '@' && records) {
+				if _, err := w.Write(line); err != nil {
+					return err
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// Read the BAM header after the magic: its text, and the reference names,
+// which records refer to by number.
+func readBamHeader(r io.Reader) (string, []string, error) {
+	var n int32
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return "", nil, fmt.Errorf("truncated BAM header: %v", err)
+	}
+	text := make([]byte, n)
+	if _, err := io.ReadFull(r, text); err != nil {
+		return "", nil, fmt.Errorf("truncated BAM header: %v", err)
+	}
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return "", nil, fmt.Errorf("truncated BAM header: %v", err)
+	}
+	refs := make([]string, n)
+	for i := range refs {
+		var length int32
+		if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+			return "", nil, fmt.Errorf("truncated BAM header: %v", err)
+		}
+		name := make([]byte, length+4)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", nil, fmt.Errorf("truncated BAM header: %v", err)
+		}
+		refs[i] = strings.TrimRight(string(name[:length]), "\x00")
+	}
+	// The text may be padded with NULs, and samtools adds the missing newline.
+	s := strings.TrimRight(string(text), "\x00")
+	if s != "" && !strings.HasSuffix(s, "\n") {
+		s += "\n"
+	}
+	return s, refs, nil
+}
+
+const cigarOps = "MIDNSHP=X"
+const seqBases = "=ACMGRSVTWYHKDBN"
+
+// Append the SAM line of a BAM record (without its block size).
+func appendSAMRecord(line, b []byte, refs []string) ([]byte, error) {
+	le := binary.LittleEndian
+	ref := func(id int32) (string, error) {
+		if id < 0 {
+			return "*", nil
+		}
+		if int(id) >= len(refs) {
+			return "", fmt.Errorf("BAM record refers to reference %d of %d", id, len(refs))
+		}
+		return refs[id], nil
+	}
+	refID := int32(le.Uint32(b[0:]))
+	pos := int32(le.Uint32(b[4:]))
+	nameLen := int(b[8])
+	mapq := b[9]
+	nCigar := int(le.Uint16(b[12:]))
+	flag := le.Uint16(b[14:])
+	seqLen := int(int32(le.Uint32(b[16:])))
+	nextRefID := int32(le.Uint32(b[20:]))
+	nextPos := int32(le.Uint32(b[24:]))
+	tlen := int32(le.Uint32(b[28:]))
+	p := 32
+	if p+nameLen+nCigar*4+(seqLen+1)/2+seqLen > len(b) {
+		return nil, fmt.Errorf("BAM record shorter than its fields")
+	}
+	line = append(line, bytes.TrimRight(b[p:p+nameLen], "\x00")...)
+	p += nameLen
+	line = append(line, '\t')
+	line = strconv.AppendUint(line, uint64(flag), 10)
+	rname, err := ref(refID)
+	if err != nil {
+		return nil, err
+	}
+	line = append(append(line, '\t'), rname...)
+	line = append(line, '\t')
+	line = strconv.AppendInt(line, int64(pos)+1, 10)
+	line = append(line, '\t')
+	line = strconv.AppendUint(line, uint64(mapq), 10)
+	line = append(line, '\t')
+	if nCigar == 0 {
+		line = append(line, '*')
+	}
+	for i := 0; i < nCigar; i++ {
+		op := le.Uint32(b[p:])
+		p += 4
+		if int(op&0xf) >= len(cigarOps) {
+			return nil, fmt.Errorf("bad CIGAR operation %d", op&0xf)
+		}
+		line = strconv.AppendUint(line, uint64(op>>4), 10)
+		line = append(line, cigarOps[op&0xf])
+	}
+	line = append(line, '\t')
+	switch {
+	case nextRefID < 0:
+		line = append(line, '*')
+	case nextRefID == refID:
+		line = append(line, '=')
+	default:
+		rnext, err := ref(nextRefID)
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, rnext...)
+	}
+	line = append(line, '\t')
+	line = strconv.AppendInt(line, int64(nextPos)+1, 10)
+	line = append(line, '\t')
+	line = strconv.AppendInt(line, int64(tlen), 10)
+	line = append(line, '\t')
+	if seqLen == 0 {
+		line = append(line, '*')
+	}
+	for i := 0; i < seqLen; i++ {
+		packed := b[p+i/2]
+		if i%2 == 0 {
+			packed >>= 4
+		}
+		line = append(line, seqBases[packed&0xf])
+	}
+	p += (seqLen + 1) / 2
+	line = append(line, '\t')
+	if seqLen == 0 || b[p] == 0xff {
+		line = append(line, '*')
+	} else {
+		for _, q := range b[p : p+seqLen] {
+			line = append(line, q+33)
+		}
+	}
+	p += seqLen
+	for p < len(b) {
+		var err error
+		line, p, err = appendSAMTag(append(line, '\t'), b, p)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return append(line, '\n'), nil
+}
+
+// The size of a numeric tag value of the given BAM type, or 0 if it isn't one.
+func tagValueSize(t byte) int {
+	switch t {
+	case 'c', 'C', 'A':
+		return 1
+	case 's', 'S':
+		return 2
+	case 'i', 'I', 'f':
+		return 4
+	}
+	return 0
+}
+
+func appendTagValue(line []byte, t byte, v []byte) []byte {
+	le := binary.LittleEndian
+	switch t {
+	case 'c':
+		return strconv.AppendInt(line, int64(int8(v[0])), 10)
+	case 'C':
+		return strconv.AppendUint(line, uint64(v[0]), 10)
+	case 's':
+		return strconv.AppendInt(line, int64(int16(le.Uint16(v))), 10)
+	case 'S':
+		return strconv.AppendUint(line, uint64(le.Uint16(v)), 10)
+	case 'i':
+		return strconv.AppendInt(line, int64(int32(le.Uint32(v))), 10)
+	case 'I':
+		return strconv.AppendUint(line, uint64(le.Uint32(v)), 10)
+	default:
+		return strconv.AppendFloat(line, float64(math.Float32frombits(le.Uint32(v))), 'g', 6, 32)
+	}
+}
+
+// Append one of a BAM record's optional fields as SAM text, returning where
+// the next one starts.
+func appendSAMTag(line, b []byte, p int) ([]byte, int, error) {
+	if p+3 > len(b) {
+		return nil, 0, fmt.Errorf("truncated BAM tag")
+	}
+	line = append(line, b[p], b[p+1], ':')
+	t := b[p+2]
+	p += 3
+	switch t {
+	case 'A':
+		if p >= len(b) {
+			return nil, 0, fmt.Errorf("truncated BAM tag")
+		}
+		return append(line, 'A', ':', b[p]), p + 1, nil
+	case 'c', 'C', 's', 'S', 'i', 'I', 'f':
+		size := tagValueSize(t)
+		if p+size > len(b) {
+			return nil, 0, fmt.Errorf("truncated BAM tag")
+		}
+		if t == 'f' {
+			line = append(line, 'f', ':')
+		} else {
+			line = append(line, 'i', ':')
+		}
+		return appendTagValue(line, t, b[p:p+size]), p + size, nil
+	case 'Z', 'H':
+		end := bytes.IndexByte(b[p:], 0)
+		if end < 0 {
+			return nil, 0, fmt.Errorf("unterminated BAM string tag")
+		}
+		line = append(append(line, t, ':'), b[p:p+end]...)
+		return line, p + end + 1, nil
+	case 'B':
+		if p+5 > len(b) {
+			return nil, 0, fmt.Errorf("truncated BAM tag")
+		}
+		sub := b[p]
+		n := int(binary.LittleEndian.Uint32(b[p+1:]))
+		p += 5
+		size := tagValueSize(sub)
+		if size == 0 || sub == 'A' || p+n*size > len(b) {
+			return nil, 0, fmt.Errorf("bad BAM array tag")
+		}
+		line = append(line, 'B', ':', sub)
+		for i := 0; i < n; i++ {
+			line = appendTagValue(append(line, ','), sub, b[p:p+size])
+			p += size
+		}
+		return line, p, nil
+	}
+	return nil, 0, fmt.Errorf("bad BAM tag type %q", t)
+}
+
+// Read a file's SAM header natively.
+func readNativeHeader(filename string) (string, error) {
+	r, _, err := OpenSource(filename)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	var header strings.Builder
+	if err := DecodeSAM(r, &header, true, false); err != nil {
+		return "", fmt.Errorf("failed to read header: %v", err)
+	}
+	return header.String(), nil
+}
+
+// A native stand-in for `samtools view file`, started and waited on the same
+// way.
+type nativeView struct {
+	filename string
+	pr       *io.PipeReader
+	done     chan error
+}
+
+// What reads the SAM records of a BAM file from its stdout: samtools view, or
+// the same natively.
+type viewer interface {
+	StdoutPipe() (io.ReadCloser, error)
+	Start() error
+	Wait() error
+}
+
+func openView(bamfile string) viewer {
+	if nativeIO() {
+		return &nativeView{filename: bamfile, done: make(chan error, 1)}
+	}
+	return viewCommand(bamfile)
+}
+
+func (v *nativeView) StdoutPipe() (io.ReadCloser, error) {
+	var pw *io.PipeWriter
+	v.pr, pw = io.Pipe()
+	go func() {
+		r, _, err := OpenSource(v.filename)
+		if err == nil {
+			w := bufio.NewWriterSize(pw, 256*1024)
+			err = DecodeSAM(r, w, false, true)
+			if err == nil {
+				err = w.Flush()
+			}
+			r.Close()
+		}
+		pw.CloseWithError(err)
+		v.done <- err
+	}()
+	return v.pr, nil
+}
+
+func (v *nativeView) Start() error { return nil }
+
+func (v *nativeView) Wait() error {
+	// Stop the decoder if the reader quit before the end.
+	v.pr.Close()
+	err := <-v.done
+	if err == io.ErrClosedPipe {
+		return nil
+	}
+	return err
+}
+
+// BGZF: gzip members of up to 64KB, each saying how big it is in an extra
+// field, ending with an empty one.
+const bgzfBlockSize = 0xff00
+
+// Writes BGZF blocks to w. With more than one thread, blocks are compressed
+// on a pool of goroutines and written in order as they're done.
+type BgzfWriter struct {
+	w     io.Writer
+	level int
+	buf   []byte
+	out   bytes.Buffer
+	fw    *flate.Writer
+	work  chan *bgzfJob // blocks to compress
+	queue chan *bgzfJob // and to write, in order
+	wrote chan struct{} // closed once the queue is written
+	mu    sync.Mutex
+	err   error // from compressing or writing a block off on its own
+}
+
+// A block to compress, and once done, the BGZF block.
+type bgzfJob struct {
+	data  []byte
+	out   bytes.Buffer
+	block []byte
+	err   error
+	done  chan struct{}
+}
+
+// A BGZF writer at a compression level 0-9, or -1 for the default, with
+// threads to compress blocks on.
+func NewBgzfWriter(w io.Writer, level, threads int) (*BgzfWriter, error) {
+	if level < 0 {
+		level = flate.DefaultCompression
+	}
+	fw, err := flate.NewWriter(nil, level)
+	if err != nil {
+		return nil, err
+	}
+	z := &BgzfWriter{w: w, level: level, fw: fw, buf: make([]byte, 0, bgzfBlockSize)}
+	if threads > 1 {
+		z.work = make(chan *bgzfJob, 4*threads)
+		z.queue = make(chan *bgzfJob, 4*threads)
+		z.wrote = make(chan struct{})
+		for i := 0; i < threads; i++ {
+			go z.compress()
+		}
+		go z.writeQueue()
+	}
+	return z, nil
+}
+
+func (z *BgzfWriter) compress() {
+	fw, _ := flate.NewWriter(nil, z.level)
+	for job := range z.work {
+		job.block, job.err = compressBgzfBlock(&job.out, fw, job.data)
+		close(job.done)
+	}
+}
+
+// Write the compressed blocks in the order they were queued in.
+func (z *BgzfWriter) writeQueue() {
+	defer close(z.wrote)
+	for job := range z.queue {
+		<-job.done
+		err := job.err
+		if err == nil && z.failed() == nil {
+			_, err = z.w.Write(job.block)
+		}
+		if err != nil {
+			z.mu.Lock()
+			if z.err == nil {
+				z.err = err
+			}
+			z.mu.Unlock()
+		}
+	}
+}
+
+func (z *BgzfWriter) failed() error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.err
+}
+
+func (z *BgzfWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		take := bgzfBlockSize - len(z.buf)
+		if take > len(p) {
+			take = len(p)
+		}
+		z.buf = append(z.buf, p[:take]...)
+		p = p[take:]
+		if len(z.buf) == bgzfBlockSize {
+			if err := z.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Compress one block of data into a BGZF block.
+func compressBgzfBlock(out *bytes.Buffer, fw *flate.Writer, data []byte) ([]byte, error) {
+	out.Reset()
+	out.Write([]byte{0x1f, 0x8b, 0x08, 0x04, 0, 0, 0, 0, 0, 0xff, 6, 0, 'B', 'C', 2, 0, 0, 0})
+	fw.Reset(out)
+	if _, err := fw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := fw.Close(); err != nil {
+		return nil, err
+	}
+	var tail [8]byte
+	binary.LittleEndian.PutUint32(tail[0:], crc32.ChecksumIEEE(data))
+	binary.LittleEndian.PutUint32(tail[4:], uint32(len(data)))
+	out.Write(tail[:])
+	block := out.Bytes()
+	if len(block) > 1<<16 {
+		return nil, fmt.Errorf("BGZF block of %d bytes is too big", len(block))
+	}
+	binary.LittleEndian.PutUint16(block[16:], uint16(len(block)-1))
+	return block, nil
+}
+
+func (z *BgzfWriter) flush() error {
+	if len(z.buf) == 0 {
+		return nil
+	}
+	if z.work != nil {
+		if err := z.failed(); err != nil {
+			return err
+		}
+		job := &bgzfJob{data: z.buf, done: make(chan struct{})}
+		z.buf = make([]byte, 0, bgzfBlockSize)
+		z.queue <- job
+		z.work <- job
+		return nil
+	}
+	block, err := compressBgzfBlock(&z.out, z.fw, z.buf)
+	if err != nil {
+		return err
+	}
+	z.buf = z.buf[:0]
+	_, err = z.w.Write(block)
+	return err
+}
+
+// Write what's left and the end of file block.
+func (z *BgzfWriter) Close() error {
+	if err := z.flush(); err != nil {
+		return err
+	}
+	if z.work != nil {
+		close(z.work)
+		close(z.queue)
+		<-z.wrote
+		if err := z.failed(); err != nil {
+			return err
+		}
+	}
+	_, err := z.w.Write(bgzfEOF)
+	return err
+}
+
+// Takes the SAM text written to it, header first, and writes it as BAM.
+type BamEncoder struct {
+	z       *BgzfWriter
+	dest    io.Closer // closed after the BAM is finished, if anything
+	partial []byte    // an unfinished line
+	header  []string
+	started bool
+	refs    map[string]int32
+	record  []byte
+}
+
+func NewBamEncoder(w io.Writer, level int, dest io.Closer) (*BamEncoder, error) {
+	z, err := NewBgzfWriter(w, level, nativeThreads)
+	if err != nil {
+		return nil, err
+	}
+	return &BamEncoder{z: z, dest: dest}, nil
+}
+
+func (e *BamEncoder) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			e.partial = append(e.partial, p...)
+			break
+		}
+		line := p[:i]
+		if len(e.partial) > 0 {
+			line = append(e.partial, line...)
+			e.partial = e.partial[:0]
+		}
+		if err := e.line(line); err != nil {
+			return 0, err
+		}
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+func (e *BamEncoder) line(line []byte) error {
+	if len(line) == 0 {
+		return nil
+	}
+	if line[0] == '@' && !e.started {
+		e.header = append(e.header, string(line))
+		return nil
+	}
+	if err := e.start(); err != nil {
+		return err
+	}
+	var err error
+	e.record, err = encodeBamRecord(e.record[:0], string(line), e.refs)
+	if err != nil {
+		return err
+	}
+	_, err = e.z.Write(e.record)
+	return err
+}
+
+// Write the BAM header once the SAM header is all there.
+func (e *BamEncoder) start() error {
+	if e.started {
+		return nil
+	}
+	e.started = true
+	text := ""
+	if len(e.header) > 0 {
+		text = strings.Join(e.header, "\n") + "\n"
+	}
+	var b bytes.Buffer
+	b.WriteString("BAM\x01")
+	binary.Write(&b, binary.LittleEndian, int32(len(text)))
+	b.WriteString(text)
+	e.refs = make(map[string]int32)
+	type ref struct {
+		name   string
+		length int32
+	}
+	refs := []ref{}
+	for _, line := range e.header {
+		if !strings.HasPrefix(line, "@SQ\t") {
+			continue
+		}
+		r := ref{}
+		for _, field := range strings.Split(line, "\t")[1:] {
+			if strings.HasPrefix(field, "SN:") {
+				r.name = field[3:]
+			} else if strings.HasPrefix(field, "LN:") {
+				length, err := strconv.Atoi(field[3:])
+				if err != nil {
+					return fmt.Errorf("bad @SQ length %q", field)
+				}
+				r.length = int32(length)
+			}
+		}
+		e.refs[r.name] = int32(len(refs))
+		refs = append(refs, r)
+	}
+	binary.Write(&b, binary.LittleEndian, int32(len(refs)))
+	for _, r := range refs {
+		binary.Write(&b, binary.LittleEndian, int32(len(r.name)+1))
+		b.WriteString(r.name)
+		b.WriteByte(0)
+		binary.Write(&b, binary.LittleEndian, r.length)
+	}
+	_, err := e.z.Write(b.Bytes())
+	return err
+}
+
+func (e *BamEncoder) Close() error {
+	if len(e.partial) > 0 {
+		if err := e.line(e.partial); err != nil {
+			return err
+		}
+	}
+	if err := e.start(); err != nil {
+		return err
+	}
+	if err := e.z.Close(); err != nil {
+		return err
+	}
+	if e.dest != nil {
+		return e.dest.Close()
+	}
+	return nil
+}
+
+// The BAM bin of a 0-based, end exclusive region, as in the SAM spec.
+func reg2bin(beg, end int) uint16 {
+	end--
+	switch {
+	case beg>>14 == end>>14:
+		return uint16(((1<<15)-1)/7 + (beg >> 14))
+	case beg>>17 == end>>17:
+		return uint16(((1<<12)-1)/7 + (beg >> 17))
+	case beg>>20 == end>>20:
+		return uint16(((1<<9)-1)/7 + (beg >> 20))
+	case beg>>23 == end>>23:
+		return uint16(((1<<6)-1)/7 + (beg >> 23))
+	case beg>>26 == end>>26:
+		return uint16(((1<<3)-1)/7 + (beg >> 26))
+	}
+	return 0
+}
+
+// Append the BAM encoding of a SAM line, block size first.
+func encodeBamRecord(b []byte, line string, refs map[string]int32) ([]byte, error) {
+	fields := strings.Split(line, "\t")
+	if len(fields) < 11 {
+		return nil, fmt.Errorf("SAM record with %d fields, expected at least 11", len(fields))
+	}
+	le := binary.LittleEndian
+	num := func(i int) (int, error) {
+		n, err := strconv.Atoi(fields[i])
+		if err != nil {
+			return 0, fmt.Errorf("read %s: bad SAM field %d %q", fields[0], i+1, fields[i])
+		}
+		return n, nil
+	}
+	refID := func(name string) (int32, error) {
+		if name == "*" {
+			return -1, nil
+		}
+		id, ok := refs[name]
+		if !ok {
+			return 0, fmt.Errorf("read %s: reference %s isn't in the header", fields[0], name)
+		}
+		return id, nil
+	}
+	flag, err := num(1)
+	if err != nil {
+		return nil, err
+	}
+	ref, err := refID(fields[2])
+	if err != nil {
+		return nil, err
+	}
+	pos, err := num(3)
+	if err != nil {
+		return nil, err
+	}
+	mapq, err := num(4)
+	if err != nil {
+		return nil, err
+	}
+	var ops []CigarOp
+	if fields[5] != "*" {
+		if ops, err = ParseCigar(fields[5]); err != nil {
+			return nil, fmt.Errorf("read %s: %v", fields[0], err)
+		}
+	}
+	nextRef := ref
+	if fields[6] != "=" {
+		if nextRef, err = refID(fields[6]); err != nil {
+			return nil, err
+		}
+	}
+	nextPos, err := num(7)
+	if err != nil {
+		return nil, err
+	}
+	tlen, err := num(8)
+	if err != nil {
+		return nil, err
+	}
+	seq := fields[9]
+	if seq == "*" {
+		seq = ""
+	}
+	qual := fields[10]
+	if qual != "*" && len(qual) != len(seq) {
+		return nil, fmt.Errorf("read %s: QUAL and SEQ differ in length", fields[0])
+	}
+
+	beg := pos - 1
+	end := beg + ReferenceSpan(ops)
+	if end <= beg {
+		end = beg + 1
+	}
+	start := len(b)
+	b = append(b, make([]byte, 36)...)
+	h := b[start:]
+	le.PutUint32(h[4:], uint32(ref))
+	le.PutUint32(h[8:], uint32(int32(beg)))
+	h[12] = byte(len(fields[0]) + 1)
+	h[13] = byte(mapq)
+	le.PutUint16(h[14:], reg2bin(beg, end))
+	le.PutUint16(h[16:], uint16(len(ops)))
+	le.PutUint16(h[18:], uint16(flag))
+	le.PutUint32(h[20:], uint32(len(seq)))
+	le.PutUint32(h[24:], uint32(nextRef))
+	le.PutUint32(h[28:], uint32(int32(nextPos-1)))
+	le.PutUint32(h[32:], uint32(int32(tlen)))
+	b = append(append(b, fields[0]...), 0)
+	for _, op := range ops {
+		code := strings.IndexByte(cigarOps, op.Op)
+		b = le.AppendUint32(b, uint32(op.Len)<<4|uint32(code))
+	}
+	for i := 0; i < len(seq); i += 2 {
+		packed := byte(strings.IndexByte(seqBases, upper(seq[i]))&0xf) << 4
+		if i+1 < len(seq) {
+			packed |= byte(strings.IndexByte(seqBases, upper(seq[i+1])) & 0xf)
+		}
+		b = append(b, packed)
+	}
+	for i := 0; i < len(seq); i++ {
+		if qual == "*" {
+			b = append(b, 0xff)
+		} else {
+			b = append(b, qual[i]-33)
+		}
+	}
+	for _, tag := range fields[11:] {
+		if b, err = appendBamTag(b, tag); err != nil {
+			return nil, fmt.Errorf("read %s: %v", fields[0], err)
+		}
+	}
+	le.PutUint32(b[start:], uint32(len(b)-start-4))
+	return b, nil
+}
+
+func upper(c byte) byte {
+	if 'a' <= c && c <= 'z' {
+		return c - 'a' + 'A'
+	}
+	return c
+}
+
+// The smallest BAM integer type holding v, as samtools picks.
+func intTagType(v int64) byte {
+	switch {
+	case v >= 0 && v <= math.MaxUint8:
+		return 'C'
+	case v >= math.MinInt8 && v < 0:
+		return 'c'
+	case v >= 0 && v <= math.MaxUint16:
+		return 'S'
+	case v >= math.MinInt16 && v < 0:
+		return 's'
+	case v >= 0 && v <= math.MaxUint32 && v > math.MaxInt32:
+		return 'I'
+	}
+	return 'i'
+}
+
+func appendIntValue(b []byte, t byte, v int64) []byte {
+	switch tagValueSize(t) {
+	case 1:
+		return append(b, byte(v))
+	case 2:
+		return binary.LittleEndian.AppendUint16(b, uint16(v))
+	}
+	return binary.LittleEndian.AppendUint32(b, uint32(v))
+}
+
+// Append a SAM optional field, like NM:i:2, in BAM encoding.
+func appendBamTag(b []byte, tag string) ([]byte, error) {
+	if len(tag) < 5 || tag[2] != ':' || tag[4] != ':' {
+		return nil, fmt.Errorf("bad tag %q", tag)
+	}
+	value := tag[5:]
+	b = append(b, tag[0], tag[1])
+	switch tag[3] {
+	case 'A':
+		if len(value) != 1 {
+			return nil, fmt.Errorf("bad tag %q", tag)
+		}
+		return append(b, 'A', value[0]), nil
+	case 'i':
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad tag %q", tag)
+		}
+		t := intTagType(v)
+		return appendIntValue(append(b, t), t, v), nil
+	case 'f':
+		v, err := strconv.ParseFloat(value, 32)
+		if err != nil {
+			return nil, fmt.Errorf("bad tag %q", tag)
+		}
+		return binary.LittleEndian.AppendUint32(append(b, 'f'), math.Float32bits(float32(v))), nil
+	case 'Z', 'H':
+		return append(append(append(b, tag[3]), value...), 0), nil
+	case 'B':
+		values := strings.Split(value, ",")
+		sub := values[0]
+		if len(sub) != 1 || tagValueSize(sub[0]) == 0 || sub[0] == 'A' {
+			return nil, fmt.Errorf("bad tag %q", tag)
+		}
+		b = append(b, 'B', sub[0])
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(values)-1))
+		for _, s := range values[1:] {
+			if sub[0] == 'f' {
+				v, err := strconv.ParseFloat(s, 32)
+				if err != nil {
+					return nil, fmt.Errorf("bad tag %q", tag)
+				}
+				b = binary.LittleEndian.AppendUint32(b, math.Float32bits(float32(v)))
+				continue
+			}
+			v, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad tag %q", tag)
+			}
+			b = appendIntValue(b, sub[0], v)
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("bad tag type in %q", tag)
+}
+
+// Open a BAM file for writing natively, for BamWriter.Open: to stdout for -,
+// to the object store for an s3:// or gs:// URI and otherwise to the target.
+func (w *BamWriter) openNative(bamfile, target string) (io.WriteCloser, error) {
+	if w.Sort {
+		return nil, needsSamtools("-sort-output")
+	}
+	level := w.Level
+	if w.Uncompressed {
+		level = 0
+	}
+	var dest io.WriteCloser
+	switch {
+	case bamfile == "-":
+		dest = os.Stdout
+	case IsObject(bamfile):
+		w.upload = objectCommand(bamfile, true)
+		w.upload.Stderr = &w.uploadStderr
+		stdin, err := w.upload.StdinPipe()
+		if err != nil {
+			return nil, fmt.Errorf("failed creating pipe: %v", err)
+		}
+		if err := w.upload.Start(); err != nil {
+			return nil, fmt.Errorf("failed to upload %s: %v", bamfile, err)
+		}
+		dest = stdin
+	default:
+		fp, err := os.Create(target)
+		if err != nil {
+			return nil, err
+		}
+		dest = fp
+	}
+	encoded := newFlushCloser(dest, 256*1024)
+	encoder, err := NewBamEncoder(encoded, level, encoded)
+	if err != nil {
+		return nil, err
+	}
+	return newFlushCloser(encoder, outputBuffer), nil
+}
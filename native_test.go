@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testSAMHeader = "@HD\tVN:1.6\tSO:queryname\n" +
+	"@SQ\tSN:chr1\tLN:248956422\n" +
+	"@SQ\tSN:chrM\tLN:16569\n" +
+	"@RG\tID:rg1\tSM:sample\n"
+
+// Records covering each kind of field: both strands, an unmapped mate, a
+// mate on another reference, missing qualities, an odd length sequence and
+// every tag type.
+const testSAMRecords = "read1\t99\tchr1\t10001\t60\t5M1I3M2D4M\t=\t10101\t113\tACGTNACGTACGT\tIIIIIIIIIIIII\tNM:i:3\tAS:i:-7\tXC:i:200\tXS:i:-200\tXL:i:70000\tXN:i:-70000\tRG:Z:rg1\n" +
+	"read1\t147\tchr1\t10101\t60\t13M\t=\t10001\t-113\tTTTTTGGGGGCCC\t#############\tMD:Z:13\tXA:A:x\tXF:f:1.5\tXH:H:1AE301\tXB:B:c,-1,2,-3\tXU:B:S,1,65535\tXI:B:i,-100000,7\n" +
+	"read2\t73\tchrM\t1\t0\t3S7M\t*\t0\t0\tacgtacgtac\t*\n" +
+	"read2\t133\tchrM\t1\t0\t*\t=\t1\t0\tACG\t###\n" +
+	"read3\t65\tchr1\t248956400\t37\t10M10H\tchrM\t16000\t0\tGGGGGAAAAA\tABCDEFGHIJ\n" +
+	"read4\t4\t*\t0\t0\t*\t*\t0\t0\t*\t*\n"
+
+func encodeTestBAM(t *testing.T, sam string, threads int) []byte {
+	t.Helper()
+	saved := nativeThreads
+	nativeThreads = threads
+	defer func() { nativeThreads = saved }()
+	var bam bytes.Buffer
+	encoder, err := NewBamEncoder(&bam, 6, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// In uneven pieces, as a BamWriter would hand it over.
+	for len(sam) > 0 {
+		n := 37
+		if n > len(sam) {
+			n = len(sam)
+		}
+		if _, err := io.WriteString(encoder, sam[:n]); err != nil {
+			t.Fatal(err)
+		}
+		sam = sam[n:]
+	}
+	if err := encoder.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return bam.Bytes()
+}
+
+func decodeTestBAM(t *testing.T, bam []byte) string {
+	t.Helper()
+	var sam strings.Builder
+	if err := DecodeSAM(bytes.NewReader(bam), &sam, true, true); err != nil {
+		t.Fatal(err)
+	}
+	return sam.String()
+}
+
+func TestNativeBAMRoundTrip(t *testing.T) {
+	sam := testSAMHeader + testSAMRecords
+	for _, threads := range []int{1, 4} {
+		bam := encodeTestBAM(t, sam, threads)
+		if !bytes.HasSuffix(bam, bgzfEOF) {
+			t.Errorf("%d threads: BAM doesn't end with the BGZF EOF block", threads)
+		}
+		// Lower case bases come back upper case, as BAM can't tell them apart.
+		want := strings.Replace(sam, "acgtacgtac", "ACGTACGTAC", 1)
+		if got := decodeTestBAM(t, bam); got != want {
+			t.Errorf("%d threads: decoded\n%s\nwant\n%s", threads, got, want)
+		}
+	}
+}
+
+// The encoding against the layout in the SAM spec, read with compress/gzip
+// rather than our own BGZF reader.
+func TestNativeBAMLayout(t *testing.T) {
+	bam := encodeTestBAM(t, testSAMHeader+testSAMRecords, 1)
+	gz, err := gzip.NewReader(bytes.NewReader(bam))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	le := binary.LittleEndian
+	if string(raw[:4]) != "BAM\x01" {
+		t.Fatalf("magic %q", raw[:4])
+	}
+	textLen := int(le.Uint32(raw[4:]))
+	if string(raw[8:8+textLen]) != testSAMHeader {
+		t.Errorf("header text %q", raw[8:8+textLen])
+	}
+	p := 8 + textLen
+	if n := le.Uint32(raw[p:]); n != 2 {
+		t.Fatalf("%d references, want 2", n)
+	}
+	p += 4
+	for _, ref := range []struct {
+		name   string
+		length uint32
+	}{{"chr1", 248956422}, {"chrM", 16569}} {
+		n := int(le.Uint32(raw[p:]))
+		if name := string(raw[p+4 : p+4+n]); name != ref.name+"\x00" {
+			t.Errorf("reference %q, want %q", name, ref.name)
+		}
+		if length := le.Uint32(raw[p+4+n:]); length != ref.length {
+			t.Errorf("%s length %d, want %d", ref.name, length, ref.length)
+		}
+		p += 8 + n
+	}
+	// The first record, read1/1.
+	r := raw[p+4 : p+4+int(le.Uint32(raw[p:]))]
+	fields := []struct {
+		name      string
+		got, want uint32
+	}{
+		{"refID", le.Uint32(r[0:]), 0},
+		{"pos", le.Uint32(r[4:]), 10000},
+		{"l_read_name", uint32(r[8]), 6},
+		{"mapq", uint32(r[9]), 60},
+		{"bin", uint32(le.Uint16(r[10:])), uint32(reg2bin(10000, 10014))},
+		{"n_cigar_op", uint32(le.Uint16(r[12:])), 5},
+		{"flag", uint32(le.Uint16(r[14:])), 99},
+		{"l_seq", le.Uint32(r[16:]), 13},
+		{"next_refID", le.Uint32(r[20:]), 0},
+		{"next_pos", le.Uint32(r[24:]), 10100},
+		{"tlen", le.Uint32(r[28:]), 113},
+		{"first CIGAR op", le.Uint32(r[38:]), 5<<4 | 0},
+		{"second CIGAR op", le.Uint32(r[42:]), 1<<4 | 1},
+		{"first bases", uint32(r[58]), 1<<4 | 2},
+	}
+	for _, f := range fields {
+		if f.got != f.want {
+			t.Errorf("read1 %s = %d, want %d", f.name, f.got, f.want)
+		}
+	}
+	if name := string(r[32:38]); name != "read1\x00" {
+		t.Errorf("read name %q", name)
+	}
+}
+
+func TestReg2bin(t *testing.T) {
+	tests := []struct {
+		beg, end int
+		bin      uint16
+	}{
+		{0, 1, 4681},
+		{16384, 16385, 4682},
+		{0, 16385, 585},
+		{0, 1 << 26, 1},
+		{0, 1 << 29, 0},
+	}
+	for _, test := range tests {
+		if bin := reg2bin(test.beg, test.end); bin != test.bin {
+			t.Errorf("reg2bin(%d, %d) = %d, want %d", test.beg, test.end, bin, test.bin)
+		}
+	}
+}
+
+// Enough records to take many BGZF blocks, so records straddle blocks.
+func TestNativeBAMManyBlocks(t *testing.T) {
+	var sam strings.Builder
+	sam.WriteString(testSAMHeader)
+	seq := strings.Repeat("ACGT", 40)
+	qual := strings.Repeat("I", 160)
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&sam, "read%d\t0\tchr1\t%d\t60\t160M\t*\t0\t0\t%s\t%s\tNM:i:%d\n", i, i+1, seq, qual, i%7)
+	}
+	bam := encodeTestBAM(t, sam.String(), 4)
+	if got := decodeTestBAM(t, bam); got != sam.String() {
+		t.Errorf("decoded %d bytes of SAM, want the %d encoded", len(got), sam.Len())
+	}
+}
+
+// With samtools installed, check it reads what we write the same as we do,
+// and that we read what it writes the same as it does.
+func TestNativeBAMSamtools(t *testing.T) {
+	if _, err := exec.LookPath(samtoolsPath); err != nil {
+		t.Skip("samtools isn't installed")
+	}
+	dir := t.TempDir()
+	sam := testSAMHeader + testSAMRecords
+	ours := filepath.Join(dir, "ours.bam")
+	if err := os.WriteFile(ours, encodeTestBAM(t, sam, 2), 0666); err != nil {
+		t.Fatal(err)
+	}
+	output, err := exec.Command(samtoolsPath, "view", "-h", "--no-PG", ours).Output()
+	if err != nil {
+		t.Fatalf("samtools view failed: %v", err)
+	}
+	want := strings.Replace(sam, "acgtacgtac", "ACGTACGTAC", 1)
+	if string(output) != want {
+		t.Errorf("samtools read\n%s\nwant\n%s", output, want)
+	}
+
+	theirs := filepath.Join(dir, "theirs.bam")
+	cmd := exec.Command(samtoolsPath, "view", "-b", "--no-PG", "-o", theirs, "-")
+	cmd.Stdin = strings.NewReader(sam)
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("samtools view -b failed: %v", err)
+	}
+	fp, err := os.Open(theirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	var got strings.Builder
+	if err := DecodeSAM(bufio.NewReader(fp), &got, true, true); err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != want {
+		t.Errorf("decoded samtools' BAM as\n%s\nwant\n%s", got.String(), want)
+	}
+}
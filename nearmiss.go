@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+)
+
+// Reads kept although they were found in the contamination, their sample
+// alignment winning by more than the margin. How many there are, and how
+// narrowly they won, shows whether the margin lets too much through. With
+// -near-misses the reads are written to a table of the read name, its sample
+// score, the best contaminant and its score, and the difference.
+type NearMisses struct {
+	Count int
+	fp    *os.File
+	w     *bufio.Writer
+}
+
+// The file name may be empty to only count them.
+func NewNearMisses(filename string) (*NearMisses, error) {
+	n := &NearMisses{}
+	if filename == "" {
+		return n, nil
+	}
+	fp, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	n.fp = fp
+	n.w = bufio.NewWriter(fp)
+	fmt.Fprintln(n.w, "read\tsample_score\tcontaminant\tcontaminant_score\tdifference")
+	return n, nil
+}
+
+func (n *NearMisses) Add(read string, score float64, cont string, contScore float64) {
+	n.Count++
+	if n.w != nil {
+		fmt.Fprintf(n.w, "%s\t%g\t%s\t%g\t%g\n", read, score, cont, contScore, score-contScore)
+	}
+}
+
+func (n *NearMisses) Close() error {
+	if n.w == nil {
+		return nil
+	}
+	if err := n.w.Flush(); err != nil {
+		return err
+	}
+	return n.fp.Close()
+}
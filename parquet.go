@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+)
+
+// Just enough of Parquet to write a flat table of strings and doubles: one
+// gzipped PLAIN data page per column per row group, with the footer in
+// Thrift's compact protocol. See https://github.com/apache/parquet-format.
+
+const (
+	parquetDouble    = 5 // Type DOUBLE
+	parquetByteArray = 6 // Type BYTE_ARRAY
+)
+
+// Rows per row group.
+var parquetRowGroupSize = 1000000
+
+type ParquetColumn struct {
+	Name     string
+	Type     int // parquetDouble or parquetByteArray, which is written as UTF8
+	Optional bool
+}
+
+type parquetChunk struct {
+	values  bytes.Buffer // PLAIN encoded non-null values
+	defined []bool
+}
+
+type ParquetWriter struct {
+	columns   []ParquetColumn
+	chunks    []parquetChunk
+	rows      int
+	totalRows int64
+	fp        *os.File
+	w         *bufio.Writer
+	offset    int64
+	rowGroups [][]byte // encoded RowGroup structs for the footer
+}
+
+func NewParquetWriter(filename string, columns []ParquetColumn) (*ParquetWriter, error) {
+	fp, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	p := &ParquetWriter{
+		columns: columns,
+		chunks:  make([]parquetChunk, len(columns)),
+		fp:      fp,
+		w:       bufio.NewWriter(fp),
+	}
+	p.write([]byte("PAR1"))
+	return p, nil
+}
+
+func (p *ParquetWriter) write(b []byte) {
+	p.w.Write(b)
+	p.offset += int64(len(b))
+}
+
+// Add a row of values, a string or float64 for each column or nil for null in
+// an optional one.
+func (p *ParquetWriter) Add(values ...interface{}) error {
+	for i, column := range p.columns {
+		chunk := &p.chunks[i]
+		switch v := values[i].(type) {
+		case nil:
+			if !column.Optional {
+				return fmt.Errorf("null value for required column %s", column.Name)
+			}
+			chunk.defined = append(chunk.defined, false)
+			continue
+		case string:
+			binary.Write(&chunk.values, binary.LittleEndian, uint32(len(v)))
+			chunk.values.WriteString(v)
+		case float64:
+			binary.Write(&chunk.values, binary.LittleEndian, math.Float64bits(v))
+		default:
+			return fmt.Errorf("unsupported value %v for column %s", v, column.Name)
+		}
+		chunk.defined = append(chunk.defined, true)
+	}
+	p.rows++
+	if p.rows >= parquetRowGroupSize {
+		return p.flush()
+	}
+	return nil
+}
+
+// Definition levels for an optional column, as the RLE runs of the RLE/bit
+// packing hybrid encoding with a bit width of one.
+func definitionLevels(defined []bool) []byte {
+	var buf bytes.Buffer
+	for i := 0; i < len(defined); {
+		j := i
+		for j < len(defined) && defined[j] == defined[i] {
+			j++
+		}
+		writeUvarint(&buf, uint64(j-i)<<1)
+		if defined[i] {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+		i = j
+	}
+	return buf.Bytes()
+}
+
+// Write out the buffered rows as a row group.
+func (p *ParquetWriter) flush() error {
+	if p.rows == 0 {
+		return nil
+	}
+	chunks := [][]byte{}
+	total := int64(0)
+	for i, column := range p.columns {
+		chunk := &p.chunks[i]
+		var page bytes.Buffer
+		if column.Optional {
+			levels := definitionLevels(chunk.defined)
+			binary.Write(&page, binary.LittleEndian, uint32(len(levels)))
+			page.Write(levels)
+		}
+		page.Write(chunk.values.Bytes())
+		var compressed bytes.Buffer
+		gz := gzip.NewWriter(&compressed)
+		gz.Write(page.Bytes())
+		if err := gz.Close(); err != nil {
+			return err
+		}
+
+		header := &thriftWriter{}
+		header.i32(1, 0) // DATA_PAGE
+		header.i32(2, int32(page.Len()))
+		header.i32(3, int32(compressed.Len()))
+		header.beginStruct(5)
+		header.i32(1, int32(p.rows))
+		header.i32(2, 0) // PLAIN
+		header.i32(3, 3) // RLE
+		header.i32(4, 3)
+		header.endStruct()
+		header.stop()
+
+		pageOffset := p.offset
+		p.write(header.buf.Bytes())
+		p.write(compressed.Bytes())
+		size := int64(header.buf.Len() + compressed.Len())
+		uncompressedSize := int64(header.buf.Len() + page.Len())
+		total += uncompressedSize
+
+		meta := &thriftWriter{}
+		meta.i64(2, pageOffset)
+		meta.beginStruct(3)
+		meta.i32(1, int32(column.Type))
+		meta.beginList(2, thriftI32, 2)
+		meta.listI32(0) // PLAIN
+		meta.listI32(3) // RLE
+		meta.beginList(3, thriftBinary, 1)
+		meta.listString(column.Name)
+		meta.i32(4, 2) // GZIP
+		meta.i64(5, int64(p.rows))
+		meta.i64(6, uncompressedSize)
+		meta.i64(7, size)
+		meta.i64(9, pageOffset)
+		meta.endStruct()
+		meta.stop()
+		chunks = append(chunks, meta.buf.Bytes())
+
+		chunk.values.Reset()
+		chunk.defined = chunk.defined[:0]
+	}
+
+	group := &thriftWriter{}
+	group.beginList(1, thriftStruct, len(chunks))
+	for _, chunk := range chunks {
+		group.raw(chunk)
+	}
+	group.i64(2, total)
+	group.i64(3, int64(p.rows))
+	group.stop()
+	p.rowGroups = append(p.rowGroups, group.buf.Bytes())
+	p.totalRows += int64(p.rows)
+	p.rows = 0
+	return nil
+}
+
+func (p *ParquetWriter) Close() error {
+	if err := p.flush(); err != nil {
+		return err
+	}
+	footer := &thriftWriter{}
+	footer.i32(1, 1)
+	footer.beginList(2, thriftStruct, len(p.columns)+1)
+	root := &thriftWriter{}
+	root.str(4, "schema")
+	root.i32(5, int32(len(p.columns)))
+	root.stop()
+	footer.raw(root.buf.Bytes())
+	for _, column := range p.columns {
+		element := &thriftWriter{}
+		element.i32(1, int32(column.Type))
+		if column.Optional {
+			element.i32(3, 1) // OPTIONAL
+		} else {
+			element.i32(3, 0) // REQUIRED
+		}
+		element.str(4, column.Name)
+		if column.Type == parquetByteArray {
+			element.i32(6, 0) // UTF8
+		}
+		element.stop()
+		footer.raw(element.buf.Bytes())
+	}
+	footer.i64(3, p.totalRows)
+	footer.beginList(4, thriftStruct, len(p.rowGroups))
+	for _, group := range p.rowGroups {
+		footer.raw(group)
+	}
+	footer.str(6, "contfilter "+Version)
+	footer.stop()
+
+	p.write(footer.buf.Bytes())
+	length := make([]byte, 4)
+	binary.LittleEndian.PutUint32(length, uint32(footer.buf.Len()))
+	p.write(length)
+	p.write([]byte("PAR1"))
+	if err := p.w.Flush(); err != nil {
+		return err
+	}
+	return p.fp.Close()
+}
+
+// Thrift compact protocol, only as much as the Parquet metadata needs. Fields
+// are written in increasing id order within each struct.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+type thriftWriter struct {
+	buf     bytes.Buffer
+	last    []int16 // the last field id written in each open struct
+	current int16
+}
+
+func writeUvarint(buf *bytes.Buffer, v uint64) {
+	b := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(b, v)
+	buf.Write(b[:n])
+}
+
+func zigzag(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
+
+func (t *thriftWriter) field(id int16, kind byte) {
+	delta := id - t.current
+	if delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | kind)
+	} else {
+		t.buf.WriteByte(kind)
+		writeUvarint(&t.buf, zigzag(int64(id)))
+	}
+	t.current = id
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	writeUvarint(&t.buf, zigzag(int64(v)))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	writeUvarint(&t.buf, zigzag(v))
+}
+
+func (t *thriftWriter) str(id int16, s string) {
+	t.field(id, thriftBinary)
+	writeUvarint(&t.buf, uint64(len(s)))
+	t.buf.WriteString(s)
+}
+
+func (t *thriftWriter) beginStruct(id int16) {
+	t.field(id, thriftStruct)
+	t.last = append(t.last, t.current)
+	t.current = 0
+}
+
+func (t *thriftWriter) endStruct() {
+	t.stop()
+	t.current = t.last[len(t.last)-1]
+	t.last = t.last[:len(t.last)-1]
+}
+
+// Start a list field; its elements follow with the list* methods, or raw for
+// structs encoded separately.
+func (t *thriftWriter) beginList(id int16, kind byte, size int) {
+	t.field(id, thriftList)
+	if size < 15 {
+		t.buf.WriteByte(byte(size)<<4 | kind)
+	} else {
+		t.buf.WriteByte(0xf0 | kind)
+		writeUvarint(&t.buf, uint64(size))
+	}
+}
+
+func (t *thriftWriter) listI32(v int32) {
+	writeUvarint(&t.buf, zigzag(int64(v)))
+}
+
+func (t *thriftWriter) listString(s string) {
+	writeUvarint(&t.buf, uint64(len(s)))
+	t.buf.WriteString(s)
+}
+
+func (t *thriftWriter) raw(b []byte) {
+	t.buf.Write(b)
+}
+
+func (t *thriftWriter) stop() {
+	t.buf.WriteByte(0)
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// A Thrift compact protocol reader written from the spec, separately from
+// thriftWriter, holding each struct as its fields by id.
+type thriftReader struct {
+	b   []byte
+	p   int
+	err error
+}
+
+func (r *thriftReader) byte() byte {
+	if r.p >= len(r.b) {
+		r.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	r.p++
+	return r.b[r.p-1]
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.b[r.p:])
+	if n <= 0 {
+		r.err = fmt.Errorf("bad varint at %d", r.p)
+		return 0
+	}
+	r.p += n
+	return v
+}
+
+func (r *thriftReader) varint() int64 {
+	v := r.uvarint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (r *thriftReader) value(kind byte) interface{} {
+	switch kind {
+	case 1:
+		return true
+	case 2:
+		return false
+	case 3:
+		return int64(int8(r.byte()))
+	case 4, 5, 6:
+		return r.varint()
+	case 7:
+		v := math.Float64frombits(binary.LittleEndian.Uint64(r.b[r.p:]))
+		r.p += 8
+		return v
+	case 8:
+		n := int(r.uvarint())
+		if r.p+n > len(r.b) {
+			r.err = io.ErrUnexpectedEOF
+			return nil
+		}
+		r.p += n
+		return string(r.b[r.p-n : r.p])
+	case 9, 10:
+		head := r.byte()
+		size := int(head >> 4)
+		if size == 15 {
+			size = int(r.uvarint())
+		}
+		list := []interface{}{}
+		for i := 0; i < size && r.err == nil; i++ {
+			v := r.value(head & 0xf)
+			if head&0xf == 1 {
+				// List elements carry the bool itself.
+				v = r.byte() == 1
+			}
+			list = append(list, v)
+		}
+		return list
+	case 12:
+		return r.structure()
+	}
+	r.err = fmt.Errorf("unknown thrift type %d at %d", kind, r.p)
+	return nil
+}
+
+func (r *thriftReader) structure() map[int]interface{} {
+	fields := map[int]interface{}{}
+	id := 0
+	for r.err == nil {
+		head := r.byte()
+		if head == 0 {
+			break
+		}
+		if delta := int(head >> 4); delta != 0 {
+			id += delta
+		} else {
+			id = int(r.varint())
+		}
+		fields[id] = r.value(head & 0xf)
+	}
+	return fields
+}
+
+func readThrift(t *testing.T, b []byte) (map[int]interface{}, int) {
+	t.Helper()
+	r := &thriftReader{b: b}
+	s := r.structure()
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	return s, r.p
+}
+
+func field(t *testing.T, s map[int]interface{}, ids ...int) interface{} {
+	t.Helper()
+	var v interface{} = s
+	for _, id := range ids {
+		m, ok := v.(map[int]interface{})
+		if !ok {
+			t.Fatalf("field %v isn't in a struct", ids)
+		}
+		if v, ok = m[id]; !ok {
+			t.Fatalf("no field %v", ids)
+		}
+	}
+	return v
+}
+
+// Definition levels of bit width one in the RLE/bit-packing hybrid.
+func readLevels(t *testing.T, b []byte, n int) []bool {
+	t.Helper()
+	r := &thriftReader{b: b}
+	levels := []bool{}
+	for len(levels) < n && r.err == nil {
+		head := r.uvarint()
+		if head&1 == 0 {
+			v := r.byte() == 1
+			for i := 0; i < int(head>>1); i++ {
+				levels = append(levels, v)
+			}
+			continue
+		}
+		for i := 0; i < int(head>>1); i++ {
+			bits := r.byte()
+			for j := 0; j < 8; j++ {
+				levels = append(levels, bits>>j&1 == 1)
+			}
+		}
+	}
+	if r.err != nil || len(levels) < n {
+		t.Fatalf("bad definition levels %v", b)
+	}
+	return levels[:n]
+}
+
+// Read back a file written by ParquetWriter as rows of strings, float64s and
+// nils.
+func readTestParquet(t *testing.T, filename string) ([]string, [][]interface{}) {
+	t.Helper()
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data[:4]) != "PAR1" || string(data[len(data)-4:]) != "PAR1" {
+		t.Fatal("no PAR1 magic")
+	}
+	length := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	meta, n := readThrift(t, data[len(data)-8-length:len(data)-8])
+	if n != length {
+		t.Fatalf("footer is %d bytes, but says %d", n, length)
+	}
+	schema := field(t, meta, 2).([]interface{})
+	if children := field(t, schema[0].(map[int]interface{}), 5); children != int64(len(schema)-1) {
+		t.Fatalf("schema root has %v children, want %d", children, len(schema)-1)
+	}
+	names := []string{}
+	for _, element := range schema[1:] {
+		names = append(names, field(t, element.(map[int]interface{}), 4).(string))
+	}
+	rows := [][]interface{}{}
+	for _, group := range field(t, meta, 4).([]interface{}) {
+		group := group.(map[int]interface{})
+		count := int(field(t, group, 3).(int64))
+		start := len(rows)
+		for i := 0; i < count; i++ {
+			rows = append(rows, make([]interface{}, len(names)))
+		}
+		for c, chunk := range field(t, group, 1).([]interface{}) {
+			chunk := chunk.(map[int]interface{})
+			element := schema[c+1].(map[int]interface{})
+			if path := field(t, chunk, 3, 3).([]interface{}); path[0] != names[c] {
+				t.Fatalf("column %d is %v, want %s", c, path, names[c])
+			}
+			offset := int(field(t, chunk, 3, 9).(int64))
+			header, n := readThrift(t, data[offset:])
+			if kind := field(t, header, 1); kind != int64(0) {
+				t.Fatalf("page type %v, want DATA_PAGE", kind)
+			}
+			size := int(field(t, header, 3).(int64))
+			if total := int(field(t, chunk, 3, 7).(int64)); total != n+size {
+				t.Errorf("column %s chunk is %d bytes, but says %d", names[c], n+size, total)
+			}
+			gz, err := gzip.NewReader(bytes.NewReader(data[offset+n : offset+n+size]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			page, err := io.ReadAll(gz)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if int(field(t, header, 2).(int64)) != len(page) {
+				t.Errorf("column %s page is %d bytes, but says %d", names[c], len(page), field(t, header, 2))
+			}
+			if values := field(t, header, 5, 1); values != int64(count) {
+				t.Errorf("column %s page has %v values, want %d", names[c], values, count)
+			}
+			defined := make([]bool, count)
+			for i := range defined {
+				defined[i] = true
+			}
+			if field(t, element, 3) == int64(1) {
+				n := int(binary.LittleEndian.Uint32(page))
+				defined = readLevels(t, page[4:4+n], count)
+				page = page[4+n:]
+			}
+			for i, ok := range defined {
+				if !ok {
+					continue
+				}
+				switch field(t, element, 1) {
+				case int64(parquetDouble):
+					rows[start+i][c] = math.Float64frombits(binary.LittleEndian.Uint64(page))
+					page = page[8:]
+				case int64(parquetByteArray):
+					n := int(binary.LittleEndian.Uint32(page))
+					rows[start+i][c] = string(page[4 : 4+n])
+					page = page[4+n:]
+				}
+			}
+			if len(page) > 0 {
+				t.Errorf("column %s has %d bytes left over", names[c], len(page))
+			}
+		}
+	}
+	if total := field(t, meta, 3); total != int64(len(rows)) {
+		t.Errorf("file says %v rows, has %d", total, len(rows))
+	}
+	return names, rows
+}
+
+func testParquetRows(n int) [][]interface{} {
+	rows := [][]interface{}{}
+	for i := 0; i < n; i++ {
+		row := []interface{}{fmt.Sprintf("read%d", i), float64(i) * 1.5, nil, nil, "kept", ""}
+		if i%3 != 0 {
+			row[2], row[3], row[4], row[5] = "mm10 é", -float64(i), "rejected", "contamination"
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func writeTestParquet(t *testing.T, rows [][]interface{}) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "decisions.parquet")
+	w, err := NewParquetWriter(filename, decisionColumns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range rows {
+		if err := w.Add(row...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestParquetRoundTrip(t *testing.T) {
+	saved := parquetRowGroupSize
+	defer func() { parquetRowGroupSize = saved }()
+	for _, size := range []int{1000, 7} {
+		parquetRowGroupSize = size
+		rows := testParquetRows(50)
+		names, got := readTestParquet(t, writeTestParquet(t, rows))
+		want := []string{}
+		for _, column := range decisionColumns {
+			want = append(want, column.Name)
+		}
+		if !reflect.DeepEqual(names, want) {
+			t.Errorf("columns %v, want %v", names, want)
+		}
+		if !reflect.DeepEqual(got, rows) {
+			t.Errorf("%d rows per group: read %v, want %v", size, got, rows)
+		}
+	}
+}
+
+func TestParquetRequiredNull(t *testing.T) {
+	w, err := NewParquetWriter(filepath.Join(t.TempDir(), "d.parquet"), decisionColumns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := w.Add(nil, nil, nil, nil, "kept", ""); err == nil {
+		t.Error("took a null read name")
+	}
+}
+
+// With pyarrow installed, check it reads the file the same.
+func TestParquetPyarrow(t *testing.T) {
+	python, err := exec.LookPath("python3")
+	if err != nil || exec.Command(python, "-c", "import pyarrow.parquet").Run() != nil {
+		t.Skip("pyarrow isn't installed")
+	}
+	rows := testParquetRows(20)
+	filename := writeTestParquet(t, rows)
+	script := "import json, sys, pyarrow.parquet as pq\n" +
+		"print(json.dumps(pq.read_table(sys.argv[1]).to_pylist()))\n"
+	output, err := exec.Command(python, "-c", script, filename).Output()
+	if err != nil {
+		t.Fatalf("pyarrow failed to read the file: %v", err)
+	}
+	var got []map[string]interface{}
+	if err := json.Unmarshal(output, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(rows) {
+		t.Fatalf("pyarrow read %d rows, want %d", len(got), len(rows))
+	}
+	for i, row := range rows {
+		for c, column := range decisionColumns {
+			if !reflect.DeepEqual(got[i][column.Name], row[c]) {
+				t.Errorf("pyarrow read row %d %s as %v, want %v", i, column.Name, got[i][column.Name], row[c])
+			}
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// The read names with a mapped alignment in a contamination BAM, gathered in a
+// first pass with -prefilter so reads that aren't there can skip scanning it.
+type NameFilter interface {
+	Add(name string)
+	Contains(name string) bool
+}
+
+// An exact set of names. Takes memory in proportion to the names themselves.
+type NameSet map[string]struct{}
+
+func (s NameSet) Add(name string) {
+	s[name] = struct{}{}
+}
+
+func (s NameSet) Contains(name string) bool {
+	_, ok := s[name]
+	return ok
+}
+
+// A Bloom filter of fixed size. It can claim a name is present when it isn't,
+// which only costs a scan, but never the other way around.
+type BloomFilter struct {
+	bits   []uint64
+	hashes int
+}
+
+func NewBloomFilter(megabytes int, hashes int) *BloomFilter {
+	return &BloomFilter{
+		bits:   make([]uint64, megabytes*1024*1024/8),
+		hashes: hashes,
+	}
+}
+
+// Positions come from two halves of one 64-bit hash, combined as in
+// Kirsch & Mitzenmacher's double hashing.
+func (b *BloomFilter) positions(name string, fn func(bit uint64)) {
+	h := fnv.New64a()
+	io.WriteString(h, name)
+	sum := h.Sum64()
+	h1, h2 := sum&0xffffffff, sum>>32|1
+	n := uint64(len(b.bits)) * 64
+	for i := 0; i < b.hashes; i++ {
+		fn((h1 + uint64(i)*h2) % n)
+	}
+}
+
+func (b *BloomFilter) Add(name string) {
+	b.positions(name, func(bit uint64) {
+		b.bits[bit/64] |= 1 << (bit % 64)
+	})
+}
+
+func (b *BloomFilter) Contains(name string) bool {
+	present := true
+	b.positions(name, func(bit uint64) {
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			present = false
+		}
+	})
+	return present
+}
+
+// The filter for the names in a contamination file. With -max-memory, an
+// exact set turns into a bloom filter once it outgrows its share.
+func NewNameFilter(kind, filename string) NameFilter {
+	if kind == "exact" && memoryBudget.NameSet > 0 {
+		return &boundedNameSet{set: NameSet{}, max: memoryBudget.NameSet, filename: filename}
+	}
+	if kind == "exact" {
+		return NameSet{}
+	}
+	return NewBloomFilter(args.BloomSize, 4)
+}
+
+// About what a name costs in a NameSet on top of its bytes.
+const nameSetEntrySize = 48
+
+type boundedNameSet struct {
+	set      NameSet
+	bloom    *BloomFilter
+	size     int64
+	max      int64
+	filename string
+}
+
+func (s *boundedNameSet) Add(name string) {
+	if s.bloom != nil {
+		s.bloom.Add(name)
+		return
+	}
+	s.set.Add(name)
+	s.size += int64(len(name)) + nameSetEntrySize
+	if s.size <= s.max {
+		return
+	}
+	logger.Warnf("the names in %s take more than their %s share of -max-memory, so prefiltering it with a bloom filter instead\n",
+		s.filename, formatBytes(uint64(s.max)))
+	s.bloom = NewBloomFilter(args.BloomSize, 4)
+	for name := range s.set {
+		s.bloom.Add(name)
+	}
+	s.set = nil
+}
+
+func (s *boundedNameSet) Contains(name string) bool {
+	if s.bloom != nil {
+		return s.bloom.Contains(name)
+	}
+	return s.set.Contains(name)
+}
+
+// Read the names of every mapped record in a BAM file into the filter. Order
+// doesn't matter here, so this never needs sorting. Returns the number of
+// records added.
+func BuildNameFilter(bamfile string, filter NameFilter) (int, error) {
+	cmd := openView(bamfile)
+	input, err := cmd.StdoutPipe()
+	if err != nil {
+		return 0, fmt.Errorf("failed creating pipe: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("command failed to start: %v", err)
+	}
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 64*1024), maxRecordSize)
+	added := 0
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "\t", 3)
+		if len(fields) < 3 || fields[0] == "" || fields[0][0] == '@' {
+			continue
+		}
+		flag, err := strconv.Atoi(fields[1])
+		if err != nil {
+			cmd.Wait()
+			return 0, fmt.Errorf("%s: failed to parse FLAG: %s", bamfile, fields[1])
+		}
+		if flag&FlagUnmapped != 0 {
+			continue
+		}
+		// Looked up by the sample's names, so stored the way they'll come.
+		name := fields[0]
+		if normalizeNames {
+			name = NormalizeName(name)
+		}
+		filter.Add(name)
+		added++
+	}
+	if err := scanner.Err(); err != nil {
+		cmd.Wait()
+		return 0, scanError(bamfile, err)
+	}
+	if err := cmd.Wait(); err != nil {
+		return 0, fmt.Errorf("samtools view %s failed: %v", bamfile, err)
+	}
+	return added, nil
+}
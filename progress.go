@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Reports how far along the run is: a line in the log every -progress-interval
+// (or every 100000 reads with an interval of 0), or
+// with -progress and stderr a terminal, a bar with the percent of the sample
+// read, throughput and how much longer it should take. With -progress-json
+// the counts also go out as JSON lines, one event at a time.
+type Progress struct {
+	sample        *BamScanner
+	contamination []*Contaminant
+	bar           bool
+	started       time.Time
+	drawn         time.Time
+	reported      time.Time
+	events        io.WriteCloser
+	encoder       *json.Encoder
+}
+
+// A -progress-json event: start, progress as it's logged, or done.
+type ProgressEvent struct {
+	Event          string         `json:"event"`
+	Time           string         `json:"time"`
+	ElapsedSeconds float64        `json:"elapsed_seconds"`
+	Reads          int            `json:"reads"`
+	Considered     int            `json:"considered"`
+	Kept           int            `json:"kept"`
+	Rejected       map[string]int `json:"rejected"`
+	BytesRead      int64          `json:"bytes_read,omitempty"`
+	BytesTotal     int64          `json:"bytes_total,omitempty"`
+}
+
+const (
+	progressLogInterval = 100000
+	progressBarWidth    = 30
+	// Reads between looks at the clock, which on every read would cost more
+	// than the reporting.
+	progressClockInterval = 1000
+)
+
+func NewProgress(sample *BamScanner, contamination []*Contaminant) (*Progress, error) {
+	p := &Progress{sample: sample, contamination: contamination, started: time.Now()}
+	p.reported = p.started
+	if args.Progress {
+		info, err := os.Stderr.Stat()
+		p.bar = err == nil && info.Mode()&os.ModeCharDevice != 0
+	}
+	switch args.ProgressJSON {
+	case "":
+	case "stdout":
+		p.events = os.Stdout
+	case "stderr":
+		p.events = os.Stderr
+	default:
+		fp, err := os.Create(args.ProgressJSON)
+		if err != nil {
+			return nil, err
+		}
+		p.events = fp
+	}
+	if p.events != nil {
+		p.encoder = json.NewEncoder(p.events)
+		p.emit("start", 0, 0, 0, nil)
+	}
+	return p, nil
+}
+
+func (p *Progress) emit(event string, reads, considered, kept int, rejected []int) {
+	now := time.Now()
+	e := ProgressEvent{
+		Event:          event,
+		Time:           now.Format(time.RFC3339),
+		ElapsedSeconds: now.Sub(p.started).Seconds(),
+		Reads:          reads,
+		Considered:     considered,
+		Kept:           kept,
+		Rejected:       make(map[string]int),
+	}
+	for c, cont := range p.contamination {
+		n := 0
+		if rejected != nil {
+			n = rejected[c]
+		}
+		e.Rejected[cont.Filename] = n
+	}
+	e.BytesRead, e.BytesTotal = p.sample.Progress()
+	if err := p.encoder.Encode(e); err != nil {
+		logger.Fatalf("failed to write progress to %s: %v", args.ProgressJSON, err)
+	}
+}
+
+func (p *Progress) Update(reads, considered, kept int, rejected []int) {
+	if reads > 0 && p.due(reads) {
+		if p.encoder != nil {
+			p.emit("progress", reads, considered, kept, rejected)
+		}
+		if !p.bar {
+			kept_percent := float64(kept) / float64(considered) * 100
+			logger.Printf("considered %d out of %d so far, kept %0.1f%%\n", considered, reads, kept_percent)
+		}
+	}
+	if !p.bar {
+		return
+	}
+	if reads%progressClockInterval != 0 {
+		return
+	}
+	now := time.Now()
+	if now.Sub(p.drawn) < 200*time.Millisecond {
+		return
+	}
+	p.drawn = now
+	p.draw(reads, now)
+}
+
+// Whether the next progress report is due. Going by the clock keeps the log
+// from flooding on fast storage or going quiet on slow storage.
+func (p *Progress) due(reads int) bool {
+	if args.ProgressInterval <= 0 {
+		return reads%progressLogInterval == 0
+	}
+	if reads%progressClockInterval != 0 {
+		return false
+	}
+	now := time.Now()
+	if now.Sub(p.reported) < args.ProgressInterval {
+		return false
+	}
+	p.reported = now
+	return true
+}
+
+func (p *Progress) draw(reads int, now time.Time) {
+	elapsed := now.Sub(p.started)
+	rate := float64(reads) / elapsed.Seconds()
+	line := fmt.Sprintf("%d reads, %0.0f reads/s", reads, rate)
+	// Reading from a pipe or through samtools sort, there's no telling how
+	// much is left.
+	done, total := p.sample.Progress()
+	if total > 0 {
+		frac := float64(done) / float64(total)
+		filled := int(frac * progressBarWidth)
+		line = fmt.Sprintf("[%s%s] %5.1f%% %s", strings.Repeat("=", filled),
+			strings.Repeat(" ", progressBarWidth-filled), frac*100, line)
+		if done > 0 {
+			eta := time.Duration(float64(elapsed) * float64(total-done) / float64(done))
+			line += fmt.Sprintf(", ETA %s", eta.Round(time.Second))
+		}
+	}
+	fmt.Fprintf(os.Stderr, "\r\033[K%s", line)
+}
+
+// Finish the bar, leaving it at where the run ended, and send the done event.
+func (p *Progress) Done(reads, considered, kept int, rejected []int) {
+	if p.bar {
+		p.draw(reads, time.Now())
+		fmt.Fprintln(os.Stderr)
+	}
+	if p.encoder != nil {
+		p.emit("done", reads, considered, kept, rejected)
+		if p.events != os.Stdout && p.events != os.Stderr {
+			if err := p.events.Close(); err != nil {
+				logger.Fatal(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Whether an input (or output, for object storage) is a URL to stream
+// rather than a local file.
+func IsRemote(name string) bool {
+	return strings.HasPrefix(name, "htsget://") || IsObject(name) || IsHTTP(name)
+}
+
+func IsHTTP(name string) bool {
+	return strings.HasPrefix(name, "https://") || strings.HasPrefix(name, "http://")
+}
+
+// Whether a file is in S3 or Google Cloud Storage, which we go through the
+// aws and gcloud command line tools for, using whatever credentials they're
+// set up with.
+func IsObject(name string) bool {
+	return strings.HasPrefix(name, "s3://") || strings.HasPrefix(name, "gs://")
+}
+
+// The command copying an object to stdout, or with upload, from stdin to the
+// object. Both tools upload a stream in parts as it comes, and the object
+// only appears once it's all there.
+func objectCommand(name string, upload bool) *exec.Cmd {
+	from, to := name, "-"
+	if upload {
+		from, to = "-", name
+	}
+	if strings.HasPrefix(name, "gs://") {
+		return exec.Command("gcloud", "storage", "cp", from, to)
+	}
+	return exec.Command("aws", "s3", "cp", "--only-show-errors", from, to)
+}
+
+// Reads the output of a command, failing at the end if the command did.
+type commandReader struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	stderr bytes.Buffer
+}
+
+func openCommand(cmd *exec.Cmd) (*commandReader, error) {
+	r := &commandReader{cmd: cmd}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed creating pipe: %v", err)
+	}
+	r.ReadCloser = stdout
+	cmd.Stderr = &r.stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to run %s: %v", cmd.Path, err)
+	}
+	return r, nil
+}
+
+func (r *commandReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err == io.EOF {
+		if werr := r.cmd.Wait(); werr != nil {
+			return n, fmt.Errorf("%s failed: %v: %s", filepath.Base(r.cmd.Path), werr, strings.TrimSpace(r.stderr.String()))
+		}
+	}
+	return n, err
+}
+
+// Open an input to read from start to end, along with its size in bytes, or
+// 0 when that isn't known until it's all been read.
+func OpenSource(name string) (io.ReadCloser, int64, error) {
+	if strings.HasPrefix(name, "htsget://") {
+		r, err := OpenHtsget(name)
+		return r, 0, err
+	}
+	if IsObject(name) {
+		r, err := openCommand(objectCommand(name, false))
+		return r, 0, err
+	}
+	if IsHTTP(name) {
+		r, err := OpenHTTP(name, nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		return r, r.size, nil
+	}
+	fp, err := os.Open(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return nil, 0, err
+	}
+	return fp, info.Size(), nil
+}
+
+// The header of a remote input, read by streaming it to samtools, which stops
+// at the first record.
+func readRemoteHeader(name string) (string, error) {
+	r, _, err := OpenSource(name)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	cmd := viewCommand("-H", "-")
+	cmd.Stdin = r
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to read header: %v", err)
+	}
+	return string(output), nil
+}
+
+// A ticket from a GA4GH htsget server: the URLs whose contents, one after the
+// other, make up the BAM file.
+type htsgetTicket struct {
+	Htsget struct {
+		Format string `json:"format"`
+		URLs   []struct {
+			URL     string            `json:"url"`
+			Headers map[string]string `json:"headers"`
+		} `json:"urls"`
+	} `json:"htsget"`
+}
+
+// Reads the blocks of an htsget ticket in turn, fetching each as the one
+// before runs out.
+type htsgetReader struct {
+	ticket  htsgetTicket
+	next    int
+	current io.ReadCloser
+}
+
+// Open an htsget:// URL, which is the https:// URL of the reads on an htsget
+// server, e.g. htsget://example.org/reads/NA12878, with any query (such as
+// referenceName=chr1) passed along.
+func OpenHtsget(name string) (io.ReadCloser, error) {
+	url := "https://" + strings.TrimPrefix(name, "htsget://")
+	resp, err := OpenHTTP(url, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Close()
+	r := &htsgetReader{}
+	if err := json.NewDecoder(resp).Decode(&r.ticket); err != nil {
+		return nil, fmt.Errorf("bad htsget ticket: %v", err)
+	}
+	if format := r.ticket.Htsget.Format; format != "" && format != "BAM" {
+		return nil, fmt.Errorf("htsget server sent %s, not BAM", format)
+	}
+	return r, nil
+}
+
+func (r *htsgetReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if r.next == len(r.ticket.Htsget.URLs) {
+				return 0, io.EOF
+			}
+			block, err := r.open(r.next)
+			if err != nil {
+				return 0, err
+			}
+			r.current = block
+			r.next++
+		}
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Open one of the ticket's blocks, which is either inline as a data: URI or
+// fetched with the headers given for it.
+func (r *htsgetReader) open(i int) (io.ReadCloser, error) {
+	block := r.ticket.Htsget.URLs[i]
+	if strings.HasPrefix(block.URL, "data:") {
+		comma := strings.Index(block.URL, ",")
+		if comma < 0 || !strings.HasSuffix(block.URL[:comma], ";base64") {
+			return nil, fmt.Errorf("htsget block %d: expected a base64 data URI", i)
+		}
+		data, err := base64.StdEncoding.DecodeString(block.URL[comma+1:])
+		if err != nil {
+			return nil, fmt.Errorf("htsget block %d: %v", i, err)
+		}
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	resp, err := OpenHTTP(block.URL, block.Headers)
+	if err != nil {
+		return nil, fmt.Errorf("htsget block %d: %v", i, err)
+	}
+	return resp, nil
+}
+
+func (r *htsgetReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
+
+// How many times to retry a failed HTTP request, or a download cut off part
+// way, for -http-retries, and how long to wait before the first retry. The
+// wait doubles with each retry after that, up to maxHTTPBackoff.
+var httpRetries = 5
+var httpBackoff = time.Second
+
+const maxHTTPBackoff = time.Minute
+
+// How long to wait on a server, for the response to a request or for more of
+// a download, before taking it as a failed connection and retrying.
+const httpTimeout = time.Minute
+
+var httpClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   30 * time.Second,
+		ResponseHeaderTimeout: httpTimeout,
+		IdleConnTimeout:       90 * time.Second,
+	},
+}
+
+// Reads a file over HTTP, picking up where it left off with a range request
+// when the connection fails, so a long stream survives a network blip.
+type httpReader struct {
+	url     string
+	headers map[string]string
+	body    io.ReadCloser
+	cancel  context.CancelFunc // the request, when the body stalls
+	offset  int64
+	size    int64  // from the first response, or 0 if it didn't say
+	etag    string // to make sure a resumed download is of the same file
+	retries int    // in a row, since the last read that got anywhere
+	// The bytes asked for by a Range header among the headers, as htsget
+	// blocks have, with end -1 for the rest of the file. Start is -1 when
+	// there's a Range we can't resume within.
+	ranged     bool
+	rangeStart int64
+	rangeEnd   int64
+}
+
+func OpenHTTP(url string, headers map[string]string) (*httpReader, error) {
+	r := &httpReader{url: url, headers: headers}
+	for key, value := range headers {
+		if strings.EqualFold(key, "Range") {
+			r.ranged = true
+			r.rangeStart, r.rangeEnd = parseRange(value)
+		}
+	}
+	if err := r.connect(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// The first and last byte of a single "bytes=start-end" or "bytes=start-"
+// range, or -1 for both if it isn't one.
+func parseRange(value string) (int64, int64) {
+	from, to, ok := strings.Cut(strings.TrimPrefix(strings.TrimSpace(value), "bytes="), "-")
+	start, err := strconv.ParseInt(from, 10, 64)
+	if !ok || err != nil {
+		return -1, -1
+	}
+	if to == "" {
+		return start, -1
+	}
+	end, err := strconv.ParseInt(to, 10, 64)
+	if err != nil || end < start {
+		return -1, -1
+	}
+	return start, end
+}
+
+// Wait before the next retry, or give up with err once out of retries.
+func (r *httpReader) backoff(err error) error {
+	if r.retries >= httpRetries {
+		return fmt.Errorf("%s: %v (gave up after %d retries)", r.url, err, r.retries)
+	}
+	wait := httpBackoff << uint(r.retries)
+	if wait > maxHTTPBackoff {
+		wait = maxHTTPBackoff
+	}
+	r.retries++
+	logger.Warnf("%s: %v, retrying in %s\n", r.url, err, wait)
+	time.Sleep(wait)
+	return nil
+}
+
+// Request the rest of the file (or of the range asked for) from the current
+// offset, retrying server errors and failed connections. Client errors like
+// 404 aren't retried.
+func (r *httpReader) connect() error {
+	if r.ranged && r.offset > 0 && r.rangeStart < 0 {
+		return fmt.Errorf("%s: can't resume at byte %d within the range asked for", r.url, r.offset)
+	}
+	for {
+		ctx, cancel := context.WithCancel(context.Background())
+		req, err := http.NewRequestWithContext(ctx, "GET", r.url, nil)
+		if err != nil {
+			cancel()
+			return err
+		}
+		for key, value := range r.headers {
+			req.Header.Set(key, value)
+		}
+		if r.ranged && r.offset > 0 {
+			end := ""
+			if r.rangeEnd >= 0 {
+				end = fmt.Sprint(r.rangeEnd)
+			}
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%s", r.rangeStart+r.offset, end))
+		} else if r.offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", r.offset))
+		}
+		if r.offset > 0 {
+			if r.etag != "" {
+				req.Header.Set("If-Range", r.etag)
+			}
+		}
+		resp, err := httpClient.Do(req)
+		if err == nil && resp.StatusCode >= 500 {
+			resp.Body.Close()
+			err = fmt.Errorf("server said %s", resp.Status)
+		}
+		if err != nil {
+			cancel()
+			if err := r.backoff(err); err != nil {
+				return err
+			}
+			continue
+		}
+		switch {
+		case r.offset == 0 && (resp.StatusCode == http.StatusOK && !r.ranged || resp.StatusCode == http.StatusPartialContent && r.ranged):
+			r.size = resp.ContentLength
+			if r.size < 0 {
+				r.size = 0
+			}
+			r.etag = resp.Header.Get("ETag")
+		case r.offset > 0 && resp.StatusCode == http.StatusPartialContent:
+		case r.offset == 0 && resp.StatusCode == http.StatusOK:
+			resp.Body.Close()
+			cancel()
+			return fmt.Errorf("%s: the server doesn't support range requests", r.url)
+		case r.offset > 0 && resp.StatusCode == http.StatusOK:
+			resp.Body.Close()
+			cancel()
+			return fmt.Errorf("%s: can't resume at byte %d, the server doesn't support range requests or the file changed", r.url, r.offset)
+		default:
+			resp.Body.Close()
+			cancel()
+			return fmt.Errorf("%s: server said %s", r.url, resp.Status)
+		}
+		r.body = resp.Body
+		r.cancel = cancel
+		return nil
+	}
+}
+
+func (r *httpReader) Read(p []byte) (int, error) {
+	for {
+		// A server that stops sending without closing the connection would
+		// otherwise hang the run, so give up on the request after a while.
+		timer := time.AfterFunc(httpTimeout, r.cancel)
+		n, err := r.body.Read(p)
+		if !timer.Stop() {
+			err = fmt.Errorf("no data for %s", httpTimeout)
+		}
+		r.offset += int64(n)
+		if n > 0 {
+			r.retries = 0
+		}
+		if err == io.EOF && r.size > 0 && r.offset < r.size {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		// Cut off: reconnect for the rest, handing back what we got first.
+		r.body.Close()
+		r.cancel()
+		if err := r.backoff(err); err != nil {
+			return n, err
+		}
+		if err := r.connect(); err != nil {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (r *httpReader) Close() error {
+	defer r.cancel()
+	return r.body.Close()
+}
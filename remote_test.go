@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		value      string
+		start, end int64
+	}{
+		{"bytes=0-99", 0, 99},
+		{"bytes=100-", 100, -1},
+		{" bytes=5-5 ", 5, 5},
+		{"bytes=10-5", -1, -1},
+		{"bytes=-500", -1, -1},
+		{"bytes=0-9,20-29", -1, -1},
+		{"bytes=x-9", -1, -1},
+		{"bytes", -1, -1},
+		{"", -1, -1},
+	}
+	for _, test := range tests {
+		start, end := parseRange(test.value)
+		if start != test.start || end != test.end {
+			t.Errorf("parseRange(%q) = %d, %d, want %d, %d", test.value, start, end, test.start, test.end)
+		}
+	}
+}
+
+// Stops a response after limit bytes of the body, as a dropped connection
+// would.
+type cutWriter struct {
+	http.ResponseWriter
+	limit int
+}
+
+func (w *cutWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		n, _ := w.ResponseWriter.Write(p[:w.limit])
+		w.limit = 0
+		return n, errors.New("cut off")
+	}
+	w.limit -= len(p)
+	return w.ResponseWriter.Write(p)
+}
+
+// A server for content that cuts off the first response to each client
+// after cut bytes, recording the Range of each request.
+func cuttingServer(t *testing.T, content []byte, cut int) (*httptest.Server, *[]string) {
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ranges = append(ranges, req.Header.Get("Range"))
+		w.Header().Set("ETag", `"v1"`)
+		if len(ranges) == 1 {
+			w = &cutWriter{w, cut}
+		}
+		http.ServeContent(w, req, "reads.bam", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(server.Close)
+	return server, &ranges
+}
+
+func quickRetries(t *testing.T) {
+	backoff := httpBackoff
+	httpBackoff = time.Millisecond
+	t.Cleanup(func() { httpBackoff = backoff })
+}
+
+func TestHTTPResume(t *testing.T) {
+	quickRetries(t)
+	content := []byte(strings.Repeat("0123456789", 1000))
+	server, ranges := cuttingServer(t, content, 2500)
+	r, err := OpenHTTP(server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatalf("read %d bytes, want the %d served", len(got), len(content))
+	}
+	if len(*ranges) != 2 || (*ranges)[0] != "" || (*ranges)[1] != "bytes=2500-" {
+		t.Errorf("requested ranges %q, want none then bytes=2500-", *ranges)
+	}
+}
+
+func TestHTTPResumeWithinRange(t *testing.T) {
+	quickRetries(t)
+	content := []byte(strings.Repeat("abcdefghij", 1000))
+	server, ranges := cuttingServer(t, content, 1000)
+	r, err := OpenHTTP(server.URL, map[string]string{"Range": "bytes=3000-5999"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content[3000:6000]) {
+		t.Fatalf("read %d bytes, want the 3000 asked for", len(got))
+	}
+	if len(*ranges) != 2 || (*ranges)[1] != "bytes=4000-5999" {
+		t.Errorf("requested ranges %q, want bytes=3000-5999 then bytes=4000-5999", *ranges)
+	}
+}
+
+func TestHTTPNoResumeWithinUnknownRange(t *testing.T) {
+	quickRetries(t)
+	content := []byte(strings.Repeat("abcdefghij", 1000))
+	server, _ := cuttingServer(t, content, 1000)
+	r, err := OpenHTTP(server.URL, map[string]string{"Range": "bytes=0-99,3000-5999"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := io.ReadAll(r); err == nil || !strings.Contains(err.Error(), "can't resume") {
+		t.Errorf("got error %v, want one saying it can't resume", err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// What a run took of the machine, for sizing the memory to ask a cluster
+// scheduler for. This is of contfilter itself, not the samtools it runs.
+type ResourceStats struct {
+	// The most resident memory the process had at once, in bytes. Where the
+	// system doesn't say (it's read from /proc), this is the memory the Go
+	// runtime got from it instead, which is at least as much as the heap
+	// reached.
+	PeakRSS int64 `json:"peak_rss_bytes"`
+	// Bytes allocated over the run, however much was freed again.
+	TotalAlloc uint64  `json:"total_alloc_bytes"`
+	GCs        uint32  `json:"gc_count"`
+	GCPause    float64 `json:"gc_pause_seconds"`
+}
+
+func ReadResources() *ResourceStats {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	r := &ResourceStats{
+		PeakRSS:    peakRSS(),
+		TotalAlloc: mem.TotalAlloc,
+		GCs:        mem.NumGC,
+		GCPause:    time.Duration(mem.PauseTotalNs).Seconds(),
+	}
+	if r.PeakRSS == 0 {
+		r.PeakRSS = int64(mem.Sys)
+	}
+	return r
+}
+
+// The high water mark of resident memory from /proc/self/status, or 0 if
+// there isn't one.
+func peakRSS() int64 {
+	fp, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0
+	}
+	defer fp.Close()
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 3 && fields[0] == "VmHWM:" && fields[2] == "kB" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0
+			}
+			return kb * 1024
+		}
+	}
+	return 0
+}
+
+// Merged runs were separate processes, so the peak is the biggest of them
+// rather than the sum.
+func (r *ResourceStats) Add(other *ResourceStats) {
+	if other.PeakRSS > r.PeakRSS {
+		r.PeakRSS = other.PeakRSS
+	}
+	r.TotalAlloc += other.TotalAlloc
+	r.GCs += other.GCs
+	r.GCPause += other.GCPause
+}
+
+func (r *ResourceStats) Log() {
+	logger.Printf("peak memory %s, %s allocated in all, %d garbage collections pausing for %0.3fs\n",
+		formatBytes(uint64(r.PeakRSS)), formatBytes(r.TotalAlloc), r.GCs, r.GCPause)
+}
+
+func formatBytes(n uint64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	size := float64(n)
+	unit := 0
+	for size >= 1024 && unit < len(units)-1 {
+		size /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d B", n)
+	}
+	return fmt.Sprintf("%0.1f %s", size, units[unit])
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Results kept across runs in a SQLite database for -results-db, written with
+// the sqlite3 command line tool. Each run is one transaction, so a run that
+// fails part way leaves nothing behind.
+type ResultsDB struct {
+	RunID    string
+	Filename string
+	started  time.Time
+	cmd      *exec.Cmd
+	stdin    io.WriteCloser
+	w        *bufio.Writer
+	stderr   bytes.Buffer
+}
+
+const resultsSchema = `CREATE TABLE IF NOT EXISTS runs (
+	run_id TEXT PRIMARY KEY,
+	started TEXT,
+	finished TEXT,
+	version TEXT,
+	sample TEXT,
+	command TEXT,
+	parameters TEXT,
+	total_reads INTEGER,
+	total_read_mates INTEGER,
+	excluded INTEGER,
+	too_short INTEGER,
+	too_diverged INTEGER,
+	considered INTEGER,
+	reads_kept INTEGER,
+	read_mates_kept INTEGER
+);
+CREATE TABLE IF NOT EXISTS contaminants (
+	run_id TEXT,
+	filename TEXT,
+	reads_found INTEGER,
+	reads_rejected INTEGER
+);
+CREATE TABLE IF NOT EXISTS decisions (
+	run_id TEXT,
+	read TEXT,
+	sample_score REAL,
+	contaminant TEXT,
+	contaminant_score REAL,
+	outcome TEXT,
+	reason TEXT
+);
+`
+
+func OpenResultsDB(filename string) (*ResultsDB, error) {
+	db := &ResultsDB{Filename: filename, started: time.Now()}
+	host, _ := os.Hostname()
+	db.RunID = fmt.Sprintf("%s-%s-%d", db.started.Format("20060102T150405"), host, os.Getpid())
+	db.cmd = exec.Command("sqlite3", "-bail", filename)
+	db.cmd.Stderr = &db.stderr
+	var err error
+	db.stdin, err = db.cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := db.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to run sqlite3 for %s: %v", filename, err)
+	}
+	db.w = bufio.NewWriter(db.stdin)
+	db.w.WriteString(resultsSchema)
+	db.w.WriteString("BEGIN;\n")
+	return db, nil
+}
+
+// Quote a value for SQL, with nil as NULL.
+func sqlValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		return "'" + strings.Replace(v, "'", "''", -1) + "'"
+	case float64:
+		return fmt.Sprintf("%g", v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func (db *ResultsDB) insert(table string, values ...interface{}) {
+	quoted := []string{sqlValue(db.RunID)}
+	for _, v := range values {
+		quoted = append(quoted, sqlValue(v))
+	}
+	fmt.Fprintf(db.w, "INSERT INTO %s VALUES (%s);\n", table, strings.Join(quoted, ","))
+}
+
+// Record a read's decision, with the values of the -decisions columns.
+func (db *ResultsDB) Decision(values ...interface{}) {
+	db.insert("decisions", values...)
+}
+
+// Record the run's parameters and counts and commit it all.
+func (db *ResultsDB) Finish(stats *RunStats) error {
+	params, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	db.insert("runs", db.started.Format(time.RFC3339), time.Now().Format(time.RFC3339), Version,
+		sampleName(), strings.Join(os.Args, " "), string(params),
+		stats.TotalReads, stats.TotalMates, stats.Excluded, stats.TooShort,
+		stats.TooDiverged, stats.Considered, stats.Kept, stats.KeptMates)
+	for _, cont := range stats.Contaminants {
+		db.insert("contaminants", cont.Filename, cont.Found, cont.Rejected)
+	}
+	db.w.WriteString("COMMIT;\n")
+	if err := db.w.Flush(); err != nil {
+		return fmt.Errorf("failed to write to %s: %v: %s", db.Filename, err, db.stderr.String())
+	}
+	db.stdin.Close()
+	if err := db.cmd.Wait(); err != nil {
+		return fmt.Errorf("sqlite3 failed on %s: %v: %s", db.Filename, err, strings.TrimSpace(db.stderr.String()))
+	}
+	return nil
+}
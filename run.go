@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The inputs of a run, checked and opened: the sample and the contamination
+// mappings, the aligners that produced them and where each mapping's
+// alignments come from.
+type Run struct {
+	Contamination []*Contaminant
+	Sources       []AlignmentSource
+	Sample        *BamScanner
+	SampleHeader  string
+	SampleSorted  bool // being sorted by name on the fly
+	SampleAligner *Aligner
+}
+
+func OpenRun(contArgs []string) (*Run, error) {
+	run := &Run{}
+	contArgs, err := ExpandContaminants(contArgs)
+	if err != nil {
+		return nil, err
+	}
+	for _, arg := range contArgs {
+		cont, err := ParseContaminant(arg)
+		if err != nil {
+			return nil, err
+		}
+		logger.Println("contamination mapping:", cont)
+		run.Contamination = append(run.Contamination, cont)
+	}
+	if args.Blacklist != "" {
+		blacklist, err := ReadIntervals(args.Blacklist)
+		if err != nil {
+			return nil, err
+		}
+		logger.Printf("read %d blacklisted regions from %s\n", len(blacklist.Genes), args.Blacklist)
+		for _, cont := range run.Contamination {
+			if cont.Blacklist == nil {
+				cont.Blacklist = blacklist
+			}
+		}
+	}
+	dups, why, err := DuplicateContaminants(run.Contamination)
+	if err != nil {
+		return nil, err
+	}
+	if len(dups) > 0 {
+		unique := []*Contaminant{}
+		for i, cont := range run.Contamination {
+			j, ok := dups[i]
+			if !ok {
+				unique = append(unique, cont)
+				continue
+			}
+			first := run.Contamination[j].Filename
+			if !args.DedupeContamination {
+				return nil, fmt.Errorf("%s %s %s, so its rejections would count twice; "+
+					"give it once or use -dedupe-contamination", cont.Filename, why[i], first)
+			}
+			logger.Warnf("leaving out %s, which %s %s\n", cont.Filename, why[i], first)
+		}
+		run.Contamination = unique
+	}
+	if args.Fastq != "" {
+		return run, run.openAligning()
+	}
+
+	inputs := []string{}
+	if args.Sample != "" {
+		inputs = append(inputs, args.Sample)
+	}
+	for _, cont := range run.Contamination {
+		if IsFasta(cont.Filename) {
+			continue
+		}
+		index, err := FindIndex(cont.Filename, cont.IndexFile)
+		if err != nil {
+			return nil, err
+		}
+		// The index goes next to the BAM, so can't be made for a remote one.
+		if index == nil && args.AutoIndex && !IsRemote(cont.Filename) {
+			index, err = AutoIndex(cont.Filename, cont.IndexFile)
+			if err != nil {
+				return nil, err
+			}
+		}
+		cont.Index = index
+		if cont.Index != nil {
+			// Indexed files are looked up by name so needn't be sorted.
+			logger.Printf("looking up reads of %s in %s\n", cont.Filename, cont.Index.Filename)
+			continue
+		}
+		inputs = append(inputs, cont.Filename)
+	}
+	checked, err := CheckInputs(inputs)
+	if err != nil {
+		return nil, err
+	}
+	args.SortOrder, err = ChooseNameOrder(checked)
+	if err != nil {
+		return nil, err
+	}
+	if args.SortOrder == "lexicographic" {
+		nameCmp = strings.Compare
+	}
+
+	// References are aligned to as we go, their header coming from the stream.
+	aligned := make(map[*Contaminant]*BamScanner)
+	for _, cont := range run.Contamination {
+		if !IsFasta(cont.Filename) {
+			continue
+		}
+		contScanner := &BamScanner{}
+		if err := openExtracted(contScanner, cont.Filename); err != nil {
+			return nil, err
+		}
+		header, err := contScanner.ReadHeader()
+		if err != nil {
+			return nil, err
+		}
+		checked[cont.Filename] = &Input{Filename: cont.Filename, Header: header}
+		aligned[cont] = contScanner
+	}
+
+	// The sample's header comes from the stream itself when it's piped in.
+	run.Sample = &BamScanner{}
+	if args.Sample == "" {
+		run.Sample.OpenStdin()
+		run.SampleHeader, err = run.Sample.ReadHeader()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if err := OpenInput(run.Sample, checked[args.Sample]); err != nil {
+			return nil, err
+		}
+		run.SampleHeader = checked[args.Sample].Header
+		run.SampleSorted = checked[args.Sample].Sort
+	}
+	if args.HeaderFrom != "" {
+		run.SampleHeader, err = ReadHeaderFile(args.HeaderFrom)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if args.Sample == "" {
+		if run.SampleHeader == "" {
+			return nil, fmt.Errorf("no header on stdin, pipe in samtools view -h or use -header-from")
+		}
+		if _, err := CheckSortOrder("stdin", run.SampleHeader, false); err != nil {
+			return nil, err
+		}
+	}
+
+	run.SampleAligner = ChooseAligner(sampleName(), run.SampleHeader)
+	logger.Printf("sample %s: %s, edit distance from %s\n", sampleName(), run.SampleAligner.Name, run.SampleAligner.EditTag)
+	for _, cont := range run.Contamination {
+		if cont.Index != nil {
+			cont.Aligner = ChooseAligner(cont.Filename, cont.Index.Header)
+		} else {
+			cont.Aligner = ChooseAligner(cont.Filename, checked[cont.Filename].Header)
+		}
+		logger.Printf("contamination %s: %s, edit distance from %s\n", cont.Filename, cont.Aligner.Name, cont.Aligner.EditTag)
+		if cont.Aligner.Name != run.SampleAligner.Name {
+			logger.Warnf("%s was aligned with %s but the sample with %s, scores may not be comparable\n",
+				cont.Filename, cont.Aligner.Name, run.SampleAligner.Name)
+		}
+	}
+
+	for _, cont := range run.Contamination {
+		if contScanner, ok := aligned[cont]; ok {
+			run.Sources = append(run.Sources, contScanner)
+			continue
+		}
+		if cont.Index != nil {
+			if checksums != nil {
+				logger.Warnf("%s is read through its index, not verifying it against -checksums\n", cont.Filename)
+			}
+			run.Sources = append(run.Sources, cont.Index)
+			continue
+		}
+		contScanner := &BamScanner{}
+		if err := OpenInput(contScanner, checked[cont.Filename]); err != nil {
+			return nil, err
+		}
+		run.Sources = append(run.Sources, contScanner)
+	}
+	return run, nil
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SAM FLAG bits.
+const (
+	FlagPaired        = 0x1
+	FlagProperPair    = 0x2
+	FlagUnmapped      = 0x4
+	FlagMateUnmapped  = 0x8
+	FlagReverse       = 0x10
+	FlagMateReverse   = 0x20
+	FlagRead1         = 0x40
+	FlagRead2         = 0x80
+	FlagSecondary     = 0x100
+	FlagQCFail        = 0x200
+	FlagDuplicate     = 0x400
+	FlagSupplementary = 0x800
+)
+
+// Names for FLAG bits as samtools accepts them.
+var flagNames = map[string]int{
+	"PAIRED":        FlagPaired,
+	"PROPER_PAIR":   FlagProperPair,
+	"UNMAP":         FlagUnmapped,
+	"MUNMAP":        FlagMateUnmapped,
+	"REVERSE":       FlagReverse,
+	"MREVERSE":      FlagMateReverse,
+	"READ1":         FlagRead1,
+	"READ2":         FlagRead2,
+	"SECONDARY":     FlagSecondary,
+	"QCFAIL":        FlagQCFail,
+	"DUP":           FlagDuplicate,
+	"SUPPLEMENTARY": FlagSupplementary,
+}
+
+// A set of FLAG bits given on the command line, either as a number (decimal,
+// or hex with 0x) or as a comma-separated list of names like samtools takes.
+type SamFlags int
+
+func (f *SamFlags) String() string {
+	return fmt.Sprintf("%#x", int(*f))
+}
+
+func (f *SamFlags) Set(value string) error {
+	flags, err := ParseFlags(value)
+	if err != nil {
+		return err
+	}
+	*f = SamFlags(flags)
+	return nil
+}
+
+func ParseFlags(value string) (int, error) {
+	if n, err := strconv.ParseInt(value, 0, 32); err == nil {
+		return int(n), nil
+	}
+	flags := 0
+	for _, name := range strings.Split(value, ",") {
+		bit, ok := flagNames[strings.ToUpper(strings.TrimSpace(name))]
+		if !ok {
+			return 0, fmt.Errorf("unknown FLAG name %q", name)
+		}
+		flags |= bit
+	}
+	return flags, nil
+}
+
+func recordFlag(record []string) (int, error) {
+	if len(record) < 2 {
+		return 0, fmt.Errorf("too few fields")
+	}
+	flag, err := strconv.Atoi(record[1])
+	if err != nil {
+		return 0, fmt.Errorf("malformed FLAG field: %s", record[1])
+	}
+	return flag, nil
+}
+
+// The record with FLAG bits set and cleared, for -set-flags and -clear-flags.
+// The record itself is left as it was.
+func EditFlag(record []string, set, clear int) ([]string, error) {
+	if set == 0 && clear == 0 {
+		return record, nil
+	}
+	flag, err := recordFlag(record)
+	if err != nil {
+		return nil, err
+	}
+	edited := append([]string{}, record...)
+	edited[1] = strconv.Itoa(flag&^clear | set)
+	return edited, nil
+}
+
+// The FLAG bits that only make sense for a read whose mate is present.
+const pairFlags = FlagPaired | FlagProperPair | FlagMateUnmapped | FlagMateReverse | FlagRead1 | FlagRead2
+
+// Turn an alignment of a paired read into one of a single-end read, for when
+// its mate won't be written. Clears the pairing FLAG bits, resets RNEXT, PNEXT
+// and TLEN, and drops the MC tag, so the output passes validation.
+func MakeSingleton(record []string) ([]string, error) {
+	flag, err := recordFlag(record)
+	if err != nil {
+		return nil, err
+	}
+	if flag&FlagPaired == 0 || len(record) < 11 {
+		return record, nil
+	}
+	single := make([]string, 0, len(record))
+	single = append(single, record[:11]...)
+	single[1] = strconv.Itoa(flag &^ pairFlags)
+	single[6] = "*"
+	single[7] = "0"
+	single[8] = "0"
+	for _, tag := range record[11:] {
+		if !strings.HasPrefix(tag, "MC:") {
+			single = append(single, tag)
+		}
+	}
+	return single, nil
+}
+
+// The value of an optional field, by its two letter tag.
+func findTag(record []string, tag string) (string, bool) {
+	for _, field := range record[11:] {
+		if len(field) >= 5 && field[:2] == tag && field[2] == ':' && field[4] == ':' {
+			return field[5:], true
+		}
+	}
+	return "", false
+}
+
+type CigarOp struct {
+	Len int
+	Op  byte
+}
+
+func ParseCigar(cigar string) ([]CigarOp, error) {
+	if cigar == "*" {
+		return nil, nil
+	}
+	ops := []CigarOp{}
+	n := 0
+	digits := false
+	for i := 0; i < len(cigar); i++ {
+		c := cigar[i]
+		if c >= '0' && c <= '9' {
+			n = n*10 + int(c-'0')
+			digits = true
+			continue
+		}
+		if !digits || strings.IndexByte("MIDNSHP=X", c) < 0 {
+			return nil, fmt.Errorf("malformed CIGAR: %s", cigar)
+		}
+		ops = append(ops, CigarOp{n, c})
+		n = 0
+		digits = false
+	}
+	if digits {
+		return nil, fmt.Errorf("malformed CIGAR: %s", cigar)
+	}
+	return ops, nil
+}
+
+// The length of an alignment from its CIGAR: the read bases aligned to the
+// reference or inserted, and optionally the deleted reference bases. Skipped
+// regions (N, i.e. introns) and clipping never count.
+func AlignedLength(ops []CigarOp, deletions bool) int {
+	length := 0
+	for _, op := range ops {
+		switch op.Op {
+		case 'M', 'I', '=', 'X':
+			length += op.Len
+		case 'D':
+			if deletions {
+				length += op.Len
+			}
+		}
+	}
+	return length
+}
+
+// The length of the read, clipped bases and all.
+func ReadLength(ops []CigarOp) int {
+	length := 0
+	for _, op := range ops {
+		switch op.Op {
+		case 'M', 'I', 'S', 'H', '=', 'X':
+			length += op.Len
+		}
+	}
+	return length
+}
+
+// The number of read bases soft clipped at either end.
+func SoftClipped(ops []CigarOp) int {
+	clipped := 0
+	for _, op := range ops {
+		if op.Op == 'S' {
+			clipped += op.Len
+		}
+	}
+	return clipped
+}
+
+// The number of reference bases an alignment covers.
+func ReferenceSpan(ops []CigarOp) int {
+	span := 0
+	for _, op := range ops {
+		switch op.Op {
+		case 'M', 'D', 'N', '=', 'X':
+			span += op.Len
+		}
+	}
+	return span
+}
+
+// The reference position the 5' end of the read would have if it weren't
+// clipped, which is what duplicate marking goes by.
+func UnclippedFivePrime(record []string, flag int) (int, error) {
+	pos, err := strconv.Atoi(record[3])
+	if err != nil {
+		return 0, fmt.Errorf("malformed POS field: %s", record[3])
+	}
+	ops, err := ParseCigar(record[5])
+	if err != nil || len(ops) == 0 {
+		return pos, err
+	}
+	if flag&FlagReverse == 0 {
+		for _, op := range ops {
+			if op.Op != 'S' && op.Op != 'H' {
+				break
+			}
+			pos -= op.Len
+		}
+		return pos, nil
+	}
+	end := pos + ReferenceSpan(ops) - 1
+	for i := len(ops) - 1; i >= 0 && (ops[i].Op == 'S' || ops[i].Op == 'H'); i-- {
+		end += ops[i].Len
+	}
+	return end, nil
+}
+
+// Check a record against the SAM spec, for -strict: the field count, the
+// numeric fields, FLAG bits that only make sense for paired reads, CIGAR
+// agreeing with SEQ and QUAL, and the syntax of the optional fields.
+func CheckRecord(record []string) error {
+	if len(record) < 11 {
+		return fmt.Errorf("only %d fields, not 11 or more", len(record))
+	}
+	flag, err := strconv.Atoi(record[1])
+	if err != nil || flag < 0 || flag > 0xffff {
+		return fmt.Errorf("malformed FLAG field: %s", record[1])
+	}
+	if flag&FlagPaired == 0 && flag&(pairFlags&^FlagPaired) != 0 {
+		return fmt.Errorf("FLAG %d has mate bits (%#x) without the paired bit", flag, flag&(pairFlags&^FlagPaired))
+	}
+	for _, field := range []struct {
+		name  string
+		value string
+		max   int
+	}{{"POS", record[3], 1<<31 - 1}, {"MAPQ", record[4], 255}, {"PNEXT", record[7], 1<<31 - 1}} {
+		if n, err := strconv.Atoi(field.value); err != nil || n < 0 || n > field.max {
+			return fmt.Errorf("malformed %s field: %s", field.name, field.value)
+		}
+	}
+	if _, err := strconv.Atoi(record[8]); err != nil {
+		return fmt.Errorf("malformed TLEN field: %s", record[8])
+	}
+	ops, err := ParseCigar(record[5])
+	if err != nil {
+		return err
+	}
+	seq, qual := record[9], record[10]
+	if len(ops) > 0 && seq != "*" {
+		length := 0
+		for _, op := range ops {
+			switch op.Op {
+			case 'M', 'I', 'S', '=', 'X':
+				length += op.Len
+			}
+		}
+		if length != len(seq) {
+			return fmt.Errorf("CIGAR %s is of %d bases but SEQ has %d", record[5], length, len(seq))
+		}
+	}
+	if qual != "*" && (seq == "*" || len(qual) != len(seq)) {
+		return fmt.Errorf("QUAL has %d bases but SEQ has %d", len(qual), len(seq))
+	}
+	for _, tag := range record[11:] {
+		if err := checkTag(tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkTag(tag string) error {
+	if len(tag) < 5 || tag[2] != ':' || tag[4] != ':' || !isAlpha(tag[0]) || !(isAlpha(tag[1]) || isDigit(tag[1])) {
+		return fmt.Errorf("malformed optional field: %s", tag)
+	}
+	value := tag[5:]
+	ok := true
+	switch tag[3] {
+	case 'A':
+		ok = len(value) == 1 && value[0] >= '!' && value[0] <= '~'
+	case 'i':
+		_, err := strconv.ParseInt(value, 10, 64)
+		ok = err == nil
+	case 'f':
+		_, err := strconv.ParseFloat(value, 32)
+		ok = err == nil
+	case 'Z':
+	case 'H':
+		ok = len(value)%2 == 0 && strings.Trim(strings.ToUpper(value), "0123456789ABCDEF") == ""
+	case 'B':
+		elements := strings.Split(value, ",")
+		ok = len(elements[0]) == 1 && strings.IndexByte("cCsSiIf", elements[0][0]) >= 0
+		for _, element := range elements[1:] {
+			if !ok {
+				break
+			}
+			var err error
+			if elements[0] == "f" {
+				_, err = strconv.ParseFloat(element, 32)
+			} else {
+				_, err = strconv.ParseInt(element, 10, 64)
+			}
+			ok = err == nil
+		}
+	default:
+		return fmt.Errorf("optional field %s has unknown type %c", tag, tag[3])
+	}
+	if !ok {
+		return fmt.Errorf("malformed %c value in optional field: %s", tag[3], tag)
+	}
+	return nil
+}
+
+func isAlpha(c byte) bool {
+	return (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// The numbers we score an alignment by.
+type Alignment struct {
+	Len             int
+	EditDist        int
+	AlignerScore    float64 // from the aligner's score tag with -score-tag
+	HasAlignerScore bool
+	Clipped         int     // soft-clipped bases
+	QualityDiscount float64 // taken off the edit distance with -quality-weight
+}
+
+func (a *Alignment) Score(penalty float64) float64 {
+	if a.HasAlignerScore {
+		return a.AlignerScore
+	}
+	dist := float64(a.EditDist) - a.QualityDiscount
+	return float64(a.Len) - dist*penalty - float64(a.Clipped)*args.ClipPenalty
+}
+
+// Pull the length and edit distance out of an alignment, using the tags of the
+// aligner that produced it.
+func ParseAlignment(row []string, aligner *Aligner) (*Alignment, error) {
+	if len(row) < 11 {
+		return nil, fmt.Errorf("too few fields")
+	}
+	a := &Alignment{}
+	cigarLength := args.LongRead || args.Length == "cigar"
+	if cigarLength || args.ClipPenalty != 0 {
+		ops, err := ParseCigar(row[5])
+		if err != nil {
+			return nil, err
+		}
+		if cigarLength {
+			a.Len = AlignedLength(ops, countDeletions())
+		}
+		a.Clipped = SoftClipped(ops)
+	}
+	if !cigarLength {
+		a.Len = len(row[9])
+	}
+	var err error
+	if args.LongRead {
+		err = a.parseDivergence(row, aligner)
+	} else {
+		a.EditDist, err = intTag(row, aligner.EditTag, "edit distance")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if args.QualityWeight {
+		discount, err := QualityDiscount(row)
+		if err != nil {
+			return nil, err
+		}
+		// The tag may not count every mismatch MD shows (STAR's nM is per
+		// pair, for one), but never give back more than it charged.
+		a.QualityDiscount = math.Min(discount, float64(a.EditDist))
+	}
+	if aligner.ScoreTag != "" {
+		value, ok := findTag(row, aligner.ScoreTag)
+		if !ok {
+			return nil, fmt.Errorf("missing %s score tag", aligner.ScoreTag)
+		}
+		a.AlignerScore, err = strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse score: %s", value)
+		}
+		a.HasAlignerScore = true
+	}
+	return a, nil
+}
+
+// Leave out the records that can't be parsed for scoring, for
+// -skip-malformed, returning how many there were and the first one's error.
+func DropMalformed(records [][]string, aligner *Aligner) ([][]string, int, error) {
+	kept := records[:0]
+	dropped := 0
+	var first error
+	for _, record := range records {
+		flag, err := recordFlag(record)
+		if err == nil && flag&FlagUnmapped == 0 {
+			_, err = ParseAlignment(record, aligner)
+		}
+		if err != nil {
+			if logger.Enabled(LevelDebug) {
+				logger.Debugf("skipping malformed record of %s: %v\n", record[0], err)
+			}
+			dropped++
+			if first == nil {
+				first = fmt.Errorf("read %s: %v", record[0], err)
+			}
+			continue
+		}
+		kept = append(kept, record)
+	}
+	return kept, dropped, first
+}
+
+func intTag(row []string, tag, what string) (int, error) {
+	value, ok := findTag(row, tag)
+	if !ok {
+		return 0, fmt.Errorf("missing %s %s tag", tag, what)
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse %s: %s", what, value)
+	}
+	return n, nil
+}
+
+// Whether deleted reference bases count toward the alignment length. Long
+// reads go by the alignment block length, as minimap2 reports it, which
+// includes them.
+func countDeletions() bool {
+	return args.Deletions == "count" || (args.Deletions == "auto" && args.LongRead)
+}
+
+// For long reads the length always comes from the CIGAR since SEQ is often
+// omitted from secondary alignments. The edit distance comes from the
+// gap-compressed divergence when it's there, else from the aligner's edit
+// distance tag.
+func (a *Alignment) parseDivergence(row []string, aligner *Aligner) error {
+	var err error
+	if de, ok := findTag(row, "de"); ok {
+		divergence, err := strconv.ParseFloat(de, 64)
+		if err != nil {
+			return fmt.Errorf("failed to parse divergence: %s", de)
+		}
+		a.EditDist = int(math.Round(divergence * float64(a.Len)))
+		return nil
+	}
+	a.EditDist, err = intTag(row, aligner.EditTag, "edit distance")
+	return err
+}
+
+// Combine the scores of both mates of a read for -pair-score sum or mean.
+func PairScore(score1, score2 float64) float64 {
+	if args.PairScore == "mean" {
+		return (score1 + score2) / 2
+	}
+	return score1 + score2
+}
+
+// Score a sample read for comparison with a contamination mapping that uses
+// the given edit penalty: by its better mate, or both mates combined when
+// scoring pairs. Also returns the length the score is based on, combined the
+// same way.
+func SampleScore(mate1, mate2 *Mate, penalty float64, pair bool) (float64, float64) {
+	score := mate1.Score(penalty)
+	length := float64(mate1.Len)
+	if mate2 == nil {
+		return score, length
+	}
+	score2 := mate2.Score(penalty)
+	length2 := float64(mate2.Len)
+	if pair {
+		return PairScore(score, score2), PairScore(length, length2)
+	}
+	if score2 > score {
+		return score2, length2
+	}
+	return score, length
+}
+
+// Score a read's alignments in a contamination mapping as a pair: the best
+// usable alignment of each mate, combined as with the sample. A mate without
+// such an alignment contributes nothing. Returns false if neither mate has one.
+func ContaminantPairScore(alignments [][]string, cont *Contaminant) (float64, bool, error) {
+	var best [2]float64
+	var have [2]bool
+	for _, alignment := range alignments {
+		flag, err := recordFlag(alignment)
+		if err != nil {
+			return 0, false, err
+		}
+		a, err := ParseAlignment(alignment, cont.Aligner)
+		if err != nil {
+			return 0, false, err
+		}
+		if !cont.Usable(a) {
+			continue
+		}
+		m := 0
+		if flag&FlagRead2 != 0 {
+			m = 1
+		}
+		score := a.Score(cont.Penalty)
+		if !have[m] || score > best[m] {
+			best[m] = score
+			have[m] = true
+		}
+	}
+	if !have[0] && !have[1] {
+		return 0, false, nil
+	}
+	return PairScore(best[0], best[1]), true, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+)
+
+// Settings for simulated data.
+type Simulation struct {
+	Reads        int
+	ReadLen      int
+	Contaminated float64 // fraction of reads that come from the contaminant
+	CrossMapped  float64 // fraction of the others that map to it too, but worse
+	SampleEdits  int     // most edits in a sample alignment
+	ContEdits    int     // most edits in a contaminated read's contamination alignment
+	Seed         int64
+}
+
+// Write the pair of name-sorted BAMs and a table of which reads are
+// contaminated. Contaminated reads align in the contamination with one or two
+// fewer edits than in the sample, and cross-mapped reads with two or three
+// more, so the filter at its defaults should tell them apart exactly.
+func (sim *Simulation) Write(samplefile, contfile, truthfile string) (int, error) {
+	rng := rand.New(rand.NewSource(sim.Seed))
+	sampleOut := BamWriter{Level: -1}
+	samplefp, err := sampleOut.Open(samplefile)
+	if err != nil {
+		return 0, err
+	}
+	contOut := BamWriter{Level: -1}
+	contfp, err := contOut.Open(contfile)
+	if err != nil {
+		return 0, err
+	}
+	truthfp, err := os.Create(truthfile)
+	if err != nil {
+		return 0, err
+	}
+	sample := bufio.NewWriter(samplefp)
+	cont := bufio.NewWriter(contfp)
+	truth := bufio.NewWriter(truthfp)
+	io.WriteString(sample, syntheticHeader)
+	io.WriteString(cont, syntheticHeader)
+	fmt.Fprintln(truth, "read\tcontaminated")
+
+	contaminated := 0
+	for i := 0; i < sim.Reads; i++ {
+		name := fmt.Sprintf("read%d", i+1)
+		sampleEdits := rng.Intn(sim.SampleEdits + 1)
+		contEdits := -1
+		isContaminated := rng.Float64() < sim.Contaminated
+		if isContaminated {
+			contEdits = rng.Intn(sim.ContEdits + 1)
+			sampleEdits = contEdits + 1 + rng.Intn(2)
+			contaminated++
+		} else if rng.Float64() < sim.CrossMapped {
+			contEdits = sampleEdits + 2 + rng.Intn(2)
+		}
+		for _, line := range syntheticPair(rng, name, sim.ReadLen, sampleEdits, sampleEdits) {
+			fmt.Fprintln(sample, line)
+		}
+		if contEdits >= 0 {
+			for _, line := range syntheticPair(rng, name, sim.ReadLen, contEdits, contEdits) {
+				fmt.Fprintln(cont, line)
+			}
+		}
+		fmt.Fprintf(truth, "%s\t%t\n", name, isContaminated)
+	}
+
+	for _, w := range []*bufio.Writer{sample, cont, truth} {
+		if err := w.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	if err := truthfp.Close(); err != nil {
+		return 0, err
+	}
+	samplefp.Close()
+	contfp.Close()
+	sampleOut.Wait()
+	contOut.Wait()
+	for _, w := range []*BamWriter{&sampleOut, &contOut} {
+		if err := w.Finish(); err != nil {
+			return 0, err
+		}
+	}
+	return contaminated, nil
+}
+
+// contfilter simulate [options] -o prefix
+//
+// Make a small sample and contamination mapping with a known set of
+// contaminated reads, as prefix.sample.bam, prefix.cont.bam and
+// prefix.truth.tsv, for trying out the filter and its parameters.
+func simulateMain(argv []string) {
+	sim := &Simulation{}
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	prefix := flags.String("o", "", "prefix of the files to write (required)")
+	flags.IntVar(&sim.Reads, "reads", 10000, "number of read pairs")
+	flags.IntVar(&sim.ReadLen, "read-len", 100, "length of each mate")
+	flags.Float64Var(&sim.Contaminated, "contaminated", 0.1, "fraction of reads from the contaminant")
+	flags.Float64Var(&sim.CrossMapped, "cross-mapped", 0.1, "fraction of the other reads that also map, worse, to the contaminant")
+	flags.IntVar(&sim.SampleEdits, "sample-edit-dist", 2, "most edits in the sample alignment of an uncontaminated read")
+	flags.IntVar(&sim.ContEdits, "cont-edit-dist", 2, "most edits in the contamination alignment of a contaminated read")
+	flags.Int64Var(&sim.Seed, "seed", 1, "random seed")
+	flags.Usage = func() {
+		log.Println("usage: contfilter simulate [options] -o prefix")
+		flags.PrintDefaults()
+	}
+	flags.Parse(argv)
+	if *prefix == "" || flags.NArg() > 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	if sim.Contaminated < 0 || sim.Contaminated > 1 || sim.CrossMapped < 0 || sim.CrossMapped > 1 {
+		log.Println("-contaminated and -cross-mapped must be between 0 and 1")
+		os.Exit(1)
+	}
+	if sim.Reads < 1 || sim.ReadLen < 1 || sim.SampleEdits < 0 || sim.ContEdits < 0 {
+		log.Println("-reads and -read-len must be positive and edit distances not negative")
+		os.Exit(1)
+	}
+	OpenLogger()
+
+	samplefile := *prefix + ".sample.bam"
+	contfile := *prefix + ".cont.bam"
+	truthfile := *prefix + ".truth.tsv"
+	contaminated, err := sim.Write(samplefile, contfile, truthfile)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	logger.Printf("wrote %d read pairs, %d of them contaminated, to %s and %s with the truth in %s\n",
+		sim.Reads, contaminated, samplefile, contfile, truthfile)
+}
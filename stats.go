@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The version of the RunStats format. Fields may be added without changing
+// it; it goes up only when one is renamed, removed or changes meaning.
+const StatsVersion = 1
+
+// The counts from a run, logged as `stats` followed by this as JSON on one
+// line and written to -stats. All counts are of reads (both mates together)
+// unless named for mates or alignments.
+type RunStats struct {
+	Version    int    `json:"version"`
+	Contfilter string `json:"contfilter"`
+	Sample     string `json:"sample"`
+	TotalReads int    `json:"total_reads"`
+	// Left out by -subsample, and not counted in total_reads.
+	NotSampled      int `json:"not_sampled,omitempty"`
+	TotalMates      int `json:"total_read_mates"`
+	FlagFiltered    int `json:"flag_filtered"`
+	Unmapped        int `json:"unmapped"`
+	UnmappedMates   int `json:"unmapped_mates"`
+	Duplicates      int `json:"duplicates"`
+	Excluded        int `json:"excluded"`
+	InIntervals     int `json:"in_intervals"` // with -intervals, whether removed or not
+	Decoys          int `json:"decoy"`        // aligned to -decoy-contigs, whatever -decoy-action did with them
+	TooShort        int `json:"too_short"`
+	TooDiverged     int `json:"too_diverged"`
+	TooLittleMapped int `json:"too_little_mapped,omitempty"` // with -min-mapped-frac
+	TooManyNs       int `json:"too_many_ns,omitempty"`       // with -max-n-frac
+	LowComplexity   int `json:"low_complexity,omitempty"`    // with -dust
+	Malformed       int `json:"malformed"`
+	// Contamination records left out with -skip-malformed.
+	MalformedAlignments int `json:"malformed_alignments"`
+	Considered          int `json:"considered"`
+	// Whether a read was kept for a sample score greater than the best
+	// contaminant score plus the margin, or at-least that, as -keep-if says.
+	// It matters most at a margin of 0.
+	KeepIf   string `json:"keep_if,omitempty"`
+	Kept     int    `json:"reads_kept"`
+	Rejected int    `json:"reads_rejected"` // by any contamination file
+	// Within -ambiguous-window of the margin, so neither kept nor rejected.
+	Ambiguous int `json:"ambiguous,omitempty"`
+	// Kept though found in the contamination, the sample winning by more
+	// than the margin.
+	NearMisses    int `json:"near_misses"`
+	KeptMates     int `json:"read_mates_kept"`
+	Secondary     int `json:"secondary_kept"`
+	Supplementary int `json:"supplementary_kept"`
+	Singletons    int `json:"singletons_kept"`
+	// The algorithm and digest of the sample as read, with -checksums.
+	SampleChecksum string `json:"sample_checksum,omitempty"`
+	// With -kraken, how its classification compared to the rejections.
+	Kraken *KrakenConcordance `json:"kraken,omitempty"`
+	// With -max-time, whether the run stopped before the end of the sample,
+	// and the last read it did. With -resume, the read it carried on after.
+	Partial      bool   `json:"partial,omitempty"`
+	StoppedAfter string `json:"stopped_after,omitempty"`
+	ResumedAfter string `json:"resumed_after,omitempty"`
+	// Memory use and garbage collection, as of the end of the run.
+	Resources *ResourceStats `json:"resources,omitempty"`
+	// One entry for each contamination file, in the order given.
+	Contaminants []ContaminantStats `json:"contaminants"`
+}
+
+type ContaminantStats struct {
+	Filename    string `json:"filename"`
+	Label       string `json:"label,omitempty"`
+	Found       int    `json:"found"`
+	Rejected    int    `json:"rejected"`
+	Prefiltered int    `json:"prefiltered"`     // not looked up, being absent from its -prefilter
+	Skipped     int    `json:"short_circuited"` // not compared, having been rejected already
+	// Rejected only by alignments in -blacklist regions, and so kept with
+	// -blacklist-action ignore.
+	Blacklisted int    `json:"blacklisted"`
+	Checksum    string `json:"checksum,omitempty"`
+}
+
+func (s *RunStats) String() string {
+	blob, err := json.Marshal(s)
+	if err != nil {
+		panic(err)
+	}
+	return string(blob)
+}
+
+// Write the stats to a file, or stdout for -.
+func (s *RunStats) Write(filename string) error {
+	blob, err := json.MarshalIndent(s, "", "    ")
+	if err != nil {
+		return err
+	}
+	blob = append(blob, '\n')
+	if filename == "-" {
+		_, err := os.Stdout.Write(blob)
+		return err
+	}
+	return os.WriteFile(filename, blob, 0666)
+}
+
+// Join differing names, such as those of the samples of merged stats.
+func mergeNames(a, b string) string {
+	if a == "" || b == "" {
+		return a + b
+	}
+	for _, name := range strings.Split(a, ",") {
+		if name == b {
+			return a
+		}
+	}
+	return a + "," + b
+}
+
+// Add the counts of another run, such as another shard of the same sample.
+// Contaminants are matched up by file name.
+func (s *RunStats) Add(other *RunStats) {
+	s.Sample = mergeNames(s.Sample, other.Sample)
+	s.Contfilter = mergeNames(s.Contfilter, other.Contfilter)
+	s.SampleChecksum = mergeNames(s.SampleChecksum, other.SampleChecksum)
+	s.KeepIf = mergeNames(s.KeepIf, other.KeepIf)
+	s.TotalReads += other.TotalReads
+	s.NotSampled += other.NotSampled
+	s.TotalMates += other.TotalMates
+	s.FlagFiltered += other.FlagFiltered
+	s.Unmapped += other.Unmapped
+	s.UnmappedMates += other.UnmappedMates
+	s.Duplicates += other.Duplicates
+	s.Excluded += other.Excluded
+	s.InIntervals += other.InIntervals
+	s.Decoys += other.Decoys
+	s.TooShort += other.TooShort
+	s.TooDiverged += other.TooDiverged
+	s.TooLittleMapped += other.TooLittleMapped
+	s.TooManyNs += other.TooManyNs
+	s.LowComplexity += other.LowComplexity
+	s.Malformed += other.Malformed
+	s.MalformedAlignments += other.MalformedAlignments
+	s.Considered += other.Considered
+	s.Kept += other.Kept
+	s.Rejected += other.Rejected
+	s.Ambiguous += other.Ambiguous
+	s.NearMisses += other.NearMisses
+	s.KeptMates += other.KeptMates
+	s.Secondary += other.Secondary
+	s.Supplementary += other.Supplementary
+	s.Singletons += other.Singletons
+	if other.Kraken != nil {
+		if s.Kraken == nil {
+			s.Kraken = &KrakenConcordance{}
+		}
+		s.Kraken.Add(other.Kraken)
+	}
+	switch {
+	case s.Partial && other.ResumedAfter == s.StoppedAfter:
+		// other carries on from this one, so together they go as far as it.
+		s.Partial, s.StoppedAfter = other.Partial, other.StoppedAfter
+	case other.Partial && s.ResumedAfter == other.StoppedAfter:
+		s.ResumedAfter = other.ResumedAfter
+	case other.Partial:
+		s.Partial = true
+		s.StoppedAfter = mergeNames(s.StoppedAfter, other.StoppedAfter)
+	}
+	if other.Resources != nil {
+		if s.Resources == nil {
+			s.Resources = &ResourceStats{}
+		}
+		s.Resources.Add(other.Resources)
+	}
+	for _, cont := range other.Contaminants {
+		i := s.contaminant(cont.Key())
+		if i < 0 {
+			s.Contaminants = append(s.Contaminants, ContaminantStats{Filename: cont.Filename, Label: cont.Label})
+			i = len(s.Contaminants) - 1
+		}
+		s.Contaminants[i].Found += cont.Found
+		s.Contaminants[i].Rejected += cont.Rejected
+		s.Contaminants[i].Prefiltered += cont.Prefiltered
+		s.Contaminants[i].Skipped += cont.Skipped
+		s.Contaminants[i].Blacklisted += cont.Blacklisted
+		s.Contaminants[i].Checksum = mergeNames(s.Contaminants[i].Checksum, cont.Checksum)
+	}
+}
+
+// What a contaminant is known by across runs: its label, or else the base
+// name of its file, so shards run from different directories or with their
+// own scratch copies still match up.
+func (c ContaminantStats) Key() string {
+	if c.Label != "" {
+		return c.Label
+	}
+	return filepath.Base(c.Filename)
+}
+
+// The index of the entry of the contaminant with this Key, or -1.
+func (s *RunStats) contaminant(key string) int {
+	for i, cont := range s.Contaminants {
+		if cont.Key() == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// How the run fails the -fail-if thresholds, which are fractions and not
+// checked when negative.
+func (s *RunStats) Failures(rejectedAbove, keptBelow float64) []string {
+	failures := []string{}
+	if rejectedAbove >= 0 && s.Considered > 0 {
+		if frac := float64(s.Rejected) / float64(s.Considered); frac > rejectedAbove {
+			failures = append(failures, fmt.Sprintf("rejected %0.2f%% of the reads compared, more than %0.2f%%",
+				frac*100, rejectedAbove*100))
+		}
+	}
+	if keptBelow >= 0 && s.TotalReads > 0 {
+		if frac := float64(s.Kept) / float64(s.TotalReads); frac < keptBelow {
+			failures = append(failures, fmt.Sprintf("kept %0.2f%% of the reads, less than %0.2f%%",
+				frac*100, keptBelow*100))
+		}
+	}
+	return failures
+}
+
+// Read stats written by -stats, refusing a version we don't know.
+func ReadStats(filename string) (*RunStats, error) {
+	blob, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	s := &RunStats{}
+	if err := json.Unmarshal(blob, s); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	if s.Version != StatsVersion {
+		return nil, fmt.Errorf("%s: stats version %d, expected %d", filename, s.Version, StatsVersion)
+	}
+	return s, nil
+}
+
+// contfilter stats-merge [-o merged.json] run1.json run2.json ...
+//
+// Add up the -stats of runs over parts of a sample, e.g. shards filtered in
+// parallel, into the stats of the whole.
+func statsMergeMain(argv []string) {
+	flags := flag.NewFlagSet("stats-merge", flag.ExitOnError)
+	output := flags.String("o", "-", "file to write the merged stats to")
+	flags.Usage = func() {
+		log.Println("usage: contfilter stats-merge [-o merged.json] run1.json run2.json ...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(argv)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	var merged *RunStats
+	for _, filename := range flags.Args() {
+		stats, err := ReadStats(filename)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if merged == nil {
+			merged = stats
+			continue
+		}
+		merged.Add(stats)
+	}
+	if err := merged.Write(*output); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// A count from two runs being compared, and the same as a percentage of the
+// reads it is out of.
+type statsDelta struct {
+	name     string
+	a, b     int
+	aOf, bOf int
+	missing  string // the run without it, if only one has it
+}
+
+func percent(n, of int) float64 {
+	if of == 0 {
+		return 0
+	}
+	return float64(n) / float64(of) * 100
+}
+
+// The counts to compare between runs. Rates of the contaminants are out of
+// the reads considered.
+func statsDeltas(a, b *RunStats) []statsDelta {
+	deltas := []statsDelta{
+		{name: "considered", a: a.Considered, b: b.Considered, aOf: a.TotalReads, bOf: b.TotalReads},
+		{name: "reads_kept", a: a.Kept, b: b.Kept, aOf: a.Considered, bOf: b.Considered},
+		{name: "reads_rejected", a: a.Rejected, b: b.Rejected, aOf: a.Considered, bOf: b.Considered},
+		{name: "ambiguous", a: a.Ambiguous, b: b.Ambiguous, aOf: a.Considered, bOf: b.Considered},
+		{name: "near_misses", a: a.NearMisses, b: b.NearMisses, aOf: a.Considered, bOf: b.Considered},
+	}
+	seen := make(map[string]bool)
+	for _, cont := range a.Contaminants {
+		key := cont.Key()
+		seen[key] = true
+		found := statsDelta{name: key + " found", a: cont.Found, aOf: a.Considered, bOf: b.Considered}
+		rejected := statsDelta{name: key + " rejected", a: cont.Rejected, aOf: a.Considered, bOf: b.Considered}
+		if i := b.contaminant(key); i >= 0 {
+			found.b = b.Contaminants[i].Found
+			rejected.b = b.Contaminants[i].Rejected
+		} else {
+			found.missing, rejected.missing = "b", "b"
+		}
+		deltas = append(deltas, found, rejected)
+	}
+	for _, cont := range b.Contaminants {
+		key := cont.Key()
+		if seen[key] {
+			continue
+		}
+		deltas = append(deltas,
+			statsDelta{name: key + " found", b: cont.Found, aOf: a.Considered, bOf: b.Considered, missing: "a"},
+			statsDelta{name: key + " rejected", b: cont.Rejected, aOf: a.Considered, bOf: b.Considered, missing: "a"})
+	}
+	return deltas
+}
+
+// contfilter stats-diff [-max-diff points] a.json b.json
+//
+// Print how the counts and rates of two runs differ, such as runs with
+// different parameters or versions of the same sample. With -max-diff it
+// exits with status 2 if any rate differs by more than that many percentage
+// points, or a contamination file is in only one of them, for use as a
+// regression check.
+func statsDiffMain(argv []string) {
+	flags := flag.NewFlagSet("stats-diff", flag.ExitOnError)
+	maxDiff := flags.Float64("max-diff", -1, "exit with status 2 when a rate differs by more than this many percentage points")
+	flags.Usage = func() {
+		log.Println("usage: contfilter stats-diff [-max-diff points] a.json b.json")
+		flags.PrintDefaults()
+	}
+	flags.Parse(argv)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	a, err := ReadStats(flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	b, err := ReadStats(flags.Arg(1))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	fmt.Fprintln(w, "count\ta\tb\ta_percent\tb_percent\tpercent_difference")
+	exceeded := []string{}
+	for _, d := range statsDeltas(a, b) {
+		if d.missing != "" {
+			av, bv := strconv.Itoa(d.a), strconv.Itoa(d.b)
+			if d.missing == "a" {
+				av = "NA"
+			} else {
+				bv = "NA"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\tNA\tNA\tNA\n", d.name, av, bv)
+			exceeded = append(exceeded, fmt.Sprintf("%s is missing from %s", d.name, d.missing))
+			continue
+		}
+		ap, bp := percent(d.a, d.aOf), percent(d.b, d.bOf)
+		fmt.Fprintf(w, "%s\t%d\t%d\t%0.2f\t%0.2f\t%0.2f\n", d.name, d.a, d.b, ap, bp, bp-ap)
+		if *maxDiff >= 0 && math.Abs(bp-ap) > *maxDiff {
+			exceeded = append(exceeded, fmt.Sprintf("%s differs by %0.2f percentage points", d.name, bp-ap))
+		}
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatal(err)
+	}
+	if a.KeepIf != b.KeepIf && a.KeepIf != "" && b.KeepIf != "" {
+		log.Printf("the runs kept reads by different comparisons: %s in a, %s in b\n", a.KeepIf, b.KeepIf)
+	}
+	if *maxDiff >= 0 && len(exceeded) > 0 {
+		for _, msg := range exceeded {
+			log.Println(msg)
+		}
+		os.Exit(2)
+	}
+}
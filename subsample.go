@@ -0,0 +1,25 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+)
+
+// Whether a read is in the -subsample, which goes by a hash of its name and
+// the -seed, so the same reads are picked whatever order or shard they come
+// in, and both mates go together.
+func Sampled(read string, fraction float64, seed int64) bool {
+	h := fnv.New64a()
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(seed))
+	h.Write(b[:])
+	io.WriteString(h, read)
+	// FNV leaves names differing only at the end too alike in the high bits,
+	// so mix them (as splitmix64 does) before taking a fraction of them.
+	x := h.Sum64()
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	x ^= x >> 31
+	return float64(x>>11)/float64(1<<53) < fraction
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// FloatList is a comma separated list of numbers given to a flag.
+type FloatList []float64
+
+func (f *FloatList) String() string {
+	values := []string{}
+	for _, v := range *f {
+		values = append(values, strconv.FormatFloat(v, 'g', -1, 64))
+	}
+	return strings.Join(values, ",")
+}
+
+func (f *FloatList) Set(value string) error {
+	*f = nil
+	for _, field := range strings.Split(value, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return err
+		}
+		*f = append(*f, v)
+	}
+	return nil
+}
+
+// A grid of margins and edit penalties tried on every read alongside the ones
+// the filter goes by, for -sweep. Each combination stands in for the margin
+// and edit penalty of every contamination mapping, overrides included.
+type Sweep struct {
+	Margins    []float64
+	Penalties  []float64
+	Considered int
+	Rejected   []int // by combination, penalties varying fastest
+	rejecting  []bool
+}
+
+func NewSweep(margins, penalties []float64) *Sweep {
+	n := len(margins) * len(penalties)
+	return &Sweep{
+		Margins:   margins,
+		Penalties: penalties,
+		Rejected:  make([]int, n),
+		rejecting: make([]bool, n),
+	}
+}
+
+// Start on a read that made it past preliminary filtering. Like Add and End
+// this does nothing without -sweep.
+func (s *Sweep) Begin() {
+	if s == nil {
+		return
+	}
+	s.Considered++
+	for i := range s.rejecting {
+		s.rejecting[i] = false
+	}
+}
+
+// Compare the read against one contamination mapping with each combination.
+func (s *Sweep) Add(read string, mate1, mate2 *Mate, pair bool, cont *Contaminant, records [][]string) error {
+	if s == nil || len(records) == 0 {
+		return nil
+	}
+	for i := range s.rejecting {
+		if s.rejecting[i] {
+			continue
+		}
+		variant := *cont
+		variant.Margin = s.Margins[i/len(s.Penalties)]
+		variant.Penalty = s.Penalties[i%len(s.Penalties)]
+		result, err := compare(read, mate1, mate2, pair, &variant, records, false)
+		if err != nil {
+			return err
+		}
+		s.rejecting[i] = result.Rejected
+	}
+	return nil
+}
+
+func (s *Sweep) End() {
+	if s == nil {
+		return
+	}
+	for i, rejected := range s.rejecting {
+		if rejected {
+			s.Rejected[i]++
+		}
+	}
+}
+
+// Write a table of how many reads each combination keeps and rejects.
+func (s *Sweep) Write(filename string) error {
+	fp, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(fp)
+	fmt.Fprintln(w, "margin\tedit_penalty\tconsidered\tkept\trejected")
+	for i, rejected := range s.Rejected {
+		fmt.Fprintf(w, "%g\t%g\t%d\t%d\t%d\n", s.Margins[i/len(s.Penalties)], s.Penalties[i%len(s.Penalties)],
+			s.Considered, s.Considered-rejected, rejected)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return fp.Close()
+}
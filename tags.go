@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Which optional fields of kept reads to write, from -keep-tags or
+// -strip-tags, or nil to write them all.
+type TagFilter struct {
+	keep bool // only write the tags listed, rather than all but them
+	tags map[string]bool
+}
+
+var outputTags *TagFilter
+
+// A filter from a comma separated list of two letter tags, e.g. OQ,BI,BD.
+func NewTagFilter(list string, keep bool) (*TagFilter, error) {
+	f := &TagFilter{keep: keep, tags: make(map[string]bool)}
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.TrimSpace(tag)
+		if len(tag) != 2 || !isAlpha(tag[0]) || !(isAlpha(tag[1]) || isDigit(tag[1])) {
+			return nil, fmt.Errorf("bad tag %q, expected two letters like OQ", tag)
+		}
+		f.tags[tag] = true
+	}
+	return f, nil
+}
+
+// The record without the tags that aren't to be written. The record itself is
+// left as it was, as it may still be needed.
+func (f *TagFilter) Apply(record []string) []string {
+	if f == nil || len(record) <= 11 {
+		return record
+	}
+	filtered := make([]string, 11, len(record))
+	copy(filtered, record[:11])
+	for _, field := range record[11:] {
+		if len(field) >= 2 && f.tags[field[:2]] == f.keep {
+			filtered = append(filtered, field)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// Tally of what `contfilter validate` found in a BAM file.
+type Validation struct {
+	Records  int
+	Reads    int
+	Problems int
+	reported int
+	limit    int
+}
+
+func (v *Validation) Report(line int, read, format string, a ...interface{}) {
+	v.Problems++
+	if v.limit > 0 && v.reported >= v.limit {
+		return
+	}
+	v.reported++
+	log.Printf("line %d: read %s: %s\n", line, read, fmt.Sprintf(format, a...))
+}
+
+// Check a BAM file for what the filter relies on: records grouped and sorted by
+// read name in the given order, at most two primary records per read and an
+// edit distance tag on every mapped record, and with -strict, the SAM spec.
+func Validate(bamfile string, aligner *Aligner, order string, limit int) (*Validation, error) {
+	cmp := strnum_cmp
+	if order == "lexicographic" {
+		cmp = strings.Compare
+	}
+	cmd := openView(bamfile)
+	input, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed creating pipe: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("command failed to start: %v", err)
+	}
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 64*1024), maxRecordSize)
+
+	v := &Validation{limit: limit}
+	prev := ""
+	primaries := 0
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			v.Report(lineNumber, "", "empty record")
+			continue
+		}
+		record := strings.Split(line, "\t")
+		read := record[0]
+		v.Records++
+		if len(record) < 11 {
+			v.Report(lineNumber, read, "only %d fields", len(record))
+			continue
+		}
+		flag, err := recordFlag(record)
+		if err != nil {
+			v.Report(lineNumber, read, "%v", err)
+			continue
+		}
+		if strictRecords {
+			if err := CheckRecord(record); err != nil {
+				v.Report(lineNumber, read, "%v", err)
+			}
+		}
+		if read != prev {
+			if prev != "" && cmp(prev, read) > 0 {
+				v.Report(lineNumber, read, "comes after %s, out of %s order", prev, order)
+			}
+			prev = read
+			primaries = 0
+			v.Reads++
+		}
+		if flag&(FlagSecondary|FlagSupplementary) == 0 {
+			primaries++
+			if primaries == 3 {
+				v.Report(lineNumber, read, "more than two primary records")
+			}
+		}
+		if flag&FlagUnmapped == 0 {
+			if _, ok := findTag(record, aligner.EditTag); !ok {
+				v.Report(lineNumber, read, "no %s edit distance tag", aligner.EditTag)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		cmd.Wait()
+		return nil, scanError(bamfile, err)
+	}
+	if err := cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("samtools view %s failed: %v", bamfile, err)
+	}
+	return v, nil
+}
+
+// contfilter validate [options] file.bam ...
+func validateMain(argv []string) {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	flags.StringVar(&args.EditTag, "edit-tag", "auto", "tag holding the edit distance, or auto to go by the aligner named in the @PG header")
+	flags.StringVar(&args.SortOrder, "sort-order", "auto", "read name ordering to check for: natural (samtools), lexicographic or auto (from the @HD header)")
+	flags.BoolVar(&strictRecords, "strict", false, "also check every record against the SAM spec, as -strict does when filtering")
+	limit := flags.Int("max-report", 20, "report at most this many problems per file, 0 for all")
+	flags.Usage = func() {
+		log.Println("usage: contfilter validate [options] file.bam ...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(argv)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	switch args.SortOrder {
+	case "auto", "natural", "lexicographic":
+	default:
+		log.Println("-sort-order must be one of auto, natural or lexicographic")
+		os.Exit(1)
+	}
+	OpenLogger()
+
+	failed := false
+	for _, bamfile := range flags.Args() {
+		header, err := ReadBamHeader(bamfile)
+		if err != nil {
+			log.Fatalf("%s: %v", bamfile, err)
+		}
+		order := args.SortOrder
+		if order == "auto" {
+			order = ParseHeaderOrder(header).NameOrder()
+			if order == "" {
+				order = "natural"
+			}
+		}
+		aligner := ChooseAligner(bamfile, header)
+		v, err := Validate(bamfile, aligner, order, *limit)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if v.Problems > v.reported {
+			log.Printf("... and %d more\n", v.Problems-v.reported)
+		}
+		log.Printf("%s: %d records of %d reads, %d problems\n", bamfile, v.Records, v.Reads, v.Problems)
+		if v.Problems > 0 {
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}